@@ -0,0 +1,100 @@
+package autodelete
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A backlog alert tells the operator that a channel is tracking more messages
+// than expected, usually because the bot has fallen behind or the channel is
+// misconfigured. It fires once when the count goes over the threshold and is
+// re-armed when the count drops back under it. However often a channel
+// flaps, it alerts at most once per backlogAlertInterval.
+
+// BacklogAlert is the JSON body POSTed to the backlog alert webhook.
+type BacklogAlert struct {
+	Time      time.Time `json:"time"`
+	ChannelID string    `json:"channel_id"`
+	Channel   string    `json:"channel"`
+	GuildID   string    `json:"guild_id"`
+	Count     int       `json:"count"`
+	Threshold int       `json:"threshold"`
+}
+
+const backlogAlertTimeout = 10 * time.Second
+
+// checkBacklog sends an alert if the channel has just gone over the backlog
+// threshold. Call it with the mutex unlocked, after anything that changes
+// the number of tracked messages.
+func (b *Bot) checkBacklog(c *ManagedChannel) {
+	threshold := b.Config.BacklogAlert
+	if threshold <= 0 {
+		return
+	}
+	now := b.now()
+	c.mu.Lock()
+	count := len(c.liveMessages)
+	if count <= threshold {
+		c.backlogAlerted = false
+		c.mu.Unlock()
+		return
+	}
+	if c.backlogAlerted || now.Sub(c.lastBacklogAlert) < b.backlogAlertInterval() {
+		c.mu.Unlock()
+		return
+	}
+	c.backlogAlerted = true
+	c.lastBacklogAlert = now
+	c.mu.Unlock()
+
+	alert := BacklogAlert{
+		Time:      now,
+		ChannelID: c.Channel.ID,
+		Channel:   c.Channel.Name,
+		GuildID:   c.Channel.GuildID,
+		Count:     count,
+		Threshold: threshold,
+	}
+	fmt.Printf("[alrt] %s #%s is tracking %d messages, over the threshold of %d\n", alert.ChannelID, alert.Channel, count, threshold)
+	go b.sendBacklogAlert(alert)
+}
+
+func (b *Bot) sendBacklogAlert(alert BacklogAlert) {
+	if url := b.Config.BacklogAlertWebhook; url != "" {
+		err := postBacklogAlert(url, alert)
+		if err != nil {
+			fmt.Println("[alrt] could not send backlog alert to webhook:", err)
+		}
+	}
+	if user := b.Config.BacklogAlertUser; user != "" {
+		dm, err := b.s.UserChannelCreate(user)
+		if err == nil {
+			_, err = b.s.ChannelMessageSend(dm.ID, fmt.Sprintf(
+				"Backlog alert: <#%s> (%s) in server %s is tracking %d messages, over the threshold of %d.",
+				alert.ChannelID, alert.ChannelID, alert.GuildID, alert.Count, alert.Threshold))
+		}
+		if err != nil {
+			fmt.Println("[alrt] could not DM backlog alert to", user, ":", err)
+		}
+	}
+}
+
+func postBacklogAlert(url string, alert BacklogAlert) error {
+	by, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: backlogAlertTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(by))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("backlog alert webhook: %s", resp.Status)
+	}
+	return nil
+}
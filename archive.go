@@ -0,0 +1,160 @@
+package autodelete
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// An ArchivedMessage is the record of a message kept by an ArchiveSink.
+type ArchivedMessage struct {
+	ID          string    `json:"id"`
+	ChannelID   string    `json:"channel_id"`
+	GuildID     string    `json:"guild_id,omitempty"`
+	AuthorID    string    `json:"author_id,omitempty"`
+	Author      string    `json:"author,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Content     string    `json:"content"`
+	Attachments []string  `json:"attachments,omitempty"`
+}
+
+// An ArchiveSink saves messages before they are deleted. If Archive returns
+// an error, the messages are not deleted and the channel is retried later.
+type ArchiveSink interface {
+	Archive(ctx context.Context, msgs []ArchivedMessage) error
+}
+
+// How long to wait before retrying a channel whose archive failed.
+const archiveRetryDelay = 1 * time.Minute
+
+func newArchivedMessage(guildID string, m *discordgo.Message, ts time.Time) ArchivedMessage {
+	a := ArchivedMessage{
+		ID:        m.ID,
+		ChannelID: m.ChannelID,
+		GuildID:   guildID,
+		Timestamp: ts,
+		Content:   m.Content,
+	}
+	if m.Author != nil {
+		a.AuthorID = m.Author.ID
+		a.Author = m.Author.Username + "#" + m.Author.Discriminator
+		a.AvatarURL = m.Author.AvatarURL("")
+	}
+	for _, v := range m.Attachments {
+		a.Attachments = append(a.Attachments, v.URL)
+	}
+	return a
+}
+
+// rememberForArchive keeps what the archive sink needs to know about a
+// message, if there is a sink or the channel moves its messages.
+// Must be called with the mutex held.
+func (c *ManagedChannel) rememberForArchive(m *discordgo.Message, ts time.Time) {
+	if c.bot.archive == nil && c.MoveTo == "" {
+		return
+	}
+	if c.archive == nil {
+		c.archive = make(map[string]ArchivedMessage)
+	}
+	c.archive[m.ID] = newArchivedMessage(c.Channel.GuildID, m, ts)
+}
+
+// archivedMessages returns the archive records for the given message IDs.
+// Messages we have no record of are archived with just their ID and time.
+func (c *ManagedChannel) archivedMessages(msgs []string) []ArchivedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]ArchivedMessage, 0, len(msgs))
+	for _, id := range msgs {
+		a, ok := c.archive[id]
+		if !ok {
+			a = ArchivedMessage{ID: id, ChannelID: c.Channel.ID, GuildID: c.Channel.GuildID, Timestamp: snowflakeTime(id)}
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// forgetArchived drops the archive records for messages that are gone.
+func (c *ManagedChannel) forgetArchived(msgs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range msgs {
+		delete(c.archive, id)
+	}
+}
+
+// FileArchive appends each message as a line of JSON to a file.
+type FileArchive struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (f *FileArchive) Archive(ctx context.Context, msgs []ArchivedMessage) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, m := range msgs {
+		err := enc.Encode(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		// The messages are deleted as soon as we return
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// WebhookArchive POSTs each batch of messages to a URL as a JSON array.
+// Any response other than 2xx counts as a failure.
+type WebhookArchive struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *WebhookArchive) Archive(ctx context.Context, msgs []ArchivedMessage) error {
+	by, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(by))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("archive webhook: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package autodelete
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An AuditRecord is the audit log entry for one reap.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	ChannelID string    `json:"channel_id"`
+	GuildID   string    `json:"guild_id,omitempty"`
+	Count     int       `json:"count"`
+	// "bulk", "single" or "mixed"
+	Method        string `json:"method"`
+	BulkDeleted   int    `json:"bulk_deleted"`
+	SingleDeleted int    `json:"single_deleted"`
+	// Set if the reap stopped early; Count is what went before that.
+	Error string `json:"error,omitempty"`
+}
+
+// An AuditSink keeps an append-only record of deletions. A failure to write
+// is logged, and doesn't stop anything from being deleted.
+type AuditSink interface {
+	Audit(ctx context.Context, rec AuditRecord) error
+}
+
+const auditTimeout = 10 * time.Second
+
+// A Flusher is an archive or audit sink that holds on to what it is given
+// before writing it. Drain calls Flush once the workers are done, and Close
+// after that if the sink has one. Flush returns how many records were still
+// unwritten when ctx expired; those are lost.
+type Flusher interface {
+	Flush(ctx context.Context) (dropped int, err error)
+}
+
+// flushSinks flushes and closes the archive and audit sinks at shutdown.
+func (b *Bot) flushSinks(ctx context.Context) error {
+	var firstErr error
+	for _, sink := range []interface{}{b.archive, b.auditSink} {
+		if sink == nil {
+			continue
+		}
+		if f, ok := sink.(Flusher); ok {
+			dropped, err := f.Flush(ctx)
+			if dropped > 0 {
+				b.reaper.log.Error("records dropped at shutdown", "sink", fmt.Sprintf("%T", sink), "dropped", dropped, "error", err)
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func newAuditRecord(ch *ManagedChannel, res ReapResult) AuditRecord {
+	rec := AuditRecord{
+		Time:          time.Now(),
+		ChannelID:     ch.Channel.ID,
+		GuildID:       ch.Channel.GuildID,
+		Count:         res.Deleted(),
+		BulkDeleted:   res.BulkDeleted,
+		SingleDeleted: res.SingleDeleted,
+	}
+	switch {
+	case res.BulkDeleted > 0 && res.SingleDeleted > 0:
+		rec.Method = "mixed"
+	case res.BulkDeleted > 0:
+		rec.Method = "bulk"
+	default:
+		rec.Method = "single"
+	}
+	if res.Err != nil {
+		rec.Error = res.Err.Error()
+	}
+	return rec
+}
+
+// audit records a reap that deleted anything.
+func (b *Bot) audit(ch *ManagedChannel, res ReapResult) {
+	if b.auditSink == nil || res.Deleted() == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	err := b.auditSink.Audit(ctx, newAuditRecord(ch, res))
+	if err != nil {
+		b.reaper.log.Error("could not write audit record", "channel_id", ch.Channel.ID, "count", res.Deleted(), "error", err)
+	}
+}
+
+var errAuditClosed = errors.New("audit log is closed")
+
+// BufferedAudit queues records for another AuditSink and writes them in the
+// background, so a slow sink doesn't hold up the workers. Audit only blocks
+// once size records are waiting. Write errors are logged and the record is
+// dropped.
+type BufferedAudit struct {
+	sink AuditSink
+	log  *slog.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan AuditRecord
+	done   chan struct{}
+	// records queued or being written. Accessed atomically.
+	pending int64
+}
+
+// NewBufferedAudit starts writing records to sink in the background.
+func NewBufferedAudit(sink AuditSink, size int, log *slog.Logger) *BufferedAudit {
+	a := &BufferedAudit{
+		sink:  sink,
+		log:   log,
+		queue: make(chan AuditRecord, size),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *BufferedAudit) run() {
+	defer close(a.done)
+	for rec := range a.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+		err := a.sink.Audit(ctx, rec)
+		cancel()
+		atomic.AddInt64(&a.pending, -1)
+		if err != nil {
+			a.log.Error("could not write audit record", "channel_id", rec.ChannelID, "count", rec.Count, "error", err)
+		}
+	}
+}
+
+func (a *BufferedAudit) Audit(ctx context.Context, rec AuditRecord) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return errAuditClosed
+	}
+	atomic.AddInt64(&a.pending, 1)
+	select {
+	case a.queue <- rec:
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt64(&a.pending, -1)
+		return ctx.Err()
+	}
+}
+
+// Flush stops taking records and waits for the queued ones to be written.
+func (a *BufferedAudit) Flush(ctx context.Context) (int, error) {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	select {
+	case <-a.done:
+		return 0, nil
+	case <-ctx.Done():
+		return int(atomic.LoadInt64(&a.pending)), ctx.Err()
+	}
+}
+
+// Close closes the underlying sink, if it has a Close method.
+func (a *BufferedAudit) Close() error {
+	if c, ok := a.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+const defaultAuditMaxSize = 10 << 20
+
+// FileAudit appends each record as a line of JSON to a file. Once the file
+// would grow past MaxSize bytes (10MB if zero) it is renamed to Path.1, the
+// old Path.1 to Path.2 and so on, keeping MaxBackups old files (1 if zero).
+type FileAudit struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu sync.Mutex
+}
+
+func (f *FileAudit) Audit(ctx context.Context, rec AuditRecord) error {
+	by, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	by = append(by, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.rotate(int64(len(by))); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(by)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rotate moves the file aside if writing n more bytes would take it over the
+// limit. Must be called with the mutex held.
+func (f *FileAudit) rotate(n int64) error {
+	max := f.MaxSize
+	if max <= 0 {
+		max = defaultAuditMaxSize
+	}
+	st, err := os.Stat(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if st.Size() == 0 || st.Size()+n <= max {
+		return nil
+	}
+	backups := f.MaxBackups
+	if backups <= 0 {
+		backups = 1
+	}
+	for i := backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.Path, f.Path+".1")
+}
+
+// WebhookAudit POSTs each record to a URL as JSON. Any response other than
+// 2xx counts as a failure.
+type WebhookAudit struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *WebhookAudit) Audit(ctx context.Context, rec AuditRecord) error {
+	by, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(by))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit webhook: %s", resp.Status)
+	}
+	return nil
+}
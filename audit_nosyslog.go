@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package autodelete
+
+// There is no syslog here, so audit_syslog is ignored.
+func newSyslogAudit(tag string) AuditSink {
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+
+package autodelete
+
+import (
+	"context"
+	"encoding/json"
+	"log/syslog"
+	"sync"
+)
+
+// SyslogAudit sends each record, as JSON, to the local syslog daemon.
+type SyslogAudit struct {
+	Tag string
+
+	mu sync.Mutex
+	w  *syslog.Writer
+}
+
+func (s *SyslogAudit) Audit(ctx context.Context, rec AuditRecord) error {
+	by, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		tag := s.Tag
+		if tag == "" {
+			tag = "autodelete"
+		}
+		s.w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.w.Info(string(by))
+	if err != nil {
+		// Reconnect next time
+		s.w.Close()
+		s.w = nil
+	}
+	return err
+}
+
+func (s *SyslogAudit) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
+
+func newSyslogAudit(tag string) AuditSink {
+	return &SyslogAudit{Tag: tag}
+}
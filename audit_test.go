@@ -0,0 +1,58 @@
+package autodelete_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+// memAudit keeps records in memory, slowly, so some are still buffered when
+// the bot shuts down.
+type memAudit struct {
+	mu   sync.Mutex
+	recs []autodelete.AuditRecord
+}
+
+func (a *memAudit) Audit(ctx context.Context, rec autodelete.AuditRecord) error {
+	time.Sleep(20 * time.Millisecond)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recs = append(a.recs, rec)
+	return nil
+}
+
+// Shutdown writes out every audit record still in the buffer.
+func TestShutdownFlushesAudit(t *testing.T) {
+	sink := &memAudit{}
+	h := autodeletetest.New(t, autodelete.Config{Audit: sink, AuditBuffer: 10, GuildWorkers: -1})
+	var chans []string
+	for _, name := range []string{"a", "b", "c"} {
+		ch := h.AddChannel(name)
+		h.Set(ch, "1h")
+		h.Post(ch, "hello")
+		chans = append(chans, ch)
+	}
+	h.Advance(61 * time.Minute)
+	h.WaitDeleted(len(chans))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Bot.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	got := make(map[string]int)
+	for _, rec := range sink.recs {
+		got[rec.ChannelID] += rec.Count
+	}
+	for _, ch := range chans {
+		if got[ch] != 1 {
+			t.Errorf("channel %s: audited %d deletions, want 1", ch, got[ch])
+		}
+	}
+}
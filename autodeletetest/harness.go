@@ -0,0 +1,695 @@
+// Package autodeletetest runs an AutoDelete bot against an in-memory fake of
+// the Discord REST API and a fake clock, so tests can post messages, move
+// time forward, and check what got deleted.
+//
+// A test looks like:
+//
+//	h := autodeletetest.New(t, autodelete.Config{})
+//	ch := h.AddChannel("general")
+//	h.Set(ch, "1h")
+//	old := h.Post(ch, "hello")
+//	h.Advance(61 * time.Minute)
+//	h.WaitDeleted(1) // []string{old}
+//
+// Only the API calls the bot makes are faked. Messages the bot posts are
+// not fed back to it as events, and neither are messages in threads, which
+// the gateway version the bot speaks doesn't send.
+package autodeletetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete"
+)
+
+// How long the Wait methods wait, in real time, before failing the test.
+const waitTimeout = 5 * time.Second
+
+// A Harness is a bot wired to a fake Discord.
+type Harness struct {
+	Bot     *autodelete.Bot
+	Session *discordgo.Session
+	Clock   *Clock
+	Guild   *discordgo.Guild
+	// Me is the bot, Owner owns the guild and sends commands, and User
+	// posts ordinary messages.
+	Me, Owner, User *discordgo.User
+
+	t        testing.TB
+	mu       sync.Mutex
+	seq      int64
+	channels map[string]*fakeChannel
+	deleted  []string
+	// "METHOD path" of every API call, oldest first
+	requests  []string
+	onRequest func(method, path string)
+}
+
+type fakeChannel struct {
+	ch       *discordgo.Channel
+	parentID string
+	archived bool
+	flags    int
+	// oldest first
+	msgs     []*discordgo.Message
+	pinned   map[string]bool
+	botPosts int
+}
+
+type nopLimiter struct{}
+
+func (nopLimiter) Wait(ctx context.Context) error { return ctx.Err() }
+
+// New starts a bot with the given config against a fresh fake Discord. Unset
+// fields get test-friendly values: a temporary data directory, a fake clock
+// at the current time, no rate limiting, no jitter, and quiet logs. The bot
+// is shut down when the test ends.
+func New(t testing.TB, conf autodelete.Config) *Harness {
+	t.Helper()
+	h := &Harness{
+		t:        t,
+		channels: make(map[string]*fakeChannel),
+	}
+	clock, ok := conf.Clock.(*Clock)
+	if !ok {
+		clock = NewClock(time.Now())
+		conf.Clock = clock
+	}
+	h.Clock = clock
+	if conf.DataDir == "" {
+		conf.DataDir = t.TempDir()
+	}
+	if conf.Limiter == nil {
+		conf.Limiter = nopLimiter{}
+	}
+	if conf.ReapJitter == 0 {
+		conf.ReapJitter = -1
+	}
+	if conf.Logger == nil {
+		conf.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	h.Me = &discordgo.User{ID: h.newID(), Username: "AutoDelete", Bot: true}
+	h.Owner = &discordgo.User{ID: h.newID(), Username: "owner"}
+	h.User = &discordgo.User{ID: h.newID(), Username: "user"}
+	h.Guild = &discordgo.Guild{ID: h.newID(), Name: "test", OwnerID: h.Owner.ID}
+
+	s, err := discordgo.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Client = &http.Client{Transport: transport{h}}
+	s.State.User = h.Me
+	s.State.GuildAdd(h.Guild)
+	h.Session = s
+
+	h.Bot = autodelete.New(conf)
+	err = h.Bot.ConnectSession(s, h.Me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+		defer cancel()
+		h.Bot.Shutdown(ctx)
+	})
+	return h
+}
+
+// newID returns a snowflake for the current fake time.
+func (h *Harness) newID() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.newIDLocked()
+}
+
+func (h *Harness) newIDLocked() string {
+	h.seq++
+	var now time.Time
+	if h.Clock != nil {
+		now = h.Clock.Now()
+	} else {
+		now = time.Now()
+	}
+	ms := now.UnixNano()/int64(time.Millisecond) - 1420070400000
+	return strconv.FormatInt(ms<<22|(h.seq&0x3fffff), 10)
+}
+
+// AddChannel creates a text channel in the guild and returns its ID.
+func (h *Harness) AddChannel(name string) string {
+	ch := &discordgo.Channel{
+		ID:      h.newID(),
+		GuildID: h.Guild.ID,
+		Name:    name,
+		Type:    discordgo.ChannelTypeGuildText,
+	}
+	h.mu.Lock()
+	h.channels[ch.ID] = &fakeChannel{ch: ch}
+	h.mu.Unlock()
+	h.Session.State.ChannelAdd(ch)
+	return ch.ID
+}
+
+// AddCategory creates a channel category in the guild and returns its ID.
+func (h *Harness) AddCategory(name string) string {
+	ch := &discordgo.Channel{
+		ID:      h.newID(),
+		GuildID: h.Guild.ID,
+		Name:    name,
+		Type:    discordgo.ChannelTypeGuildCategory,
+	}
+	h.mu.Lock()
+	h.channels[ch.ID] = &fakeChannel{ch: ch}
+	h.mu.Unlock()
+	h.Session.State.ChannelAdd(ch)
+	return ch.ID
+}
+
+// AddForum creates a forum channel in the guild and returns its ID. Its
+// posts are threads, started with AddThread.
+func (h *Harness) AddForum(name string) string {
+	ch := &discordgo.Channel{
+		ID:      h.newID(),
+		GuildID: h.Guild.ID,
+		Name:    name,
+		Type:    forumType,
+	}
+	h.mu.Lock()
+	h.channels[ch.ID] = &fakeChannel{ch: ch}
+	h.mu.Unlock()
+	h.Session.State.ChannelAdd(ch)
+	return ch.ID
+}
+
+// AddChannelIn creates a text channel in a category, as if it came in over
+// the gateway, and returns its ID.
+func (h *Harness) AddChannelIn(name, categoryID string) string {
+	id := h.AddChannel(name)
+	h.mu.Lock()
+	fc := h.channels[id]
+	fc.parentID = categoryID
+	h.mu.Unlock()
+	h.Bot.OnChannelCreate(h.Session, &discordgo.ChannelCreate{Channel: fc.ch})
+	return id
+}
+
+// MoveChannel puts a channel in another category, or in none if categoryID
+// is empty, and tells the bot.
+func (h *Harness) MoveChannel(channelID, categoryID string) {
+	h.mu.Lock()
+	fc := h.channels[channelID]
+	fc.parentID = categoryID
+	h.mu.Unlock()
+	h.Bot.OnChannelUpdate(h.Session, &discordgo.ChannelUpdate{Channel: fc.ch})
+}
+
+// AddThread starts a public thread in a channel, or a post in a forum, and
+// returns its ID. The bot isn't told; it finds threads by listing them.
+func (h *Harness) AddThread(parentID, name string) string {
+	ch := &discordgo.Channel{
+		ID:      h.newID(),
+		GuildID: h.Guild.ID,
+		Name:    name,
+		Type:    threadType,
+	}
+	h.mu.Lock()
+	h.channels[ch.ID] = &fakeChannel{ch: ch, parentID: parentID}
+	h.mu.Unlock()
+	return ch.ID
+}
+
+// ArchiveThread archives a thread, or unarchives it if archived is false,
+// without telling the bot.
+func (h *Harness) ArchiveThread(threadID string, archived bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.channels[threadID].archived = archived
+}
+
+// PinPost pins a post in a forum without telling the bot.
+func (h *Harness) PinPost(postID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.channels[postID].flags |= channelFlagPinned
+}
+
+// Archived reports whether a thread or post is archived.
+func (h *Harness) Archived(threadID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.channels[threadID].archived
+}
+
+// Post sends a message from User to the channel, as if it came in over the
+// gateway, and returns its ID.
+func (h *Harness) Post(channelID, content string) string {
+	return h.PostMessage(&discordgo.Message{ChannelID: channelID, Content: content})
+}
+
+// PostMessage is like Post for a message built by the caller, for instance
+// with attachments. ID, Timestamp and Author are filled in if empty.
+func (h *Harness) PostMessage(m *discordgo.Message) string {
+	h.t.Helper()
+	h.mu.Lock()
+	fc := h.channels[m.ChannelID]
+	if fc == nil {
+		h.mu.Unlock()
+		h.t.Fatalf("no such channel %s", m.ChannelID)
+	}
+	if m.ID == "" {
+		m.ID = h.newIDLocked()
+	}
+	if m.Timestamp == "" {
+		m.Timestamp = discordgo.Timestamp(h.Clock.Now().Format(time.RFC3339Nano))
+	}
+	if m.Author == nil {
+		m.Author = h.User
+	}
+	fc.msgs = append(fc.msgs, m)
+	thread := fc.ch.Type == threadType
+	h.mu.Unlock()
+
+	if !thread {
+		h.Bot.OnMessage(h.Session, &discordgo.MessageCreate{Message: m})
+	}
+	return m.ID
+}
+
+// Command sends "@AutoDelete <args>" from Owner and waits for the bot to
+// reply in the channel.
+func (h *Harness) Command(channelID string, args ...string) {
+	h.t.Helper()
+	h.mu.Lock()
+	before := h.channels[channelID].botPosts
+	h.mu.Unlock()
+
+	m := &discordgo.Message{
+		ID:        h.newID(),
+		ChannelID: channelID,
+		Content:   "<@" + h.Me.ID + "> " + strings.Join(args, " "),
+		Timestamp: discordgo.Timestamp(h.Clock.Now().Format(time.RFC3339Nano)),
+		Author:    h.Owner,
+		Mentions:  []*discordgo.User{h.Me},
+	}
+	h.Bot.HandleMentions(h.Session, &discordgo.MessageCreate{Message: m})
+	h.waitFor("a reply to "+strings.Join(args, " "), func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.channels[channelID].botPosts > before
+	})
+}
+
+// Set runs the set command with the given arguments and waits until the
+// channel is in the reap queue.
+func (h *Harness) Set(channelID string, args ...string) {
+	h.t.Helper()
+	h.Command(channelID, append([]string{"set"}, args...)...)
+	h.waitFor("channel to be queued", func() bool {
+		for _, v := range h.Bot.QueueSnapshot() {
+			if v.ChannelID == channelID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Advance moves the fake clock forward, waking the scheduler if anything
+// came due.
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+}
+
+// Deleted returns the IDs of every message the bot has deleted so far, in
+// the order it deleted them.
+func (h *Harness) Deleted() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.deleted...)
+}
+
+// WaitDeleted waits until at least n messages have been deleted and returns
+// all deleted IDs, sorted. It fails the test if that takes too long.
+func (h *Harness) WaitDeleted(n int) []string {
+	h.t.Helper()
+	h.waitFor(strconv.Itoa(n)+" deletions", func() bool {
+		return len(h.Deleted()) >= n
+	})
+	ids := h.Deleted()
+	sort.Strings(ids)
+	return ids
+}
+
+// Pin pins a message without telling the bot, as if it happened while the
+// bot was disconnected.
+func (h *Harness) Pin(channelID, msgID string) {
+	h.t.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fc := h.channels[channelID]
+	if fc.find(msgID) == nil {
+		h.t.Fatalf("no message %s in %s", msgID, channelID)
+	}
+	if fc.pinned == nil {
+		fc.pinned = make(map[string]bool)
+	}
+	fc.pinned[msgID] = true
+}
+
+// Edit changes a message without telling the bot, for instance to add the
+// embed Discord generates for a link some time after it is posted.
+func (h *Harness) Edit(channelID, msgID string, edit func(m *discordgo.Message)) {
+	h.t.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := h.channels[channelID].find(msgID)
+	if m == nil {
+		h.t.Fatalf("no message %s in %s", msgID, channelID)
+	}
+	edit(m)
+}
+
+// Vanish removes a message without telling the bot, as if someone else
+// deleted it while the bot was disconnected. It doesn't count as deleted.
+func (h *Harness) Vanish(channelID, msgID string) {
+	h.t.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fc := h.channels[channelID]
+	for i, m := range fc.msgs {
+		if m.ID == msgID {
+			fc.msgs = append(fc.msgs[:i], fc.msgs[i+1:]...)
+			return
+		}
+	}
+	h.t.Fatalf("no message %s in %s", msgID, channelID)
+}
+
+// Requests counts the API calls the bot has made with the given method and a
+// path ending in suffix, such as "GET" and "/pins".
+func (h *Harness) Requests(method, suffix string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, r := range h.requests {
+		if strings.HasPrefix(r, method+" ") && strings.HasSuffix(r, suffix) {
+			n++
+		}
+	}
+	return n
+}
+
+// OnRequest has fn called with the method and path of every API call from
+// then on, before it is answered. fn runs without the harness locked, so it
+// may call the bot, and sees its own calls too.
+func (h *Harness) OnRequest(fn func(method, path string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onRequest = fn
+}
+
+// WaitRequest waits until Requests(method, suffix) reaches n.
+func (h *Harness) WaitRequest(method, suffix string, n int) {
+	h.t.Helper()
+	h.waitFor(method+" "+suffix, func() bool {
+		return h.Requests(method, suffix) >= n
+	})
+}
+
+// Messages returns the IDs of the messages still in the channel, oldest
+// first.
+func (h *Harness) Messages(channelID string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ids []string
+	for _, m := range h.channels[channelID].msgs {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func (h *Harness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// transport answers the bot's REST calls from the harness's state.
+type transport struct {
+	h *Harness
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (tr transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := tr.h
+	path := strings.TrimPrefix(req.URL.Path, "/api/v"+discordgo.APIVersion+"/")
+	// Thread calls aren't in the vendored API version
+	path = strings.TrimPrefix(path, "/api/v9/")
+	parts := strings.Split(path, "/")
+
+	h.mu.Lock()
+	hook := h.onRequest
+	h.mu.Unlock()
+	if hook != nil {
+		hook(req.Method, path)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = append(h.requests, req.Method+" "+path)
+
+	switch {
+	case len(parts) == 2 && parts[0] == "users" && parts[1] == "@me":
+		return reply(req, 200, h.Me)
+	case len(parts) == 2 && parts[0] == "guilds" && parts[1] == h.Guild.ID:
+		return reply(req, 200, h.Guild)
+	case len(parts) == 3 && parts[0] == "guilds" && parts[1] == h.Guild.ID && parts[2] == "channels":
+		var out []channelJSON
+		for _, fc := range h.channels {
+			if fc.ch.Type != threadType {
+				out = append(out, fc.json())
+			}
+		}
+		return reply(req, 200, out)
+	case len(parts) == 4 && parts[0] == "guilds" && parts[1] == h.Guild.ID && parts[2] == "threads" && parts[3] == "active":
+		out := []channelJSON{}
+		for _, fc := range h.channels {
+			if fc.ch.Type == threadType && !fc.archived {
+				out = append(out, fc.json())
+			}
+		}
+		return reply(req, 200, map[string]interface{}{"threads": out})
+	case len(parts) >= 2 && parts[0] == "channels":
+		fc := h.channels[parts[1]]
+		if fc == nil {
+			return reply(req, 404, apiError{discordgo.ErrCodeUnknownChannel, "Unknown Channel"})
+		}
+		return tr.channel(req, fc, parts[2:])
+	}
+	return reply(req, 404, apiError{0, "404: Not Found"})
+}
+
+func (tr transport) channel(req *http.Request, fc *fakeChannel, parts []string) (*http.Response, error) {
+	h := tr.h
+	switch {
+	case len(parts) == 0 && req.Method == "GET":
+		return reply(req, 200, fc.json())
+	case len(parts) == 0 && req.Method == "DELETE":
+		// A deleted thread or post is recorded like a deleted message
+		delete(h.channels, fc.ch.ID)
+		h.deleted = append(h.deleted, fc.ch.ID)
+		return reply(req, 200, fc.json())
+	case len(parts) == 0 && req.Method == "PATCH":
+		var body struct {
+			Archived *bool `json:"archived"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Archived != nil {
+			fc.archived = *body.Archived
+		}
+		return reply(req, 200, fc.json())
+	case len(parts) == 1 && parts[0] == "pins":
+		out := []*discordgo.Message{}
+		for i := len(fc.msgs) - 1; i >= 0; i-- {
+			if fc.pinned[fc.msgs[i].ID] {
+				out = append(out, fc.msgs[i])
+			}
+		}
+		return reply(req, 200, out)
+	case len(parts) == 2 && parts[0] == "pins" && req.Method == "PUT":
+		if !fc.has(parts[1]) {
+			return reply(req, 404, apiError{discordgo.ErrCodeUnknownMessage, "Unknown Message"})
+		}
+		return reply(req, 204, nil)
+	case len(parts) == 1 && parts[0] == "messages" && req.Method == "GET":
+		limit := 50
+		if n, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil {
+			limit = n
+		}
+		before, _ := strconv.ParseUint(req.URL.Query().Get("before"), 10, 64)
+		var out []*discordgo.Message
+		if after, _ := strconv.ParseUint(req.URL.Query().Get("after"), 10, 64); after != 0 {
+			// The oldest messages after it, still newest first
+			for i := 0; i < len(fc.msgs) && len(out) < limit; i++ {
+				if id, _ := strconv.ParseUint(fc.msgs[i].ID, 10, 64); id > after {
+					out = append([]*discordgo.Message{fc.msgs[i]}, out...)
+				}
+			}
+			return reply(req, 200, out)
+		}
+		for i := len(fc.msgs) - 1; i >= 0 && len(out) < limit; i-- {
+			if id, _ := strconv.ParseUint(fc.msgs[i].ID, 10, 64); before != 0 && id >= before {
+				continue
+			}
+			out = append(out, fc.msgs[i])
+		}
+		return reply(req, 200, out)
+	case len(parts) == 1 && parts[0] == "messages" && req.Method == "POST":
+		var body struct {
+			Content string                  `json:"content"`
+			Embed   *discordgo.MessageEmbed `json:"embed"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		m := &discordgo.Message{
+			ID:        h.newIDLocked(),
+			ChannelID: fc.ch.ID,
+			Content:   body.Content,
+			Timestamp: discordgo.Timestamp(h.Clock.Now().Format(time.RFC3339Nano)),
+			Author:    h.Me,
+		}
+		if body.Embed != nil {
+			m.Embeds = []*discordgo.MessageEmbed{body.Embed}
+		}
+		fc.msgs = append(fc.msgs, m)
+		fc.botPosts++
+		return reply(req, 200, m)
+	case len(parts) == 2 && parts[0] == "messages" && parts[1] == "bulk_delete":
+		var body struct {
+			Messages []string `json:"messages"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		if fc.archived {
+			return reply(req, 400, apiError{errCodeThreadArchived, "Thread is archived"})
+		}
+		for _, id := range body.Messages {
+			if !fc.has(id) {
+				return reply(req, 400, apiError{discordgo.ErrCodeUnknownMessage, "Unknown Message"})
+			}
+		}
+		for _, id := range body.Messages {
+			tr.delete(fc, id)
+		}
+		return reply(req, 204, nil)
+	case len(parts) == 2 && parts[0] == "messages":
+		idx := -1
+		for i, m := range fc.msgs {
+			if m.ID == parts[1] {
+				idx = i
+			}
+		}
+		if idx == -1 {
+			return reply(req, 404, apiError{discordgo.ErrCodeUnknownMessage, "Unknown Message"})
+		}
+		if req.Method == "DELETE" && fc.archived {
+			return reply(req, 400, apiError{errCodeThreadArchived, "Thread is archived"})
+		}
+		if req.Method == "DELETE" {
+			tr.delete(fc, parts[1])
+			return reply(req, 204, nil)
+		}
+		return reply(req, 200, fc.msgs[idx])
+	}
+	return reply(req, 404, apiError{0, "404: Not Found"})
+}
+
+// Thread values the vendored discordgo doesn't have.
+const (
+	threadType            discordgo.ChannelType = 11
+	forumType             discordgo.ChannelType = 15
+	errCodeThreadArchived                       = 50083
+	channelFlagPinned                           = 1 << 1
+)
+
+// channelJSON adds the fields the vendored discordgo lacks.
+type channelJSON struct {
+	*discordgo.Channel
+	ParentID       string          `json:"parent_id,omitempty"`
+	ThreadMetadata *threadMetadata `json:"thread_metadata,omitempty"`
+	Flags          int             `json:"flags,omitempty"`
+}
+
+type threadMetadata struct {
+	Archived bool `json:"archived"`
+}
+
+func (fc *fakeChannel) json() channelJSON {
+	out := channelJSON{Channel: fc.ch, ParentID: fc.parentID, Flags: fc.flags}
+	if fc.ch.Type == threadType {
+		out.ThreadMetadata = &threadMetadata{Archived: fc.archived}
+	}
+	return out
+}
+
+func (fc *fakeChannel) has(id string) bool {
+	return fc.find(id) != nil
+}
+
+func (fc *fakeChannel) find(id string) *discordgo.Message {
+	for _, m := range fc.msgs {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// delete removes a message and records that the bot deleted it.
+func (tr transport) delete(fc *fakeChannel, id string) {
+	for i, m := range fc.msgs {
+		if m.ID == id {
+			fc.msgs = append(fc.msgs[:i], fc.msgs[i+1:]...)
+			tr.h.deleted = append(tr.h.deleted, id)
+			return
+		}
+	}
+}
+
+func reply(req *http.Request, code int, v interface{}) (*http.Response, error) {
+	var body []byte
+	if v != nil {
+		var err error
+		body, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &http.Response{
+		StatusCode: code,
+		Status:     strconv.Itoa(code) + " " + http.StatusText(code),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,56 @@
+package autodeletetest_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+// A full cycle: messages posted over time come out as each reaches the
+// channel's retention, and nothing goes early.
+func TestHarnessReapCycle(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h")
+	first := h.Post(ch, "first")
+	h.Advance(10 * time.Minute)
+	second := h.Post(ch, "second")
+	h.Advance(30 * time.Minute)
+	third := h.Post(ch, "third")
+
+	h.Advance(25 * time.Minute) // first is 65m old, second 55m
+	if got := h.WaitDeleted(1); !reflect.DeepEqual(got, []string{first}) {
+		t.Fatalf("deleted %v, want %v", got, []string{first})
+	}
+	h.Advance(10 * time.Minute) // second 65m, third 35m
+	want := []string{first, second}
+	sort.Strings(want)
+	if got := h.WaitDeleted(2); !reflect.DeepEqual(got, want) {
+		t.Fatalf("deleted %v, want %v", got, want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := h.Deleted(); len(got) != 2 {
+		t.Fatalf("deleted %v, want only %v", got, want)
+	}
+	if got := h.Messages(ch); !containsID(got, third) {
+		t.Errorf("third message is gone early")
+	}
+
+	h.Advance(30 * time.Minute)
+	if got := h.WaitDeleted(3); len(got) != 3 || !containsID(got, third) {
+		t.Errorf("deleted %v, want all three", got)
+	}
+}
+
+func containsID(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package autodelete
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// A BulkConfig is a document describing many channels' settings at once, as
+// written by ExportConfig and read by ImportConfig. JSON works too, being
+// a subset of YAML.
+type BulkConfig struct {
+	// If set, configured channels that aren't listed are removed.
+	Prune    bool                    `yaml:"prune,omitempty"`
+	Channels []managedChannelMarshal `yaml:"channels"`
+}
+
+// An ImportResult is what ImportConfig changed, or would have.
+type ImportResult struct {
+	Added, Updated, Removed, Unchanged int
+	// Entries that weren't applied, by channel ID, with why
+	Skipped map[string]string
+	DryRun  bool
+}
+
+func (r ImportResult) String() string {
+	verb := "Imported"
+	if r.DryRun {
+		verb = "Would import"
+	}
+	s := fmt.Sprintf("%s: %d channels added, %d updated, %d removed, %d unchanged.", verb, r.Added, r.Updated, r.Removed, r.Unchanged)
+	if len(r.Skipped) == 0 {
+		return s
+	}
+	ids := make([]string, 0, len(r.Skipped))
+	for id := range r.Skipped {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	s += fmt.Sprintf(" Skipped %d:", len(ids))
+	for _, id := range ids {
+		s += fmt.Sprintf("\n  %s: %s", id, r.Skipped[id])
+	}
+	return s
+}
+
+// importMaxSize is the largest document ImportConfig accepts.
+const importMaxSize = 4 << 20
+
+// ExportConfig writes every saved channel config as a BulkConfig.
+func (b *Bot) ExportConfig(w io.Writer) error {
+	var doc BulkConfig
+	err := b.store.EachChannel(func(conf managedChannelMarshal) {
+		doc.Channels = append(doc.Channels, conf)
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(doc.Channels, func(i, j int) bool { return idLess(doc.Channels[i].ID, doc.Channels[j].ID) })
+	by, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(by)
+	return err
+}
+
+// ImportConfig applies a BulkConfig: listed channels are added or updated,
+// and with Prune set, the rest are removed. Each entry replaces all of the
+// channel's settings, like the set command does. An entry that doesn't
+// validate is skipped and the others still go ahead. Message IDs the bot
+// keeps for itself, like the config message, are carried over when an entry
+// leaves them out. With dryRun, nothing is changed.
+func (b *Bot) ImportConfig(r io.Reader, dryRun bool) (ImportResult, error) {
+	res := ImportResult{Skipped: make(map[string]string), DryRun: dryRun}
+	by, err := ioutil.ReadAll(io.LimitReader(r, importMaxSize+1))
+	if err != nil {
+		return res, err
+	}
+	if len(by) > importMaxSize {
+		return res, errors.Errorf("config is over %d bytes", importMaxSize)
+	}
+	var doc BulkConfig
+	if err := yaml.UnmarshalStrict(by, &doc); err != nil {
+		return res, errors.Wrap(err, "parse config")
+	}
+
+	current := make(map[string]managedChannelMarshal)
+	err = b.store.EachChannel(func(conf managedChannelMarshal) {
+		current[conf.ID] = conf
+	})
+	if err != nil {
+		return res, err
+	}
+
+	// Work out the whole diff before touching anything
+	var apply []managedChannelMarshal
+	listed := make(map[string]bool)
+	for _, conf := range doc.Channels {
+		if conf.ID == "" {
+			res.Skipped["(no id)"] = "missing id"
+			continue
+		}
+		if listed[conf.ID] {
+			res.Skipped[conf.ID] = "listed more than once, only the first was used"
+			continue
+		}
+		listed[conf.ID] = true
+		if err := b.validateChannelConfig(conf); err != nil {
+			res.Skipped[conf.ID] = err.Error()
+			continue
+		}
+		cur, ok := current[conf.ID]
+		if ok {
+			conf = keepBookkeeping(cur, conf)
+			if b.sameChannelConfig(cur, conf) {
+				res.Unchanged++
+				continue
+			}
+			res.Updated++
+		} else {
+			res.Added++
+		}
+		apply = append(apply, conf)
+	}
+	var remove []string
+	if doc.Prune {
+		for id := range current {
+			if !listed[id] {
+				remove = append(remove, id)
+			}
+		}
+	}
+	res.Removed = len(remove)
+	if dryRun {
+		return res, nil
+	}
+
+	for _, conf := range apply {
+		err := b.setChannelConfig(conf)
+		if err != nil && !b.handleCriticalPermissionsErrors(conf.ID, err) {
+			fmt.Printf("[load] error importing %s: %v\n", conf.ID, err)
+		}
+	}
+	for _, id := range remove {
+		b.deleteChannelConfig(id)
+	}
+	fmt.Printf("[load] imported configs: %d added, %d updated, %d removed, %d skipped\n", res.Added, res.Updated, res.Removed, len(res.Skipped))
+	return res, nil
+}
+
+// validateChannelConfig checks an imported config the way the set command
+// checks its arguments, and that the channel exists.
+func (b *Bot) validateChannelConfig(conf managedChannelMarshal) error {
+	if conf.LiveTime < 0 || conf.MaxMessages < 0 || conf.KeepMessages < 0 || conf.MinAge < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if conf.ShortLength < 0 || conf.ShortLiveTime < 0 || (conf.ShortLength > 0) != (conf.ShortLiveTime > 0) {
+		return errors.New("short_length and short_live_time must be set together")
+	}
+	if conf.MaxMessages > 0 && conf.KeepMessages > conf.MaxMessages {
+		return errors.Errorf("keep_messages %d is over max_messages %d", conf.KeepMessages, conf.MaxMessages)
+	}
+	if min := b.minRetention(); min > 0 && conf.LiveTime > 0 && conf.LiveTime < min {
+		return errors.Errorf("live_time %s is under the minimum of %s", conf.LiveTime, min)
+	}
+	if conf.ContentPattern != "" {
+		if _, err := regexp.Compile(conf.ContentPattern); err != nil {
+			return errors.Wrap(err, "content_pattern")
+		}
+	}
+	if conf.Schedule != "" {
+		if _, err := parseSchedule(conf.Schedule, conf.Timezone); err != nil {
+			return errors.Wrap(err, "schedule")
+		}
+	}
+	if conf.QuietHours != "" {
+		if _, err := parseQuiet(conf.QuietHours, conf.Timezone); err != nil {
+			return errors.Wrap(err, "quiet_hours")
+		}
+	}
+	ch, err := b.s.Channel(conf.ID)
+	if err != nil {
+		return errors.Wrap(err, "look up channel")
+	}
+	if conf.MoveTo != "" {
+		dest, err := b.s.Channel(conf.MoveTo)
+		if err != nil || dest.GuildID != ch.GuildID || dest.ID == ch.ID {
+			return errors.New("move_to must be another channel in the same server")
+		}
+	}
+	return nil
+}
+
+// keepBookkeeping fills in the message IDs and flags the bot tracks for
+// itself from the current config, where the imported one leaves them out.
+func keepBookkeeping(cur, conf managedChannelMarshal) managedChannelMarshal {
+	if conf.ConfMessageID == "" {
+		conf.ConfMessageID = cur.ConfMessageID
+	}
+	if conf.NoticeMessageID == "" {
+		conf.NoticeMessageID = cur.NoticeMessageID
+	}
+	if !conf.NoticePosted {
+		conf.NoticePosted = cur.NoticePosted
+	}
+	if conf.LastSentUpdate == 0 {
+		conf.LastSentUpdate = cur.LastSentUpdate
+	}
+	if !conf.HasPins {
+		conf.HasPins = cur.HasPins
+	}
+	if conf.GraceUntil == nil {
+		conf.GraceUntil = cur.GraceUntil
+	}
+	return conf
+}
+
+// ConfigHandler exports the channel configs on GET and imports them on POST
+// (PUT works too), adding ?dryrun=1 to only report what would change.
+// Clients authenticate with the configured admin token as a bearer token.
+// It returns a 404 handler if no token is set.
+func (b *Bot) ConfigHandler() http.Handler {
+	token := b.Config.AdminToken
+	if token == "" {
+		return http.NotFoundHandler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			var buf bytes.Buffer
+			if err := b.ExportConfig(&buf); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write(buf.Bytes())
+		case "POST", "PUT":
+			res, err := b.ImportConfig(r.Body, r.URL.Query().Get("dryrun") != "")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, res.String()+"\n")
+		default:
+			http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		}
+	})
+}
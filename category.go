@@ -0,0 +1,253 @@
+package autodelete
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Category settings live in the guild config, keyed by category ID. A text
+// channel in a configured category that has no settings of its own gets a
+// copy, marked with InheritedFrom, when it is created or moved there, or when
+// the category is set up. Moving it out again removes the copy. Channels with
+// their own settings always win and are left alone.
+
+// channelParent is the part of a channel object the vendored discordgo
+// doesn't know about yet, read from the raw API response.
+type channelParent struct {
+	ID       string                `json:"id"`
+	Type     discordgo.ChannelType `json:"type"`
+	ParentID string                `json:"parent_id"`
+}
+
+// parentCategory returns the ID of the category a channel is in, or "" if it
+// isn't in one.
+func (b *Bot) parentCategory(channelID string) (string, error) {
+	body, err := b.s.RequestWithBucketID("GET", discordgo.EndpointChannel(channelID), nil, discordgo.EndpointChannel(channelID))
+	if err != nil {
+		return "", err
+	}
+	var ch channelParent
+	err = json.Unmarshal(body, &ch)
+	return ch.ParentID, err
+}
+
+// categoryChildren returns the IDs of the text channels in a category.
+func (b *Bot) categoryChildren(guildID, categoryID string) ([]string, error) {
+	body, err := b.s.RequestWithBucketID("GET", discordgo.EndpointGuildChannels(guildID), nil, discordgo.EndpointGuildChannels(guildID))
+	if err != nil {
+		return nil, err
+	}
+	var chans []channelParent
+	err = json.Unmarshal(body, &chans)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, v := range chans {
+		if v.Type == discordgo.ChannelTypeGuildText && v.ParentID == categoryID {
+			ids = append(ids, v.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (b *Bot) categoryConfig(guildID, categoryID string) (managedChannelMarshal, bool) {
+	g, _ := b.guildDefault(guildID)
+	conf, ok := g.Categories[categoryID]
+	return conf, ok
+}
+
+// channelTemplate strips the settings that only make sense for one channel,
+// so the rest can be applied to another.
+func channelTemplate(conf managedChannelMarshal) managedChannelMarshal {
+	conf.ID = ""
+	conf.ConfMessageID = ""
+	conf.NoticeMessageID = ""
+	conf.NoticePosted = false
+	conf.LastSentUpdate = 0
+	conf.HasPins = false
+	conf.Disabled = false
+	conf.DisabledReason = ""
+	conf.DisabledUntil = nil
+	conf.InheritedFrom = ""
+	return conf
+}
+
+// saveCategories writes a guild's category settings after fn changes them.
+// The guild lock is held throughout, so concurrent changes don't overwrite
+// each other; fn must not take it.
+func (b *Bot) saveCategories(guildID string, fn func(cats map[string]managedChannelMarshal)) error {
+	b.guildMu.Lock()
+	defer b.guildMu.Unlock()
+	g := b.guilds[guildID]
+	cats := make(map[string]managedChannelMarshal, len(g.Categories)+1)
+	for k, v := range g.Categories {
+		cats[k] = v
+	}
+	fn(cats)
+	g.ID = guildID
+	g.Categories = cats
+	if len(cats) == 0 {
+		g.Categories = nil
+	}
+	err := b.store.SaveGuild(g)
+	if err != nil {
+		return err
+	}
+	b.guilds[guildID] = g
+	return nil
+}
+
+// setCategoryConfig makes conf the settings for a category and applies them
+// to every channel in it that doesn't have its own. It returns how many
+// channels were set up or updated.
+func (b *Bot) setCategoryConfig(guildID, categoryID string, conf managedChannelMarshal) (int, error) {
+	conf = channelTemplate(conf)
+	err := b.saveCategories(guildID, func(cats map[string]managedChannelMarshal) {
+		cats[categoryID] = conf
+	})
+	if err != nil {
+		return 0, err
+	}
+	children, err := b.categoryChildren(guildID, categoryID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range children {
+		ok, err := b.inheritSettings(id, categoryID, conf)
+		if err != nil {
+			fmt.Println("[cat ] could not apply category settings to", id, err)
+			continue
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// inheritSettings gives a channel the settings of a category, or of the
+// parent of a thread, unless it has settings of its own. It reports whether
+// anything changed.
+func (b *Bot) inheritSettings(channelID, fromID string, conf managedChannelMarshal) (bool, error) {
+	prev, err := b.readChannelConfig(channelID)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && prev.InheritedFrom != fromID {
+		return false, nil
+	}
+	conf.ID = channelID
+	conf.InheritedFrom = fromID
+	_, err = b.s.ChannelMessagesPinned(channelID)
+	conf.HasPins = err == nil
+	if prev.InheritedFrom == fromID && b.sameChannelConfig(prev, conf) {
+		return false, nil
+	}
+	fmt.Println("[cat ] applying settings from", fromID, "to", channelID)
+	return true, b.setChannelConfig(conf)
+}
+
+// removeCategoryConfig drops a category's settings along with every channel
+// that got its settings from the category.
+func (b *Bot) removeCategoryConfig(guildID, categoryID string) (int, error) {
+	err := b.saveCategories(guildID, func(cats map[string]managedChannelMarshal) {
+		delete(cats, categoryID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	var children []string
+	err = b.store.EachChannel(func(conf managedChannelMarshal) {
+		if conf.InheritedFrom == categoryID {
+			children = append(children, conf.ID)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range children {
+		b.deleteChannelConfig(id)
+	}
+	return len(children), nil
+}
+
+// channelCreated sets up a new channel if its category is configured.
+func (b *Bot) channelCreated(ch *discordgo.Channel) {
+	if ch.Type != discordgo.ChannelTypeGuildText {
+		return
+	}
+	parent, err := b.parentCategory(ch.ID)
+	if err != nil {
+		fmt.Println("[cat ] could not look up category of", ch.ID, err)
+		return
+	}
+	if parent == "" {
+		return
+	}
+	conf, ok := b.categoryConfig(ch.GuildID, parent)
+	if !ok {
+		return
+	}
+	_, err = b.inheritSettings(ch.ID, parent, conf)
+	if err != nil {
+		fmt.Println("[cat ] could not apply category settings to", ch.ID, err)
+	}
+}
+
+// channelUpdated follows a channel moving between categories: settings it
+// got from the category it left are removed, and it picks up the new one's
+// if that is configured and it has none of its own.
+func (b *Bot) channelUpdated(ch *discordgo.Channel) {
+	if ch.Type != discordgo.ChannelTypeGuildText {
+		return
+	}
+	prev, err := b.readChannelConfig(ch.ID)
+	inherited := err == nil && prev.InheritedFrom != ""
+	if g, _ := b.guildDefault(ch.GuildID); !inherited && len(g.Categories) == 0 {
+		// Nothing to follow, so don't bother looking up the category
+		return
+	}
+	// The update event doesn't say what changed, and the vendored discordgo
+	// drops the parent, so ask
+	parent, err := b.parentCategory(ch.ID)
+	if err != nil {
+		fmt.Println("[cat ] could not look up category of", ch.ID, err)
+		return
+	}
+	if inherited && prev.InheritedFrom != parent {
+		fmt.Println("[cat ] channel", ch.ID, "left category", prev.InheritedFrom, "- removing its settings")
+		b.deleteChannelConfig(ch.ID)
+	}
+	if parent == "" {
+		return
+	}
+	conf, ok := b.categoryConfig(ch.GuildID, parent)
+	if !ok {
+		return
+	}
+	_, err = b.inheritSettings(ch.ID, parent, conf)
+	if err != nil {
+		fmt.Println("[cat ] could not apply category settings to", ch.ID, err)
+	}
+}
+
+// channelDeleted cleans up after a deleted category.
+func (b *Bot) channelDeleted(ch *discordgo.Channel) {
+	if ch.Type != discordgo.ChannelTypeGuildCategory {
+		return
+	}
+	if _, ok := b.categoryConfig(ch.GuildID, ch.ID); !ok {
+		return
+	}
+	n, err := b.removeCategoryConfig(ch.GuildID, ch.ID)
+	if err != nil {
+		fmt.Println("[cat ] could not remove settings for deleted category", ch.ID, err)
+		return
+	}
+	fmt.Println("[cat ] category", ch.ID, "was deleted, stopped", n, "channels")
+}
@@ -0,0 +1,56 @@
+package autodelete_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+func queued(h *autodeletetest.Harness, channelID string) bool {
+	for _, v := range h.Bot.QueueSnapshot() {
+		if v.ChannelID == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+// waitQueued waits for a channel to join or leave the reap queue.
+func waitQueued(t *testing.T, h *autodeletetest.Harness, channelID string, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for queued(h, channelID) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("channel %s queued = %v, want %v", channelID, !want, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestChannelMovedBetweenCategories(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{})
+	cat := h.AddCategory("cat")
+	first := h.AddChannelIn("first", cat)
+	h.Set(first, "1h")
+	h.Command(first, "category")
+
+	sibling := h.AddChannelIn("sibling", "")
+	waitQueued(t, h, first, true)
+	if queued(h, sibling) {
+		t.Fatal("channel outside the category was set up")
+	}
+	h.MoveChannel(sibling, cat)
+	waitQueued(t, h, sibling, true)
+
+	h.MoveChannel(sibling, "")
+	waitQueued(t, h, sibling, false)
+
+	// A channel with its own settings keeps them when it leaves
+	h.MoveChannel(first, "")
+	time.Sleep(50 * time.Millisecond)
+	if !queued(h, first) {
+		t.Error("channel with its own settings lost them when moved")
+	}
+}
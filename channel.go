@@ -1,16 +1,29 @@
 package autodelete
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/riking/AutoDelete/metrics"
 )
 
 type smallMessage struct {
-	MessageID string
-	PostedAt  time.Time
+	MessageID     string
+	PostedAt      time.Time
+	HasAttachment bool
+	// Content length in characters, for ShortLength
+	Length int
+	// set if the author has one of the channel's RoleLiveTimes roles
+	LiveTime time.Duration
 
 	// implicit in which ManagedChannel this is a member of
 	//ChannelID string
@@ -21,18 +34,196 @@ type ManagedChannel struct {
 	Channel *discordgo.Channel
 
 	mu sync.Mutex
-	// Messages posted to the channel get deleted after
+	// Messages posted to the channel get deleted after MessageLiveTime, or
+	// once more than MaxMessages newer messages are tracked. When both are
+	// set, PolicyMode says how they combine.
 	MessageLiveTime time.Duration
 	MaxMessages     int
-	ConfMessageID   string
+	PolicyMode      PolicyMode
+	// If set, messages with attachments are kept this long instead of
+	// MessageLiveTime, whether or not they also have text.
+	AttachmentLiveTime time.Duration
+	// If set, messages with fewer than ShortLength characters of text are
+	// kept for ShortLiveTime instead, to clear out (or hold on to) short
+	// replies like "ok". Messages with attachments never count as short, so
+	// an attachment with no text follows AttachmentLiveTime or the channel's
+	// retention.
+	ShortLength   int
+	ShortLiveTime time.Duration
+	// if true and neither of the above is set, use the guild default
+	UseGuildDefault bool
+	// Messages younger than MinAge are never deleted, whatever the limits say
+	MinAge time.Duration
+	// If set, the channel is cleared out once nobody has posted for this
+	// long, instead of each message going after MessageLiveTime (or on the
+	// Schedule). KeepMessages, MinAge and MaxMessages still apply: the
+	// newest KeepMessages stay even once the channel goes quiet.
+	Inactivity time.Duration
+	// If set, messages posted before this are left alone. They are still
+	// fetched with the backlog, but never tracked, so they don't count
+	// towards MaxMessages either.
+	EffectiveFrom time.Time
+	// Nothing is reaped before this. Set when the channel is first set up
+	// and FirstReapGrace is on.
+	GraceUntil time.Time
+	// if true, each new message replaces the previous one right away
+	Announcement bool
+	// The newest KeepMessages messages are never deleted, regardless of age.
+	// Must not exceed MaxMessages when that is set.
+	KeepMessages int
+	// Never delete the newest message, like KeepMessages of 1
+	KeepNewest    bool
+	ConfMessageID string
+	// The pinned notice posted when the channel was first set up. It is
+	// never deleted. NoticePosted stays set if the notice was skipped or
+	// later removed, so it isn't posted again.
+	NoticeMessageID string
+	NoticePosted    bool
+	// The category the settings came from, or the parent channel for a
+	// thread, if they weren't set on the channel itself
+	InheritedFrom string
+	// If set, the channel's active threads get a copy of its settings, see
+	// syncThreads
+	Threads bool
 	// if lower than CriticalMsgSequence, need to send one
 	LastSentUpdate int
 	HasPins        bool
-	IsDonor        bool
+	// if false, pinned messages are deleted like any other
+	KeepPinned bool
+	// Messages from these users, or from any bot or webhook if KeepBots is
+	// set, are never tracked: they are not deleted and don't count towards
+	// KeepMessages or MaxMessages.
+	KeepUsers []string
+	KeepBots  bool
+	// The bot's own messages are kept, like KeepUsers, unless DeleteOwn
+	// is set. The config message and pinned notice are kept either way.
+	DeleteOwn bool
+	// If set, messages are re-posted to this channel before they are
+	// deleted, see moveMessages
+	MoveTo string
+	// If set, only messages whose text matches are tracked; the rest are
+	// never deleted, like KeepUsers. Messages with no text (attachments or
+	// embeds only) are matched against the empty string.
+	ContentPattern *regexp.Regexp
+	// If either is set, only messages with a link in their text or with an
+	// embed are tracked. Discord adds link previews a moment after the
+	// message is posted, so UpdateMessage and LoadBacklog check again.
+	OnlyWithLinks  bool
+	OnlyWithEmbeds bool
+	// Messages from members with one of these roles are kept this long
+	// instead of MessageLiveTime; if several match, the longest wins. The
+	// roles are looked up when the message is first seen. Authors with none
+	// of them, or whose roles can't be looked up, get the usual retention.
+	RoleLiveTimes map[string]time.Duration
+	// How join, boost, pin notice and other system messages are treated
+	SystemMessages SystemMode
+	// What a reap does to the messages that are due
+	Action ReapAction
+	// If set, messages are deleted at fixed times instead of after
+	// MessageLiveTime: each message goes at the first run of the schedule
+	// after it was posted (and after MinAge). MaxMessages still applies.
+	Schedule *cronSchedule
+	// If set, nothing is deleted during these hours each day. Anything
+	// that comes due goes once the window closes.
+	QuietHours *quietHours
+	// A message is deleted right away once it gets TriggerCount reactions
+	// of TriggerEmoji (a unicode emoji, or name:id for a custom one)
+	TriggerEmoji string
+	TriggerCount int
+	IsDonor      bool
+	// set once the channel has been disabled for missing permissions, so
+	// stray QueueReap calls don't put it back in the queue
+	disabled bool
 	// if false, need to check channel history for messages
 	isStarted    chan struct{}
 	liveMessages []smallMessage
 	pinMessages  []smallMessage
+	// set when LoadBacklog stopped at the fetch limit, so there may be older
+	// messages we don't know about
+	backlogTruncated bool
+	// failed reloads in a row, for reloadBacklog's backoff
+	backlogFailures int
+	// the newest message seen, so LoadBacklog can fetch just what's newer
+	lastSeenID string
+	// when the last message was posted, counting ones that aren't tracked
+	lastActivity time.Time
+	// set while over the backlog alert threshold, see checkBacklog
+	backlogAlerted   bool
+	lastBacklogAlert time.Time
+	// records for the archive sink, by message ID. nil if there is no sink.
+	archive map[string]ArchivedMessage
+
+	stats ChannelStats
+
+	// coalesce concurrent QueueReap calls. Accessed atomically.
+	queueing, requeue int32
+}
+
+// ChannelStats are cumulative reap statistics for a channel since startup.
+type ChannelStats struct {
+	Deleted          int
+	LastReap         time.Time
+	LastError        error
+	RateLimitRetries int
+	// Reaps that have failed since the last one that worked. Once there
+	// are breakerThreshold of them, the channel isn't tried again until
+	// BackoffUntil.
+	ConsecutiveFailures int
+	BackoffUntil        time.Time
+}
+
+// After this many failed reaps in a row, a channel is backed off for
+// breakerBaseDelay, doubling with each further failure up to breakerMaxDelay,
+// so one broken channel doesn't keep burning rate limit.
+const (
+	breakerThreshold = 3
+	breakerBaseDelay = 1 * time.Minute
+	breakerMaxDelay  = 1 * time.Hour
+)
+
+// Stats returns a copy of the channel's reap statistics.
+func (c *ManagedChannel) Stats() ChannelStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// recordReap updates the stats after a call to Reap.
+func (c *ManagedChannel) recordReap(res ReapResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Deleted += res.Deleted()
+	c.stats.LastReap = c.bot.now()
+	err := res.Err
+	if err == nil {
+		c.stats.ConsecutiveFailures = 0
+		c.stats.BackoffUntil = time.Time{}
+		return
+	}
+	c.stats.LastError = err
+	c.stats.ConsecutiveFailures++
+	if n := c.stats.ConsecutiveFailures - breakerThreshold; n >= 0 {
+		delay := breakerMaxDelay
+		if n < 16 && breakerBaseDelay<<uint(n) < breakerMaxDelay {
+			delay = breakerBaseDelay << uint(n)
+		}
+		c.stats.BackoffUntil = c.bot.now().Add(delay)
+	}
+}
+
+// backoffUntil returns when the circuit breaker lets the channel be reaped
+// again, or the zero time if it isn't tripped.
+func (c *ManagedChannel) backoffUntil() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats.BackoffUntil
+}
+
+// graceUntil returns when a newly set up channel's grace period ends.
+func (c *ManagedChannel) graceUntil() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.GraceUntil
 }
 
 func (c *ManagedChannel) Export() managedChannelMarshal {
@@ -40,13 +231,45 @@ func (c *ManagedChannel) Export() managedChannelMarshal {
 	defer c.mu.Unlock()
 
 	return managedChannelMarshal{
-		ID:             c.Channel.ID,
-		LiveTime:       c.MessageLiveTime,
-		MaxMessages:    c.MaxMessages,
-		LastSentUpdate: c.LastSentUpdate,
-		ConfMessageID:  c.ConfMessageID,
-		HasPins:        c.HasPins,
-		IsDonor:        c.IsDonor,
+		ID:                 c.Channel.ID,
+		LiveTime:           c.MessageLiveTime,
+		MaxMessages:        c.MaxMessages,
+		PolicyMode:         c.PolicyMode.String(),
+		AttachmentLiveTime: c.AttachmentLiveTime,
+		ShortLength:        c.ShortLength,
+		ShortLiveTime:      c.ShortLiveTime,
+		KeepMessages:       c.KeepMessages,
+		KeepNewest:         c.KeepNewest,
+		GuildDefault:       c.UseGuildDefault,
+		MinAge:             c.MinAge,
+		Inactivity:         c.Inactivity,
+		EffectiveFrom:      timePtr(c.EffectiveFrom),
+		GraceUntil:         timePtr(c.GraceUntil),
+		Announcement:       c.Announcement,
+		LastSentUpdate:     c.LastSentUpdate,
+		ConfMessageID:      c.ConfMessageID,
+		NoticeMessageID:    c.NoticeMessageID,
+		NoticePosted:       c.NoticePosted,
+		HasPins:            c.HasPins,
+		DeletePinned:       !c.KeepPinned,
+		KeepUsers:          c.KeepUsers,
+		KeepBots:           c.KeepBots,
+		DeleteOwn:          c.DeleteOwn,
+		MoveTo:             c.MoveTo,
+		ContentPattern:     patternString(c.ContentPattern),
+		OnlyWithLinks:      c.OnlyWithLinks,
+		OnlyWithEmbeds:     c.OnlyWithEmbeds,
+		SystemMessages:     c.SystemMessages.String(),
+		Action:             c.Action.String(),
+		RoleLiveTimes:      c.RoleLiveTimes,
+		Schedule:           scheduleString(c.Schedule),
+		QuietHours:         quietHoursString(c.QuietHours),
+		Timezone:           channelZone(c.Schedule, c.QuietHours),
+		TriggerEmoji:       c.TriggerEmoji,
+		TriggerCount:       c.TriggerCount,
+		IsDonor:            c.IsDonor,
+		InheritedFrom:      c.InheritedFrom,
+		Threads:            c.Threads,
 	}
 }
 
@@ -55,46 +278,162 @@ func InitChannel(b *Bot, chConf managedChannelMarshal) (*ManagedChannel, error)
 	if err != nil {
 		return nil, err
 	}
+	chConf = b.normalizeChannelConfig(chConf, func(format string, args ...interface{}) {
+		fmt.Printf("[load] %s: "+format+"\n", append([]interface{}{chConf.ID}, args...)...)
+	})
+	var pattern *regexp.Regexp
+	if chConf.ContentPattern != "" {
+		pattern, err = regexp.Compile(chConf.ContentPattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "content_pattern")
+		}
+	}
+	var schedule *cronSchedule
+	if chConf.Schedule != "" {
+		schedule, err = parseSchedule(chConf.Schedule, chConf.Timezone)
+		if err != nil {
+			return nil, errors.Wrap(err, "schedule")
+		}
+	}
+	var quiet *quietHours
+	if chConf.QuietHours != "" {
+		quiet, err = parseQuiet(chConf.QuietHours, chConf.Timezone)
+		if err != nil {
+			return nil, errors.Wrap(err, "quiet_hours")
+		}
+	}
 	return &ManagedChannel{
-		bot:             b,
-		Channel:         disCh,
-		MessageLiveTime: chConf.LiveTime,
-		MaxMessages:     chConf.MaxMessages,
-		LastSentUpdate:  chConf.LastSentUpdate,
-		ConfMessageID:   chConf.ConfMessageID,
-		HasPins:         chConf.HasPins,
-		IsDonor:         chConf.IsDonor,
-		isStarted:       make(chan struct{}),
-		liveMessages:    nil,
+		bot:                b,
+		Channel:            disCh,
+		MessageLiveTime:    chConf.LiveTime,
+		MaxMessages:        chConf.MaxMessages,
+		PolicyMode:         parsePolicyMode(chConf.PolicyMode),
+		AttachmentLiveTime: chConf.AttachmentLiveTime,
+		ShortLength:        chConf.ShortLength,
+		ShortLiveTime:      chConf.ShortLiveTime,
+		KeepMessages:       chConf.KeepMessages,
+		KeepNewest:         chConf.KeepNewest,
+		UseGuildDefault:    chConf.GuildDefault,
+		MinAge:             chConf.MinAge,
+		Inactivity:         chConf.Inactivity,
+		EffectiveFrom:      timeOrZero(chConf.EffectiveFrom),
+		GraceUntil:         timeOrZero(chConf.GraceUntil),
+		Announcement:       chConf.Announcement,
+		LastSentUpdate:     chConf.LastSentUpdate,
+		ConfMessageID:      chConf.ConfMessageID,
+		NoticeMessageID:    chConf.NoticeMessageID,
+		NoticePosted:       chConf.NoticePosted,
+		HasPins:            chConf.HasPins,
+		KeepPinned:         !chConf.DeletePinned,
+		KeepUsers:          chConf.KeepUsers,
+		KeepBots:           chConf.KeepBots,
+		DeleteOwn:          chConf.DeleteOwn,
+		MoveTo:             chConf.MoveTo,
+		ContentPattern:     pattern,
+		OnlyWithLinks:      chConf.OnlyWithLinks,
+		OnlyWithEmbeds:     chConf.OnlyWithEmbeds,
+		SystemMessages:     parseSystemMode(chConf.SystemMessages),
+		Action:             parseReapAction(chConf.Action),
+		RoleLiveTimes:      chConf.RoleLiveTimes,
+		Schedule:           schedule,
+		QuietHours:         quiet,
+		TriggerEmoji:       chConf.TriggerEmoji,
+		TriggerCount:       chConf.TriggerCount,
+		IsDonor:            chConf.IsDonor,
+		InheritedFrom:      chConf.InheritedFrom,
+		Threads:            chConf.Threads,
+		isStarted:          make(chan struct{}),
+		liveMessages:       nil,
 	}, nil
 }
 
-func (c *ManagedChannel) loadPins() ([]*discordgo.Message, error) {
-	c.mu.Lock()
-	hasPins := c.HasPins
-	c.mu.Unlock()
-	if !hasPins {
-		return nil, nil
+func patternString(re *regexp.Regexp) string {
+	if re == nil {
+		return ""
 	}
-	return c.bot.s.ChannelMessagesPinned(c.Channel.ID)
+	return re.String()
 }
 
-func (c *ManagedChannel) LoadBacklog() error {
-	msgs, err := c.bot.s.ChannelMessages(c.Channel.ID, 100, "", "", "")
+// parseSchedule parses a cron expression in the named zone, UTC if empty.
+func parseSchedule(expr, zone string) (*cronSchedule, error) {
+	loc, err := parseZone(zone)
 	if err != nil {
-		fmt.Println("could not load backlog for", c.Channel.ID, err)
-		return err
+		return nil, err
 	}
-	pins, pinsErr := c.loadPins()
-	if pinsErr != nil {
-		fmt.Println("could not load pins for", c.Channel.ID, pinsErr)
-		//return err
+	return parseCron(expr, loc)
+}
+
+func parseQuiet(window, zone string) (*quietHours, error) {
+	loc, err := parseZone(zone)
+	if err != nil {
+		return nil, err
+	}
+	return parseQuietHours(window, loc)
+}
+
+// parseZone loads a time zone by name. An empty name means UTC.
+func parseZone(zone string) (*time.Location, error) {
+	if zone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(zone)
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func scheduleString(s *cronSchedule) string {
+	if s == nil {
+		return ""
 	}
+	return s.String()
+}
+
+func scheduleZone(s *cronSchedule) string {
+	if s == nil || s.loc == time.UTC {
+		return ""
+	}
+	return s.loc.String()
+}
 
-	defer c.bot.QueueReap(c) // requires mutex unlocked
+// channelZone is the time zone saved for a channel, shared by its schedule
+// and quiet hours.
+func channelZone(s *cronSchedule, q *quietHours) string {
+	if z := scheduleZone(s); z != "" || q == nil || q.loc == time.UTC {
+		return z
+	}
+	return q.loc.String()
+}
+
+// loadPins fetches the channel's pins, if they are kept. Unless always is
+// set, a channel that had no pins last time is assumed to still have none;
+// catching up after missed events sets it.
+func (c *ManagedChannel) loadPins(always bool) ([]*discordgo.Message, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	hasPins := c.HasPins
+	keepPinned := c.KeepPinned
+	c.mu.Unlock()
+	if (!hasPins && !always) || !keepPinned {
+		return nil, nil
+	}
+	return c.bot.client.ChannelMessagesPinned(c.Channel.ID)
+}
 
+// applyPins replaces the known pins with a fresh load, keeping the old ones
+// if the load failed, and returns the pinned IDs.
+// Must be called with the mutex held.
+func (c *ManagedChannel) applyPins(pins []*discordgo.Message, pinsErr error) map[string]struct{} {
 	var newPinMessages []smallMessage
 	var quickPinLookup = make(map[string]struct{})
 	if pinsErr != nil {
@@ -119,17 +458,229 @@ func (c *ManagedChannel) LoadBacklog() error {
 			quickPinLookup[pins[i].ID] = struct{}{}
 		}
 	}
+	c.pinMessages = newPinMessages
+	return quickPinLookup
+}
+
+// fetchBacklog pages back through the channel history, newest first, until
+// it runs out or hits the count or age limit from the config. truncated is
+// set if it stopped at a limit.
+func (c *ManagedChannel) fetchBacklog() (msgs []*discordgo.Message, truncated bool, err error) {
+	limit := c.bot.backlogLimit()
+	var cutoff time.Time
+	if c.bot.Config.BacklogMaxAge > 0 {
+		cutoff = c.bot.now().Add(-c.bot.Config.BacklogMaxAge)
+	}
+	before := ""
+	for len(msgs) < limit {
+		n := limit - len(msgs)
+		if n > 100 {
+			n = 100
+		}
+		page, err := c.bot.client.ChannelMessages(c.Channel.ID, n, before, "", "")
+		if err != nil {
+			return nil, false, err
+		}
+		for _, v := range page {
+			if !cutoff.IsZero() {
+				ts, err := v.Timestamp.Parse()
+				if err == nil && ts.Before(cutoff) {
+					return msgs, true, nil
+				}
+			}
+			msgs = append(msgs, v)
+		}
+		if len(page) < n {
+			return msgs, false, nil
+		}
+		before = page[len(page)-1].ID
+	}
+	return msgs, true, nil
+}
+
+// takeBacklogTruncated reports and clears backlogTruncated.
+func (c *ManagedChannel) takeBacklogTruncated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.backlogTruncated
+	c.backlogTruncated = false
+	return t
+}
+
+// LoadBacklog brings the tracked messages up to date with the channel. After
+// the first load it only fetches messages newer than the newest one seen,
+// falling back to a full load if there are more of those than the backlog
+// limit.
+func (c *ManagedChannel) LoadBacklog() error {
+	if c.isForum() {
+		return c.loadPosts()
+	}
+	done, err := c.loadNewer()
+	if done || err != nil {
+		return err
+	}
+	return c.loadFullBacklog()
+}
+
+// loadNewer fetches the messages posted since the newest one seen and adds
+// them to the tracked set. It reports false, and does nothing, if there
+// hasn't been a full load yet or the gap is over the backlog limit.
+//
+// Edits and pins made while we weren't listening are caught the way a full
+// load catches them: the pins are fetched again, and so is the last page of
+// messages we already had, in case a link preview or embed was added to one.
+// Tracked messages that are now exempt are dropped, and reloaded ones that no
+// longer are get tracked.
+func (c *ManagedChannel) loadNewer() (bool, error) {
+	c.mu.Lock()
+	after := c.lastSeenID
+	c.mu.Unlock()
+	select {
+	case <-c.isStarted:
+	default:
+		return false, nil
+	}
+	if after == "" {
+		return false, nil
+	}
+	// The newest page we already had, up to and including after
+	recent, err := c.bot.client.ChannelMessages(c.Channel.ID, 100, nextID(after), "", "")
+	if err != nil {
+		fmt.Println("could not reload recent messages for", c.Channel.ID, err)
+		return false, err
+	}
+	pins, pinsErr := c.loadPins(true)
+	if pinsErr != nil {
+		fmt.Println("could not load pins for", c.Channel.ID, pinsErr)
+	}
+
+	limit := c.bot.backlogLimit()
+	var msgs []*discordgo.Message
+	for {
+		page, err := c.bot.client.ChannelMessages(c.Channel.ID, 100, "", after, "")
+		if err != nil {
+			fmt.Println("could not load new messages for", c.Channel.ID, err)
+			return false, err
+		}
+		for _, v := range page {
+			if idLess(after, v.ID) {
+				after = v.ID
+			}
+		}
+		msgs = append(msgs, page...)
+		if len(page) < 100 {
+			break
+		}
+		if len(msgs) >= limit {
+			fmt.Printf("[load] %s #%s has more than %d new msgs, doing a full load\n", c.Channel.ID, c.Channel.Name, limit)
+			return false, nil
+		}
+	}
+	// Reloaded messages that are no longer exempt get tracked like new ones
+	msgs = append(msgs, recent...)
+	sort.Slice(msgs, func(i, j int) bool { return idLess(msgs[i].ID, msgs[j].ID) })
+	roleTimes := make(map[string]time.Duration)
+	for _, v := range msgs {
+		if _, ok := roleTimes[authorID(v)]; !ok {
+			roleTimes[authorID(v)] = c.roleLiveTime(v)
+		}
+	}
+
+	defer c.bot.QueueReap(c)    // requires mutex unlocked
+	defer c.bot.checkBacklog(c) // same
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pinned := c.applyPins(pins, pinsErr)
+	if len(c.pinMessages) > 0 {
+		c.HasPins = true
+	}
+	dropped := 0
+	for id := range pinned {
+		if c.dropLiveMessage(id) {
+			dropped++
+		}
+	}
+	for _, v := range recent {
+		if c.isExempt(v) && c.dropLiveMessage(v.ID) {
+			dropped++
+		}
+	}
+
+	var fresh []smallMessage
+	for _, v := range msgs {
+		if _, ok := pinned[v.ID]; ok || c.isExempt(v) || c.isTracked(v.ID) {
+			continue
+		}
+		ts, err := v.Timestamp.Parse()
+		if err != nil || ts.IsZero() || ts.Before(c.EffectiveFrom) {
+			continue
+		}
+		fresh = append(fresh, smallMessage{
+			MessageID:     v.ID,
+			PostedAt:      ts,
+			HasAttachment: len(v.Attachments) > 0,
+			Length:        utf8.RuneCountInString(v.Content),
+			LiveTime:      roleTimes[authorID(v)],
+		})
+		c.rememberForArchive(v, ts)
+	}
+	c.liveMessages = mergeByTime(c.liveMessages, fresh)
+	if idLess(c.lastSeenID, after) {
+		c.lastSeenID = after
+	}
+	fmt.Printf("[load] %s #%s caught up, %d new msgs, %d now exempt, %d tracked\n", c.Channel.ID, c.Channel.Name, len(fresh), dropped, len(c.liveMessages))
+	return true, nil
+}
+
+// loadFullBacklog replaces the tracked messages and pins with a fresh load
+// of the channel history, up to the backlog limit.
+func (c *ManagedChannel) loadFullBacklog() error {
+	if c.isForum() {
+		return c.loadPosts()
+	}
+	msgs, truncated, err := c.fetchBacklog()
+	if err != nil {
+		fmt.Println("could not load backlog for", c.Channel.ID, err)
+		return err
+	}
+	if truncated {
+		fmt.Printf("[load] %s #%s history is past the backlog limit, only loaded the newest %d msgs\n", c.Channel.ID, c.Channel.Name, len(msgs))
+	}
+	pins, pinsErr := c.loadPins(false)
+	if pinsErr != nil {
+		fmt.Println("could not load pins for", c.Channel.ID, pinsErr)
+		//return err
+	}
+
+	roleTimes := make(map[string]time.Duration)
+	for _, v := range msgs {
+		if _, ok := roleTimes[authorID(v)]; !ok {
+			roleTimes[authorID(v)] = c.roleLiveTime(v)
+		}
+	}
+
+	defer c.bot.QueueReap(c)    // requires mutex unlocked
+	defer c.bot.checkBacklog(c) // same
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	quickPinLookup := c.applyPins(pins, pinsErr)
+	c.backlogTruncated = truncated
+	for _, v := range msgs {
+		if idLess(c.lastSeenID, v.ID) {
+			c.lastSeenID = v.ID
+		}
+	}
 
 	c.liveMessages = make([]smallMessage, 0, len(msgs))
+	c.archive = nil
 	// Iterate backwards so we swap the order
 	for i := len(msgs); i > 0; i-- {
 		v := msgs[i-1]
 
 		// Check for non-deletion
-		keep := false
-		if v.ID == c.ConfMessageID {
-			keep = true
-		}
+		keep := c.isExempt(v)
 		if _, found := quickPinLookup[v.ID]; found {
 			keep = true
 		}
@@ -141,13 +692,17 @@ func (c *ManagedChannel) LoadBacklog() error {
 		if err != nil {
 			panic("Timestamp format change")
 		}
-		if ts.IsZero() {
+		if ts.IsZero() || ts.Before(c.EffectiveFrom) {
 			continue
 		}
 		c.liveMessages = append(c.liveMessages, smallMessage{
-			MessageID: v.ID,
-			PostedAt:  ts,
+			MessageID:     v.ID,
+			PostedAt:      ts,
+			HasAttachment: len(v.Attachments) > 0,
+			Length:        utf8.RuneCountInString(v.Content),
+			LiveTime:      roleTimes[authorID(v)],
 		})
+		c.rememberForArchive(v, ts)
 	}
 
 	// mark as ready for AddMessage()
@@ -162,6 +717,151 @@ func (c *ManagedChannel) LoadBacklog() error {
 	return nil
 }
 
+// isExempt reports whether a message should never be deleted, regardless of
+// the channel's age or count limits. Pins are checked separately.
+// Must be called with the mutex held.
+func (c *ManagedChannel) isExempt(m *discordgo.Message) bool {
+	if m.ID == c.ConfMessageID || (m.ID == c.NoticeMessageID && m.ID != "") {
+		return true
+	}
+	if isSystemMessage(m) {
+		switch c.SystemMessages {
+		case SystemKeep:
+			return true
+		case SystemDelete:
+			return false
+		}
+	}
+	if c.ContentPattern != nil && !c.ContentPattern.MatchString(m.Content) {
+		return true
+	}
+	if (c.OnlyWithLinks || c.OnlyWithEmbeds) && !c.hasLinkOrEmbed(m) {
+		return true
+	}
+	if m.Author == nil {
+		return false
+	}
+	if !c.DeleteOwn && c.bot.me != nil && m.Author.ID == c.bot.me.ID {
+		return true
+	}
+	if c.KeepBots && m.Author.Bot {
+		return true
+	}
+	for _, id := range c.KeepUsers {
+		if m.Author.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// A SystemMode says what happens to system messages: member joins, boosts,
+// "pinned a message" notices and the like. The notice for a pin is not the
+// pinned message itself, so KeepPinned doesn't protect it.
+type SystemMode int
+
+const (
+	// SystemLikeOthers treats system messages like any other message,
+	// including the content filters (which most of them won't match).
+	SystemLikeOthers SystemMode = iota
+	// SystemKeep never deletes system messages.
+	SystemKeep
+	// SystemDelete deletes system messages on the usual schedule even if
+	// the content filters would keep them.
+	SystemDelete
+)
+
+func (m SystemMode) String() string {
+	switch m {
+	case SystemKeep:
+		return "keep"
+	case SystemDelete:
+		return "delete"
+	}
+	return ""
+}
+
+// parseSystemMode is the inverse of String. Unknown values mean
+// SystemLikeOthers.
+func parseSystemMode(s string) SystemMode {
+	switch s {
+	case "keep":
+		return SystemKeep
+	case "delete":
+		return SystemDelete
+	}
+	return SystemLikeOthers
+}
+
+// A ReapAction is what a channel's reaps do to the messages that are due.
+type ReapAction int
+
+const (
+	// ActionDelete deletes them.
+	ActionDelete ReapAction = iota
+	// ActionClearReactions removes every reaction from them and leaves the
+	// messages be, to reset polls and the like. The messages stop being
+	// tracked once cleared, so reactions added later stay.
+	ActionClearReactions
+	// ActionArchive archives the posts of a forum instead of deleting
+	// them, see forum.go. It only applies to forums.
+	ActionArchive
+)
+
+func (a ReapAction) String() string {
+	switch a {
+	case ActionClearReactions:
+		return "clearreactions"
+	case ActionArchive:
+		return "archive"
+	}
+	return ""
+}
+
+// parseReapAction is the inverse of String. Unknown values mean ActionDelete.
+func parseReapAction(s string) ReapAction {
+	switch s {
+	case "clearreactions":
+		return ActionClearReactions
+	case "archive":
+		return ActionArchive
+	}
+	return ActionDelete
+}
+
+func (c *ManagedChannel) reapAction() ReapAction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Action
+}
+
+// Message types newer than our discordgo that are ordinary user messages.
+const (
+	messageTypeReply          discordgo.MessageType = 19
+	messageTypeChatInput      discordgo.MessageType = 20
+	messageTypeContextCommand discordgo.MessageType = 23
+)
+
+func isSystemMessage(m *discordgo.Message) bool {
+	switch m.Type {
+	case discordgo.MessageTypeDefault, messageTypeReply, messageTypeChatInput, messageTypeContextCommand:
+		return false
+	}
+	return true
+}
+
+var linkRe = regexp.MustCompile(`(?i)\bhttps?://\S|\bdiscord\.gg/\S`)
+
+// hasLinkOrEmbed reports whether a message has what OnlyWithLinks or
+// OnlyWithEmbeds asks for.
+// Must be called with the mutex held.
+func (c *ManagedChannel) hasLinkOrEmbed(m *discordgo.Message) bool {
+	if c.OnlyWithLinks && linkRe.MatchString(m.Content) {
+		return true
+	}
+	return c.OnlyWithEmbeds && len(m.Embeds) > 0
+}
+
 func (b *Bot) LoadAllBacklogs() {
 	b.mu.RLock()
 	for _, v := range b.channels {
@@ -180,35 +880,164 @@ func (c *ManagedChannel) AddMessage(m *discordgo.Message) {
 	//	fmt.Println("[DEBUG]", "Got pinning message", m)
 	// }
 
+	roleTime := c.roleLiveTime(m)
 	c.mu.Lock()
+	if idLess(c.lastSeenID, m.ID) {
+		c.lastSeenID = m.ID
+	}
+	now := c.bot.now()
+	c.lastActivity = now
+	inactivity := c.Inactivity > 0
 	// Check for nondeletion
 	// don't need a pin check here, it's a brand new message
-	keep := false
-	if m.ID == c.ConfMessageID {
-		keep = true
-	}
-	if keep {
+	if c.isExempt(m) {
 		c.mu.Unlock()
+		if inactivity {
+			// Still activity, so the timer starts over
+			c.bot.QueueReap(c)
+		}
 		return
 	}
 
-	if len(c.liveMessages) == 0 {
+	_, maxMessages, _ := c.effectivePolicy()
+	if len(c.liveMessages) == 0 || inactivity {
 		needReap = true
-	} else if c.MaxMessages > 0 && len(c.liveMessages) == c.MaxMessages {
+	} else if maxMessages > 0 && len(c.liveMessages) == maxMessages {
 		needReap = true
 	}
 
 	c.liveMessages = append(c.liveMessages, smallMessage{
-		MessageID: m.ID,
-		PostedAt:  time.Now(),
+		MessageID:     m.ID,
+		PostedAt:      now,
+		HasAttachment: len(m.Attachments) > 0,
+		Length:        utf8.RuneCountInString(m.Content),
+		LiveTime:      roleTime,
 	})
+	c.rememberForArchive(m, now)
+
+	// In announcement mode the previous messages go as soon as a new one
+	// lands, instead of waiting for the timer.
+	var replaced []string
+	if c.Announcement {
+		floor := c.bot.now().Add(-c.MinAge)
+		for len(c.liveMessages) > 1 && !c.liveMessages[0].PostedAt.After(floor) {
+			replaced = append(replaced, c.liveMessages[0].MessageID)
+			c.liveMessages = c.liveMessages[1:]
+		}
+	}
 	c.mu.Unlock()
+	c.bot.checkBacklog(c)
 
-	if needReap {
+	if len(replaced) > 0 {
+		go c.bot.reapMessages(c, replaced)
+	} else if needReap {
 		c.bot.QueueReap(c)
 	}
 }
 
+// UpdateMessage handles an edit to a message, which is also how Discord
+// delivers link previews. In a channel that only deletes messages with links
+// or embeds, a message that didn't qualify when it was posted may now.
+func (c *ManagedChannel) UpdateMessage(m *discordgo.Message) {
+	<-c.isStarted
+	c.mu.Lock()
+	if !(c.OnlyWithLinks || c.OnlyWithEmbeds) || !c.hasLinkOrEmbed(m) || c.isTracked(m.ID) {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	// Embed updates only carry the embeds, so get the rest of the message
+	// before deciding whether it is exempt.
+	full, err := c.bot.client.ChannelMessage(c.Channel.ID, m.ID)
+	if err != nil {
+		fmt.Println("[updt] could not fetch message", c.Channel.ID, m.ID, err)
+		return
+	}
+	ts, err := full.Timestamp.Parse()
+	if err != nil || ts.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	early := ts.Before(c.EffectiveFrom)
+	c.mu.Unlock()
+	if early {
+		return
+	}
+	roleTime := c.roleLiveTime(full)
+
+	c.mu.Lock()
+	if c.isExempt(full) || c.isTracked(full.ID) {
+		c.mu.Unlock()
+		return
+	}
+	idx := sort.Search(len(c.liveMessages), func(i int) bool {
+		return c.liveMessages[i].PostedAt.After(ts)
+	})
+	c.liveMessages = append(c.liveMessages, smallMessage{})
+	copy(c.liveMessages[idx+1:], c.liveMessages[idx:])
+	c.liveMessages[idx] = smallMessage{
+		MessageID:     full.ID,
+		PostedAt:      ts,
+		HasAttachment: len(full.Attachments) > 0,
+		Length:        utf8.RuneCountInString(full.Content),
+		LiveTime:      roleTime,
+	}
+	c.rememberForArchive(full, ts)
+	c.mu.Unlock()
+
+	c.bot.QueueReap(c)
+}
+
+func authorID(m *discordgo.Message) string {
+	if m.Author == nil {
+		return ""
+	}
+	return m.Author.ID
+}
+
+// roleLiveTime returns the retention the author's roles give a message, or
+// zero if none of the channel's RoleLiveTimes apply. It may call the API, so
+// it must be called without the mutex held.
+func (c *ManagedChannel) roleLiveTime(m *discordgo.Message) time.Duration {
+	// The map is replaced on a config change, never modified
+	c.mu.Lock()
+	roleTimes := c.RoleLiveTimes
+	c.mu.Unlock()
+	if len(roleTimes) == 0 || m.Author == nil || m.Author.Bot {
+		return 0
+	}
+	member, err := c.bot.client.GuildMember(c.Channel.GuildID, m.Author.ID)
+	if err != nil {
+		// Gone from the server, most likely
+		return 0
+	}
+	var best time.Duration
+	for _, r := range member.Roles {
+		if d := roleTimes[r]; d > best {
+			best = d
+		}
+	}
+	return best
+}
+
+// isTracked reports whether a message is already waiting to be deleted, or
+// is a pin we are keeping.
+// Must be called with the mutex held.
+func (c *ManagedChannel) isTracked(id string) bool {
+	for _, v := range c.liveMessages {
+		if v.MessageID == id {
+			return true
+		}
+	}
+	for _, v := range c.pinMessages {
+		if v.MessageID == id {
+			return true
+		}
+	}
+	return false
+}
+
 // UpdatePins gets called in two situations - a pin was added, a pin was
 // removed, or more than one of those happened too fast for us to notice.
 func (c *ManagedChannel) UpdatePins(hasPins bool) {
@@ -222,11 +1051,11 @@ func (c *ManagedChannel) UpdatePins(hasPins bool) {
 	}
 
 	if hasPins {
-		c.LoadBacklog()
+		c.loadFullBacklog()
 	}
 
 	/*
-		pins, err := c.bot.s.ChannelMessagesPinned(c.Channel.ID)
+		pins, err := c.bot.client.ChannelMessagesPinned(c.Channel.ID)
 		if err != nil {
 			fmt.Println("could not load pins for", c.Channel.ID, err)
 			return
@@ -265,6 +1094,15 @@ func (c *ManagedChannel) UpdatePins(hasPins bool) {
 func (c *ManagedChannel) DoNotDeleteMessage(msgID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	delete(c.archive, msgID)
+	if !c.dropLiveMessage(msgID) {
+		fmt.Println("[BUG] DoNotDeleteMessage called with non-live message")
+	}
+}
+
+// dropLiveMessage stops tracking a message. Returns false if it wasn't tracked.
+// Must be called with the mutex held.
+func (c *ManagedChannel) dropLiveMessage(msgID string) bool {
 	idx := -1
 
 	for i, v := range c.liveMessages {
@@ -273,20 +1111,192 @@ func (c *ManagedChannel) DoNotDeleteMessage(msgID string) {
 		}
 	}
 	if idx == -1 {
-		fmt.Println("[BUG] DoNotDeleteMessage called with non-live message")
-		return
+		return false
 	}
 	lenMinus1 := len(c.liveMessages) - 1
 	// Delete item
 	copy(c.liveMessages[idx:], c.liveMessages[idx+1:])
 	c.liveMessages[lenMinus1] = smallMessage{}
 	c.liveMessages = c.liveMessages[:lenMinus1]
+	return true
+}
+
+// isTriggerEmoji reports whether the emoji is this channel's deletion trigger.
+func (c *ManagedChannel) isTriggerEmoji(e *discordgo.Emoji) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.TriggerEmoji == "" || c.TriggerCount <= 0 || e == nil {
+		return false
+	}
+	return c.TriggerEmoji == e.APIName() || c.TriggerEmoji == e.Name
+}
+
+// reactionTriggered reports whether the message has enough trigger reactions
+// to be deleted.
+func (c *ManagedChannel) reactionTriggered(m *discordgo.Message) bool {
+	for _, r := range m.Reactions {
+		if c.isTriggerEmoji(r.Emoji) {
+			c.mu.Lock()
+			threshold := c.TriggerCount
+			c.mu.Unlock()
+			return r.Count >= threshold
+		}
+	}
+	return false
 }
 
 func (c *ManagedChannel) Enabled() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.MessageLiveTime > 0 || c.MaxMessages > 0
+	liveTime, maxMessages, _ := c.effectivePolicy()
+	return liveTime > 0 || maxMessages > 0 || c.Announcement || c.Schedule != nil || c.Inactivity > 0
+}
+
+// policySource says where a channel's effective settings come from.
+type policySource int
+
+const (
+	policyNone policySource = iota
+	policyChannel
+	policyGuild
+)
+
+func (p policySource) String() string {
+	switch p {
+	case policyChannel:
+		return "channel setting"
+	case policyGuild:
+		return "server default"
+	}
+	return "not set"
+}
+
+// effectivePolicy resolves the live time and message cap for the channel.
+// The channel's own settings win, then the guild default if the channel
+// follows it, then nothing.
+// Must be called with the mutex held.
+func (c *ManagedChannel) effectivePolicy() (time.Duration, int, policySource) {
+	if c.MessageLiveTime != 0 || c.MaxMessages != 0 {
+		return c.MessageLiveTime, c.MaxMessages, policyChannel
+	}
+	if c.UseGuildDefault {
+		if g, ok := c.bot.guildDefault(c.Channel.GuildID); ok {
+			return g.LiveTime, g.MaxMessages, policyGuild
+		}
+	}
+	return 0, 0, policyNone
+}
+
+// A PolicyMode says how MessageLiveTime and MaxMessages combine when both are
+// set. With only one of them set, the mode makes no difference.
+type PolicyMode int
+
+const (
+	// PolicyEither deletes a message as soon as it hits either limit. With
+	// 1h and 50, a message goes once it is an hour old, or right away once
+	// 50 newer messages have been posted, whichever happens first.
+	PolicyEither PolicyMode = iota
+	// PolicyBoth deletes a message only once it is past both limits. With
+	// 1h and 50, the newest 50 messages always stay, and older ones go once
+	// they are an hour old.
+	PolicyBoth
+)
+
+func (m PolicyMode) String() string {
+	if m == PolicyBoth {
+		return "both"
+	}
+	return "either"
+}
+
+// parsePolicyMode is the inverse of String. Unknown values mean PolicyEither.
+func parsePolicyMode(s string) PolicyMode {
+	if s == "both" {
+		return PolicyBoth
+	}
+	return PolicyEither
+}
+
+// describePolicy summarizes the deletion settings in words.
+// Must be called with the mutex held.
+func (c *ManagedChannel) describePolicy() string {
+	var desc string
+	liveTime, maxMessages, source := c.effectivePolicy()
+	switch {
+	case c.Inactivity != 0 && maxMessages != 0:
+		desc = fmt.Sprintf("once nobody has posted for %s, or after %d messages", c.Inactivity, maxMessages)
+	case c.Inactivity != 0:
+		desc = fmt.Sprintf("once nobody has posted for %s", c.Inactivity)
+	case c.Schedule != nil && maxMessages != 0:
+		desc = fmt.Sprintf("on the schedule `%s` (%s), or after %d messages", c.Schedule, c.Schedule.loc, maxMessages)
+	case c.Schedule != nil:
+		desc = fmt.Sprintf("on the schedule `%s` (%s)", c.Schedule, c.Schedule.loc)
+	case liveTime != 0 && maxMessages != 0 && c.PolicyMode == PolicyBoth:
+		desc = fmt.Sprintf("after %s, once %d newer messages have been posted", liveTime, maxMessages)
+	case liveTime != 0 && maxMessages != 0:
+		desc = fmt.Sprintf("after %s or %d messages, whichever comes first", liveTime, maxMessages)
+	case liveTime != 0:
+		desc = fmt.Sprintf("after %s", liveTime)
+	case maxMessages != 0:
+		desc = fmt.Sprintf("after %d other messages", maxMessages)
+	case c.Announcement:
+		desc = "as soon as a newer message is posted"
+	default:
+		desc = "never"
+	}
+	desc += fmt.Sprintf(" (%s)", source)
+	if c.KeepMessages != 0 {
+		desc += fmt.Sprintf(", always keeping the newest %d", c.KeepMessages)
+	} else if c.KeepNewest {
+		desc += ", always keeping the newest message"
+	}
+	if c.MinAge != 0 {
+		desc += fmt.Sprintf(", never deleting messages younger than %s", c.MinAge)
+	}
+	if !c.EffectiveFrom.IsZero() {
+		desc += fmt.Sprintf(", leaving messages from before <t:%d:f> alone", c.EffectiveFrom.Unix())
+	}
+	if c.GraceUntil.After(c.bot.now()) {
+		desc += fmt.Sprintf(", starting <t:%d:f>", c.GraceUntil.Unix())
+	}
+	if c.Action == ActionClearReactions {
+		desc += ", clearing their reactions instead of deleting them"
+	} else if c.Action == ActionArchive {
+		desc += ", archiving them instead of deleting them"
+	}
+	if c.MoveTo != "" {
+		desc += fmt.Sprintf(", moving them to <#%s> first", c.MoveTo)
+	}
+	if c.QuietHours != nil {
+		desc += fmt.Sprintf(", except during quiet hours %s (%s)", c.QuietHours, c.QuietHours.loc)
+	}
+	if c.AttachmentLiveTime != 0 {
+		desc += fmt.Sprintf(", keeping messages with attachments for %s", c.AttachmentLiveTime)
+	}
+	if c.ShortLength != 0 {
+		desc += fmt.Sprintf(", keeping messages under %d characters for %s", c.ShortLength, c.ShortLiveTime)
+	}
+	if n := len(c.RoleLiveTimes); n != 0 {
+		desc += fmt.Sprintf(", with a different retention for %d roles", n)
+	}
+	switch c.SystemMessages {
+	case SystemKeep:
+		desc += ", keeping system messages"
+	case SystemDelete:
+		desc += ", always deleting system messages"
+	}
+	switch {
+	case c.OnlyWithLinks && c.OnlyWithEmbeds:
+		desc += ", only deleting messages with links or embeds"
+	case c.OnlyWithLinks:
+		desc += ", only deleting messages with links"
+	case c.OnlyWithEmbeds:
+		desc += ", only deleting messages with embeds"
+	}
+	if c.Threads {
+		desc += ", and the same in its active threads"
+	}
+	return desc
 }
 
 func (c *ManagedChannel) SetLiveTime(d time.Duration) {
@@ -301,116 +1311,584 @@ func (c *ManagedChannel) SetMaxMessages(max int) {
 	c.MaxMessages = max
 }
 
+// channelLimits are the settings the config command changes together.
+type channelLimits struct {
+	LiveTime     time.Duration
+	MaxMessages  int
+	KeepMessages int
+	MinAge       time.Duration
+}
+
+func (c *ManagedChannel) limits() channelLimits {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return channelLimits{
+		LiveTime:     c.MessageLiveTime,
+		MaxMessages:  c.MaxMessages,
+		KeepMessages: c.KeepMessages,
+		MinAge:       c.MinAge,
+	}
+}
+
+// setLimits replaces all of the limits at once, so a reap never sees some
+// of them changed and not others.
+func (c *ManagedChannel) setLimits(l channelLimits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageLiveTime = l.LiveTime
+	c.MaxMessages = l.MaxMessages
+	c.KeepMessages = l.KeepMessages
+	c.MinAge = l.MinAge
+}
+
+// GetNextDeletionTime returns when the channel's next reap is due. A time that
+// falls in the channel's quiet hours is moved to the end of them.
 func (c *ManagedChannel) GetNextDeletionTime() time.Time {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	t := c.nextDeletionTime()
+	if c.QuietHours != nil && c.QuietHours.contains(t) {
+		t = c.QuietHours.endAfter(t)
+	}
+	return t
+}
+
+// nextDeletionTime is GetNextDeletionTime without the quiet hours.
+// Must be called with the mutex held.
+func (c *ManagedChannel) nextDeletionTime() time.Time {
+	never := c.bot.now().Add(240 * time.Hour)
 	if len(c.liveMessages) == 0 {
-		return time.Now().Add(240 * time.Hour)
+		return never
 	}
 
 	if c.liveMessages[0].MessageID == c.ConfMessageID {
 		c.liveMessages = c.liveMessages[1:]
 	}
-	if c.MaxMessages > 0 && len(c.liveMessages) > c.MaxMessages {
-		return time.Now()
+	liveTime, maxMessages, _ := c.effectivePolicy()
+	keep, both := c.keepCount(liveTime, maxMessages)
+	candidates := len(c.liveMessages) - keep
+	if candidates <= 0 {
+		// Nothing is eligible until more messages arrive
+		return never
+	}
+	if !both && maxMessages > 0 && len(c.liveMessages) > maxMessages {
+		return laterOf(c.bot.now(), c.liveMessages[0].PostedAt.Add(c.MinAge))
+	}
+	if c.Inactivity > 0 {
+		return laterOf(c.lastPostAt().Add(c.Inactivity), c.liveMessages[0].PostedAt.Add(c.MinAge))
+	}
+	if c.Schedule != nil {
+		// The oldest message is always the first to come up
+		if t := c.scheduledAt(c.liveMessages[0]); !t.IsZero() {
+			return t
+		}
+		return never
 	}
-	if c.MessageLiveTime != 0 {
-		return c.liveMessages[0].PostedAt.Add(c.MessageLiveTime)
+	next := never
+	for _, v := range c.liveMessages[:candidates] {
+		lt := c.retentionFor(v, liveTime)
+		if lt != 0 {
+			t := laterOf(v.PostedAt.Add(lt), v.PostedAt.Add(c.MinAge))
+			if t.Before(next) {
+				next = t
+			}
+		}
+		if c.AttachmentLiveTime == 0 && c.ShortLength == 0 && len(c.RoleLiveTimes) == 0 && lt != 0 {
+			// Everything has the same retention, so the oldest is soonest
+			break
+		}
 	}
-	return time.Now().Add(240 * time.Hour)
+	return next
+}
+
+// lastPostAt returns when the channel was last posted in.
+// Must be called with the mutex held.
+func (c *ManagedChannel) lastPostAt() time.Time {
+	t := c.lastActivity
+	if n := len(c.liveMessages); n > 0 {
+		t = laterOf(t, c.liveMessages[n-1].PostedAt)
+	}
+	return t
+}
+
+// scheduledAt returns the run of the channel's schedule that deletes the
+// message: the first one after it is MinAge old.
+// Must be called with the mutex held.
+func (c *ManagedChannel) scheduledAt(m smallMessage) time.Time {
+	return c.Schedule.Next(m.PostedAt.Add(c.MinAge))
+}
+
+// keepCount returns how many of the newest messages can't be deleted yet,
+// and whether the count and time limits both have to be met.
+// Must be called with the mutex held.
+func (c *ManagedChannel) keepCount(liveTime time.Duration, maxMessages int) (int, bool) {
+	keep := c.KeepMessages
+	if c.KeepNewest && keep < 1 {
+		keep = 1
+	}
+	both := c.PolicyMode == PolicyBoth && liveTime > 0 && maxMessages > 0
+	if both && maxMessages > keep {
+		// Only messages over the cap may go, and only once they age out
+		keep = maxMessages
+	}
+	return keep, both
+}
+
+// retentionFor returns how long a message is kept before it ages out.
+// Must be called with the mutex held.
+func (c *ManagedChannel) retentionFor(m smallMessage, liveTime time.Duration) time.Duration {
+	if m.LiveTime > 0 {
+		return m.LiveTime
+	}
+	if m.HasAttachment && c.AttachmentLiveTime > 0 {
+		return c.AttachmentLiveTime
+	}
+	if c.ShortLength > 0 && !m.HasAttachment && m.Length < c.ShortLength {
+		return c.ShortLiveTime
+	}
+	return liveTime
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
 }
 
 const errCodeBulkDeleteOld = 50034
 
-func (c *ManagedChannel) Reap(msgs []string) (int, error) {
-	var err error
-	count := 0
+// Not in the vendored discordgo
+const errCodeUnknownWebhook = 10015
 
-nobulk:
-	switch {
-	case true:
-		for len(msgs) > 50 {
-			err := c.bot.s.ChannelMessagesBulkDelete(c.Channel.ID, msgs[:50])
-			if rErr, ok := err.(*discordgo.RESTError); ok {
-				if rErr.Message != nil && rErr.Message.Code == errCodeBulkDeleteOld {
-					break nobulk
-				}
-				return count, err
-			} else if err != nil {
-				return count, err
-			}
-			msgs = msgs[50:]
-			count += 50
-		}
-		err = c.bot.s.ChannelMessagesBulkDelete(c.Channel.ID, msgs)
-		count += len(msgs)
-		if rErr, ok := err.(*discordgo.RESTError); ok {
-			if rErr.Message != nil && rErr.Message.Code == errCodeBulkDeleteOld {
-				break nobulk
+// Discord refuses to bulk delete messages older than this. We leave a little
+// margin so a message doesn't age out between collection and deletion.
+const bulkDeleteMaxAge = 14*24*time.Hour - 10*time.Minute
+
+const discordEpoch = 1420070400000
+
+// snowflakeTime extracts the creation time from a Discord ID.
+func snowflakeTime(id string) time.Time {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	ms := int64(n>>22) + discordEpoch
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// isUnknownMessage reports whether err means the message is already gone.
+// Other 404s, like Unknown Channel, are real failures.
+func isUnknownMessage(err error) bool {
+	return isErrorCode(err, discordgo.ErrCodeUnknownMessage)
+}
+
+// isErrorCode reports whether err is a Discord API error with the given code.
+func isErrorCode(err error, code int) bool {
+	rErr, ok := err.(*discordgo.RESTError)
+	return ok && rErr != nil && rErr.Message != nil && rErr.Message.Code == code
+}
+
+// rateLimitDelay returns how long Discord asked us to wait, if err is a 429.
+func rateLimitDelay(err error) (time.Duration, bool) {
+	rErr, ok := err.(*discordgo.RESTError)
+	if !ok || rErr == nil || rErr.Response == nil || rErr.Response.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	secs, _ := strconv.ParseFloat(rErr.Response.Header.Get("Retry-After"), 64)
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+// callWithContext runs fn, giving up when ctx is done. discordgo can't cancel
+// a request in flight, so an abandoned call finishes in the background and
+// its result is discarded. A panic in fn is raised again in the caller, where
+// the worker can recover from it.
+func callWithContext(ctx context.Context, fn func() error) error {
+	errCh := make(chan error, 1)
+	panicCh := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicCh <- r
 			}
-			return count, err
+		}()
+		errCh <- fn()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case r := <-panicCh:
+		panic(r)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withRetry calls fn, sleeping and retrying a bounded number of times if it
+// gets rate limited. It returns how many of the calls were rate limited.
+func (c *ManagedChannel) withRetry(ctx context.Context, fn func() error) (int, error) {
+	backoff := c.bot.reapBackoff()
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.bot.limiter.Wait(ctx)
+		if err != nil {
+			return attempt, err
+		}
+		err = callWithContext(ctx, fn)
+		retryAfter, limited := rateLimitDelay(err)
+		if !limited {
+			return attempt, err
+		}
+		metrics.RateLimitHits.Inc()
+		if attempt >= c.bot.reapRetries() {
+			return attempt + 1, err
+		}
+		c.mu.Lock()
+		c.stats.RateLimitRetries++
+		c.mu.Unlock()
+		if retryAfter < backoff {
+			retryAfter = backoff
+		}
+		c.bot.reaper.log.Warn("rate limited", "channel_id", c.Channel.ID, "channel", c.Channel.Name, "retry_after", retryAfter)
+		select {
+		case <-time.After(retryAfter):
+		case <-ctx.Done():
+			return attempt + 1, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// A ReapResult is what happened to the messages passed to Reap.
+type ReapResult struct {
+	// Deleted with the bulk-delete endpoint, and one at a time
+	BulkDeleted   int
+	SingleDeleted int
+	// Already gone when the bot tried to delete them
+	Skipped int
+	// Would have been deleted, if not for Config.DryRun
+	DryRun int
+	// Had their reactions cleared instead, for ActionClearReactions
+	Cleared int
+	// Forum posts archived instead, for ActionArchive
+	Archived int
+	// Delete calls that hit a rate limit, including ones that then worked
+	// on a retry
+	RateLimited int
+	// Why Reap stopped early, if it did. Messages after the failure are
+	// not counted anywhere, but are listed in Failed.
+	Err    error
+	Failed []string
+}
+
+// Deleted is how many messages Reap actually deleted.
+func (r ReapResult) Deleted() int {
+	return r.BulkDeleted + r.SingleDeleted
+}
+
+// add combines the results of reaping parts of a channel at once. The first
+// error wins.
+func (r ReapResult) add(o ReapResult) ReapResult {
+	r.BulkDeleted += o.BulkDeleted
+	r.SingleDeleted += o.SingleDeleted
+	r.Skipped += o.Skipped
+	r.DryRun += o.DryRun
+	r.Cleared += o.Cleared
+	r.Archived += o.Archived
+	r.RateLimited += o.RateLimited
+	if r.Err == nil {
+		r.Err = o.Err
+	}
+	r.Failed = append(r.Failed, o.Failed...)
+	return r
+}
+
+// Reap deletes the given messages from the channel. Messages young enough
+// for the bulk-delete endpoint are deleted in sequential batches of up to
+// Config.BulkDeleteSize; older ones are deleted one at a time. Every call
+// waits on the shared rate limiter first.
+//
+// Messages that are already gone (Unknown Message) are not an error. If a
+// bulk delete fails that way, its batch is retried one at a time so the rest
+// still go, and the missing ones are skipped.
+//
+// Rate limited calls are retried with backoff. The result counts what was
+// done before the first error, if any. If ctx expires, Reap stops with the
+// context's error.
+//
+// For a forum, msgs are posts, see reapPosts.
+func (c *ManagedChannel) Reap(ctx context.Context, msgs []string) ReapResult {
+	var res ReapResult
+	if c.bot.Config.DryRun {
+		c.bot.reaper.log.Info("DRY RUN: would delete messages", "channel_id", c.Channel.ID, "channel", c.Channel.Name, "count", len(msgs), "message_ids", msgs)
+		res.DryRun = len(msgs)
+		return res
+	}
+	if c.isForum() {
+		return c.reapPosts(ctx, msgs)
+	}
+	if c.reapAction() == ActionClearReactions {
+		return c.clearReactions(ctx, msgs)
+	}
+
+	bulkCutoff := c.bot.now().Add(-bulkDeleteMaxAge)
+	var bulk, single []string
+	for _, msg := range msgs {
+		if snowflakeTime(msg).Before(bulkCutoff) {
+			single = append(single, msg)
+		} else {
+			bulk = append(bulk, msg)
+		}
+	}
+
+	batchSize := c.bot.bulkDeleteSize()
+	for len(bulk) > 0 {
+		batch := bulk
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		bulk = bulk[len(batch):]
+
+		limited, err := c.withRetry(ctx, func() error {
+			return c.bot.client.ChannelMessagesBulkDelete(c.Channel.ID, batch)
+		})
+		res.RateLimited += limited
+		if rErr, ok := err.(*discordgo.RESTError); ok && rErr.Message != nil && rErr.Message.Code == errCodeBulkDeleteOld {
+			// Our idea of the cutoff was off, fall back to single deletes
+			single = append(single, batch...)
+			continue
+		} else if isUnknownMessage(err) {
+			// Someone got to one of them first. Find out which.
+			single = append(single, batch...)
+			continue
 		} else if err != nil {
-			return count, err
+			res.Err = err
+			res.Failed = make([]string, 0, len(batch)+len(bulk)+len(single))
+			res.Failed = append(res.Failed, batch...)
+			res.Failed = append(res.Failed, bulk...)
+			res.Failed = append(res.Failed, single...)
+			return res
 		}
-		return count, nil
+		res.BulkDeleted += len(batch)
 	}
 
-	// single delete required
-	// Spin up a separate goroutine - this could take a while
-	go func() {
-		for _, msg := range msgs {
-			err = c.bot.s.ChannelMessageDelete(c.Channel.ID, msg)
-			if err != nil {
-				fmt.Println("Error in single-message delete:", err, c.Channel.ID, msg)
-			}
+	for i, msg := range single {
+		limited, err := c.withRetry(ctx, func() error {
+			return c.bot.client.ChannelMessageDelete(c.Channel.ID, msg)
+		})
+		res.RateLimited += limited
+		if isUnknownMessage(err) {
+			res.Skipped++
+			continue
+		} else if err != nil {
+			res.Err = err
+			res.Failed = single[i:]
+			return res
 		}
-		// re-load the backlog in case this surfaced more things to delete
-		c.LoadBacklog()
-	}()
-	return -1, nil
+		res.SingleDeleted++
+	}
+	return res
+}
+
+// clearReactions is Reap for ActionClearReactions: it removes the reactions
+// from each message, one call per message, instead of deleting it.
+func (c *ManagedChannel) clearReactions(ctx context.Context, msgs []string) ReapResult {
+	var res ReapResult
+	for i, msg := range msgs {
+		limited, err := c.withRetry(ctx, func() error {
+			return c.bot.client.MessageReactionsRemoveAll(c.Channel.ID, msg)
+		})
+		res.RateLimited += limited
+		if isUnknownMessage(err) {
+			res.Skipped++
+			continue
+		} else if err != nil {
+			res.Err = err
+			res.Failed = msgs[i:]
+			return res
+		}
+		res.Cleared++
+	}
+	return res
+}
+
+// retrack puts messages that were collected for a reap but not deleted back
+// in the tracked set. They were already due, so only their IDs are needed.
+func (c *ManagedChannel) retrack(msgs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var back []smallMessage
+	for _, id := range msgs {
+		if c.isTracked(id) {
+			continue
+		}
+		back = append(back, smallMessage{MessageID: id, PostedAt: snowflakeTime(id)})
+	}
+	sort.Slice(back, func(i, j int) bool { return back[i].PostedAt.Before(back[j].PostedAt) })
+	c.liveMessages = mergeByTime(c.liveMessages, back)
 }
 
 func (c *ManagedChannel) collectMessagesToDelete() []string {
+	msgs, _ := c.collectChunk(0)
+	return msgs
+}
+
+// collectChunk is collectMessagesToDelete, but takes at most max messages
+// (the oldest) if max is positive. The rest stay tracked, and more reports
+// whether there were any.
+func (c *ManagedChannel) collectChunk(max int) (msgs []string, more bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	var toDelete []string
+	now := c.bot.now()
+	if c.QuietHours != nil && c.QuietHours.contains(now) {
+		// Wait for the window to close; QueueReap will say when
+		return nil, false
+	}
+	due, remaining := c.dueMessages(now)
+	if max > 0 && len(due) > max {
+		remaining = mergeByTime(due[max:], remaining)
+		due = due[:max]
+		more = true
+	}
+	c.liveMessages = remaining
+	toDelete := make([]string, len(due))
+	for i, v := range due {
+		toDelete[i] = v.MessageID
+	}
+	return toDelete, more
+}
+
+// nextID returns the snowflake after id, so that fetching messages before it
+// includes id itself.
+func nextID(id string) string {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return id
+	}
+	return strconv.FormatUint(n+1, 10)
+}
+
+// mergeByTime merges two lists of messages that are each sorted oldest first.
+func mergeByTime(a, b []smallMessage) []smallMessage {
+	out := make([]smallMessage, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].PostedAt.Before(a[0].PostedAt) {
+			out = append(out, b[0])
+			b = b[1:]
+		} else {
+			out = append(out, a[0])
+			a = a[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
+
+// ageBuckets are the upper bounds of the buckets AgeHistogram counts into.
+var ageBuckets = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// AgeHistogram counts the tracked messages by age: one count per entry in
+// ageBuckets, and a last one for anything older.
+func (c *ManagedChannel) AgeHistogram() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.bot.now()
+	counts := make([]int, len(ageBuckets)+1)
+	for _, v := range c.liveMessages {
+		age := now.Sub(v.PostedAt)
+		i := sort.Search(len(ageBuckets), func(i int) bool { return age < ageBuckets[i] })
+		counts[i]++
+	}
+	return counts
+}
+
+// PreviewDeletion returns up to k of the oldest messages that the next reap
+// will delete, without deleting or forgetting anything.
+func (c *ManagedChannel) PreviewDeletion(k int) []smallMessage {
+	next := c.GetNextDeletionTime()
+	if now := c.bot.now(); next.Before(now) {
+		next = now
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	due, _ := c.dueMessages(next)
+	if len(due) > k {
+		due = due[:k]
+	}
+	return due
+}
+
+// dueMessages picks the messages that are due for deletion at the given
+// time, oldest first, and returns them along with the messages that stay
+// tracked. The config message is in neither list once it would be due.
+// liveMessages is not modified.
+// Must be called with the mutex held.
+func (c *ManagedChannel) dueMessages(now time.Time) (due, remaining []smallMessage) {
+	live := c.liveMessages
+	floor := now.Add(-c.MinAge)
+	liveTime, maxMessages, _ := c.effectivePolicy()
+	keep, both := c.keepCount(liveTime, maxMessages)
+
+	// Only the oldest candidates messages may go at all
+	candidates := len(live) - keep
+	if candidates < 0 {
+		candidates = 0
+	}
+	overCap := 0
+	if maxMessages > 0 && !both && len(live) > maxMessages {
+		overCap = len(live) - maxMessages
+	}
+
+	// In inactivity mode everything goes at once, when the channel goes quiet
+	inactive := c.Inactivity > 0 && !c.lastPostAt().Add(c.Inactivity).After(now)
+
+	isDue := make([]bool, candidates)
 	var oldest time.Time
 	var zero time.Time
-
-	if c.MaxMessages > 0 {
-		for len(c.liveMessages) > c.MaxMessages {
-			if c.liveMessages[0].MessageID != c.ConfMessageID {
-				toDelete = append(toDelete, c.liveMessages[0].MessageID)
-				if oldest == zero {
-					oldest = c.liveMessages[0].PostedAt
-				}
+	for i := 0; i < candidates; i++ {
+		v := live[i]
+		if v.PostedAt.After(floor) {
+			// Sorted by age, so nothing after this is old enough either
+			candidates = i
+			break
+		}
+		lt := c.retentionFor(v, liveTime)
+		aged := lt > 0 && v.PostedAt.Before(now.Add(-lt))
+		if c.Schedule != nil {
+			t := c.scheduledAt(v)
+			aged = !t.IsZero() && !t.After(now)
+		}
+		if c.Inactivity > 0 {
+			aged = inactive
+		}
+		if i < overCap || aged {
+			isDue[i] = true
+			// A message due early for its own retention doesn't pull its
+			// neighbours along with it
+			if oldest == zero && v.MessageID != c.ConfMessageID && (i < overCap || lt == liveTime) {
+				oldest = v.PostedAt
 			}
-			c.liveMessages = c.liveMessages[1:]
 		}
 	}
-	if c.MessageLiveTime > 0 {
-		cutoff := time.Now().Add(-c.MessageLiveTime)
-		for len(c.liveMessages) > 0 && c.liveMessages[0].PostedAt.Before(cutoff) {
-			if c.liveMessages[0].MessageID != c.ConfMessageID {
-				toDelete = append(toDelete, c.liveMessages[0].MessageID)
-				if oldest == zero {
-					oldest = c.liveMessages[0].PostedAt
-				}
+	// Collect additional messages within 1.5sec of deleted message
+	if liveTime > 0 && c.Schedule == nil && c.Inactivity == 0 && oldest != zero {
+		cutoff := oldest.Add(1500 * time.Millisecond)
+		for i := 0; i < candidates && live[i].PostedAt.Before(cutoff); i++ {
+			if c.retentionFor(live[i], liveTime) == liveTime {
+				isDue[i] = true
 			}
-			c.liveMessages = c.liveMessages[1:]
 		}
-		// Collect additional messages within 1.5sec of deleted message
-		if oldest != zero {
-			cutoff = oldest.Add(1500 * time.Millisecond)
-			for len(c.liveMessages) > 0 && c.liveMessages[0].PostedAt.Before(cutoff) {
-				if c.liveMessages[0].MessageID != c.ConfMessageID {
-					toDelete = append(toDelete, c.liveMessages[0].MessageID)
-				}
-				c.liveMessages = c.liveMessages[1:]
+	}
+
+	for i, v := range live {
+		if i < candidates && isDue[i] {
+			if v.MessageID != c.ConfMessageID {
+				due = append(due, v)
 			}
+			continue
 		}
+		remaining = append(remaining, v)
 	}
-
-	return toDelete
+	return due, remaining
 }
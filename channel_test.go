@@ -0,0 +1,238 @@
+package autodelete_test
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+// Catching up after a reconnect notices pins and link previews that came in
+// while the bot wasn't listening.
+func TestCatchUpRechecksPinsAndEmbeds(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h", "embeds")
+	pinned := h.PostMessage(&discordgo.Message{ChannelID: ch, Content: "rules", Embeds: []*discordgo.MessageEmbed{{Title: "rules"}}})
+	link := h.Post(ch, "https://example.com")
+
+	h.Pin(ch, pinned)
+	h.Edit(ch, link, func(m *discordgo.Message) {
+		m.Embeds = []*discordgo.MessageEmbed{{URL: "https://example.com"}}
+	})
+	loads := h.Requests("GET", ch+"/messages")
+	h.Bot.LoadAllBacklogs()
+	h.WaitRequest("GET", ch+"/messages", loads+1)
+	time.Sleep(50 * time.Millisecond)
+
+	h.Advance(61 * time.Minute)
+	if got := h.WaitDeleted(1); !reflect.DeepEqual(got, []string{link}) {
+		t.Errorf("deleted %v, want only %v", got, link)
+	}
+}
+
+// Pinned messages stay when the others around them pass the deadline, unless
+// the channel is set to delete pins too.
+func TestPinnedMessagesKept(t *testing.T) {
+	for _, deletePins := range []bool{false, true} {
+		h := autodeletetest.New(t, autodelete.Config{})
+		ch := h.AddChannel("general")
+		args := []string{"1h"}
+		if deletePins {
+			args = append(args, "deletepins")
+		}
+		h.Set(ch, args...)
+		before := h.Post(ch, "before")
+		pinned := h.Post(ch, "pinned")
+		after := h.Post(ch, "after")
+		h.Pin(ch, pinned)
+		h.Bot.OnChannelPins(h.Session, &discordgo.ChannelPinsUpdate{ChannelID: ch, LastPinTimestamp: "now"})
+
+		h.Advance(61 * time.Minute)
+		want := []string{before, after}
+		if deletePins {
+			want = []string{before, pinned, after}
+		}
+		sort.Strings(want)
+		if got := h.WaitDeleted(len(want)); !reflect.DeepEqual(got, want) {
+			t.Errorf("deletepins %v: deleted %v, want %v", deletePins, got, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := h.Deleted(); len(got) != len(want) {
+			t.Errorf("deletepins %v: deleted %v, want %v", deletePins, got, want)
+		}
+	}
+}
+
+// A big reap is split into bulk deletes of at most BulkDeleteSize messages.
+func TestBulkDeleteChunks(t *testing.T) {
+	for _, tc := range []struct{ size, calls int }{{0, 3}, {50, 5}} {
+		h := autodeletetest.New(t, autodelete.Config{BulkDeleteSize: tc.size})
+		ch := h.AddChannel("general")
+		h.Set(ch, "1h")
+		for i := 0; i < 250; i++ {
+			h.Post(ch, "hello")
+		}
+		h.Advance(61 * time.Minute)
+		if got := h.WaitDeleted(250); len(got) != 250 {
+			t.Errorf("size %d: deleted %d messages, want 250", tc.size, len(got))
+		}
+		if n := h.Requests("POST", ch+"/messages/bulk_delete"); n != tc.calls {
+			t.Errorf("size %d: %d bulk deletes, want %d", tc.size, n, tc.calls)
+		}
+		if n := h.Requests("DELETE", ""); n != 0 {
+			t.Errorf("size %d: %d single deletes, want none", tc.size, n)
+		}
+	}
+}
+
+// A message that is already gone doesn't fail the rest of the batch, or send
+// the bot off to reload the channel.
+func TestReapSkipsMissingMessage(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h")
+	a := h.Post(ch, "a")
+	gone := h.Post(ch, "gone")
+	b := h.Post(ch, "b")
+	h.Vanish(ch, gone)
+	loads := h.Requests("GET", ch+"/messages")
+
+	h.Advance(61 * time.Minute)
+	want := []string{a, b}
+	sort.Strings(want)
+	if got := h.WaitDeleted(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted %v, want %v", got, want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := h.Requests("GET", ch+"/messages"); n != loads {
+		t.Errorf("reloaded the channel %d times after the reap, want none", n-loads)
+	}
+}
+
+// flakyClient is a DiscordClient whose first delete runs first instead, to
+// hang or panic. The channels it serves start out empty.
+type flakyClient struct {
+	mu      sync.Mutex
+	calls   int
+	deleted []string
+	first   func()
+}
+
+func (c *flakyClient) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error) {
+	return nil, nil
+}
+
+func (c *flakyClient) ChannelMessagesPinned(channelID string) ([]*discordgo.Message, error) {
+	return nil, nil
+}
+
+func (c *flakyClient) ChannelMessageDelete(channelID, messageID string) error {
+	return c.ChannelMessagesBulkDelete(channelID, []string{messageID})
+}
+
+func (c *flakyClient) ChannelMessagesBulkDelete(channelID string, messages []string) error {
+	c.mu.Lock()
+	c.calls++
+	first := c.calls == 1
+	c.mu.Unlock()
+	if first {
+		c.first()
+		return nil
+	}
+	c.mu.Lock()
+	c.deleted = append(c.deleted, messages...)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *flakyClient) MessageReactionsRemoveAll(channelID, messageID string) error {
+	return nil
+}
+
+func (c *flakyClient) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	return nil, errors.New("no members")
+}
+
+func (c *flakyClient) ChannelMessage(channelID, messageID string) (*discordgo.Message, error) {
+	return nil, errors.New("no messages")
+}
+
+func (c *flakyClient) ActiveThreads(guildID string) ([]autodelete.Thread, error) {
+	return nil, nil
+}
+
+func (c *flakyClient) ChannelDelete(channelID string) (*discordgo.Channel, error) {
+	return nil, errors.New("no channels")
+}
+
+func (c *flakyClient) ThreadArchive(threadID string) error {
+	return errors.New("no threads")
+}
+
+// A delete that never returns is given up on after ReapTimeout, and the only
+// worker goes on to retry the channel.
+func TestReapTimeoutRecovers(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	client := &flakyClient{first: func() { <-stuck }}
+	h := autodeletetest.New(t, autodelete.Config{
+		Client:      client,
+		Workers:     1,
+		ReapTimeout: 100 * time.Millisecond,
+	})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h")
+	want := []string{h.Post(ch, "a"), h.Post(ch, "b")}
+	sort.Strings(want)
+
+	h.Advance(61 * time.Minute)
+	client.waitDeleted(t, h, 0, want)
+}
+
+// waitDeleted waits for the client to have deleted want, moving the clock on
+// by step each time round.
+func (c *flakyClient) waitDeleted(t *testing.T, h *autodeletetest.Harness, step time.Duration, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		got := append([]string(nil), c.deleted...)
+		c.mu.Unlock()
+		sort.Strings(got)
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deleted %v, want %v", got, want)
+		}
+		h.Advance(step)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A reap that panics is put off and tried again, by the same worker.
+func TestReapPanicRecovers(t *testing.T) {
+	client := &flakyClient{first: func() { panic("bad message") }}
+	h := autodeletetest.New(t, autodelete.Config{Client: client, Workers: 1})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h")
+	want := []string{h.Post(ch, "a"), h.Post(ch, "b")}
+	sort.Strings(want)
+
+	h.Advance(61 * time.Minute)
+	client.waitDeleted(t, h, 10*time.Second, want)
+
+	other := h.AddChannel("other")
+	h.Set(other, "1h")
+	want = append(want, h.Post(other, "c"))
+	sort.Strings(want)
+	h.Advance(61 * time.Minute)
+	client.waitDeleted(t, h, 0, want)
+}
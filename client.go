@@ -0,0 +1,80 @@
+package autodelete
+
+import (
+	"encoding/json"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A DiscordClient is the part of the Discord API that reaping and loading a
+// channel's backlog need, including forum posts and threads. By default it
+// is the session; Config.Client swaps in something else, like another
+// library or a mock. Everything else, including commands and moving
+// messages, still goes through the session.
+type DiscordClient interface {
+	// Up to limit messages, newest first, before or after the given IDs
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error)
+	// For refreshing a message when its embeds change
+	ChannelMessage(channelID, messageID string) (*discordgo.Message, error)
+	ChannelMessagesPinned(channelID string) ([]*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string) error
+	// Between 2 and 100 messages, none older than two weeks
+	ChannelMessagesBulkDelete(channelID string, messages []string) error
+	MessageReactionsRemoveAll(channelID, messageID string) error
+	// For role-based retention
+	GuildMember(guildID, userID string) (*discordgo.Member, error)
+	// A guild's threads and forum posts that aren't archived
+	ActiveThreads(guildID string) ([]Thread, error)
+	// Deletes a channel; for a forum post, with all its messages
+	ChannelDelete(channelID string) (*discordgo.Channel, error)
+	ThreadArchive(threadID string) error
+}
+
+// A Thread is the part of a thread or forum post object the bot needs. The
+// vendored discordgo has no type for them.
+type Thread struct {
+	ID       string                `json:"id"`
+	Type     discordgo.ChannelType `json:"type"`
+	ParentID string                `json:"parent_id"`
+	Flags    int                   `json:"flags"`
+	Metadata struct {
+		Archived bool `json:"archived"`
+	} `json:"thread_metadata"`
+}
+
+// sessionClient is the default DiscordClient. Members come from the state
+// cache when they are in it.
+type sessionClient struct {
+	*discordgo.Session
+}
+
+func (s sessionClient) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	if s.State != nil {
+		if member, err := s.State.Member(guildID, userID); err == nil {
+			return member, nil
+		}
+	}
+	return s.Session.GuildMember(guildID, userID)
+}
+
+// ActiveThreads is a raw request, as API v6 has no thread calls.
+func (s sessionClient) ActiveThreads(guildID string) ([]Thread, error) {
+	endpoint := endpointActiveThreads(guildID)
+	body, err := s.RequestWithBucketID("GET", endpoint, nil, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Threads []Thread `json:"threads"`
+	}
+	err = json.Unmarshal(body, &resp)
+	return resp.Threads, err
+}
+
+// ThreadArchive is a raw request, as the vendored discordgo can't set thread
+// fields.
+func (s sessionClient) ThreadArchive(threadID string) error {
+	endpoint := discordgo.EndpointChannel(threadID)
+	_, err := s.RequestWithBucketID("PATCH", endpoint, map[string]bool{"archived": true}, endpoint)
+	return err
+}
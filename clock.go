@@ -0,0 +1,31 @@
+package autodelete
+
+import "time"
+
+// A Clock tells the reap queue what time it is and wakes it up later. The
+// real one wraps the time package; tests can swap in a fake that advances
+// time instantly.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has passed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a pending AfterFunc call.
+type Timer interface {
+	// Stop prevents the call from happening. It returns false if the call
+	// already happened or the timer was already stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// now returns the current time according to the reap queue's clock.
+func (b *Bot) now() time.Time {
+	return b.reaper.clock.Now()
+}
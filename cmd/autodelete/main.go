@@ -2,13 +2,33 @@ package main
 
 import "fmt"
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/riking/AutoDelete"
 	"gopkg.in/yaml.v2"
 )
 
+// Exit codes after a drain, so a migration script can tell whether it is
+// safe to go ahead.
+const (
+	exitDrained      = 3
+	exitDrainTimeout = 4
+)
+
+func exitAfterDrain(err error) {
+	if err != nil {
+		fmt.Println("drain error:", err)
+		os.Exit(exitDrainTimeout)
+	}
+	os.Exit(exitDrained)
+}
+
 func main() {
 	var conf autodelete.Config
 
@@ -27,6 +47,7 @@ func main() {
 	}
 
 	b := autodelete.New(conf)
+	b.OnDrained = exitAfterDrain
 
 	err = b.ConnectDiscord()
 	if err != nil {
@@ -34,9 +55,59 @@ func main() {
 		return
 	}
 
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			fmt.Println("reloading channel configs...")
+			if _, err := b.Reload(); err != nil {
+				fmt.Println("reload error:", err)
+			}
+		}
+	}()
+
+	go func() {
+		// SIGUSR1 drains: finish what's in flight, start nothing new, exit
+		// with exitDrained.
+		drainCh := make(chan os.Signal, 1)
+		signal.Notify(drainCh, syscall.SIGUSR1)
+		<-drainCh
+		fmt.Println("draining...")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		exitAfterDrain(b.Drain(ctx, func(n int) {
+			fmt.Println(n, "reaps in flight, waiting...")
+		}))
+	}()
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		<-sigCh
+		fmt.Println("shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := b.Shutdown(ctx); err != nil {
+			fmt.Println("shutdown error:", err)
+		}
+		os.Exit(0)
+	}()
+
 	fmt.Printf("url: %s%s\n", conf.HTTP.Public, "/discord_auto_delete/oauth/start")
 	http.HandleFunc("/discord_auto_delete/oauth/start", b.HTTPOAuthStart)
 	http.HandleFunc("/discord_auto_delete/oauth/callback", b.HTTPOAuthCallback)
+	http.Handle("/healthz", b.HealthHandler())
+	// expvar serves /debug/vars on the default mux
+	b.PublishExpvar()
+	if conf.Metrics {
+		http.Handle("/metrics", b.MetricsHandler())
+	}
+	if conf.EventsToken != "" {
+		http.Handle("/events", b.EventsHandler())
+	}
+	if conf.AdminToken != "" {
+		http.Handle("/admin/config", b.ConfigHandler())
+	}
 	err = http.ListenAndServe(conf.HTTP.Listen, nil)
 	fmt.Println("exiting main()", err)
 }
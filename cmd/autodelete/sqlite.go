@@ -0,0 +1,8 @@
+//go:build sqlite
+
+package main
+
+// Build with -tags sqlite to link the SQLite driver, then set
+// db: {driver: sqlite3, url: "data/autodelete.db"} in config.yml.
+// The driver is not vendored; fetch github.com/mattn/go-sqlite3 first.
+import _ "github.com/mattn/go-sqlite3"
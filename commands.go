@@ -1,7 +1,12 @@
 package autodelete
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,12 +17,75 @@ import (
 const textHelp = `Commands:
   @AutoDelete set [duration: 30m] [count: 10] - starts this channel for message auto-deletion
       Duration or message count can be specified as ` + "`-`" + ` to not use that, but at least one must be specified. Use "set 0 0" to disable the bot.
+      With both, messages go at whichever limit comes first; add ` + "`mode:both`" + ` to only delete messages past both limits.
+      Add ` + "`files:7d`" + ` to keep messages with attachments for a different time.
+      Add ` + "`short:10:1h`" + ` to keep messages under 10 characters, like "ok", for a different time. Messages with attachments never count as short.
+      Add ` + "`role:@Role:30d`" + ` to keep messages from members with that role for a different time.
+      Add ` + "`keep:N`" + ` to always keep the newest N messages, no matter how old they are, or ` + "`keepnewest`" + ` to keep just the newest one.
+      Pinned messages are never deleted unless you add ` + "`deletepins`" + `.
+      The first time a channel is set up, a notice explaining the settings is pinned; add ` + "`nonotice`" + ` to skip it.
+      Add ` + "`trigger:EMOJI triggercount:N`" + ` to delete a message as soon as it gets N of that reaction.
+      Use ` + "`set announce`" + ` to have each new message replace the previous one.
+      Add ` + "`minage:10m`" + ` to never delete messages younger than that, even if over the count.
+      Add ` + "`keepbots`" + ` to keep bot and webhook messages, and ` + "`keepuser:@user`" + ` to keep a user's messages.
+      AutoDelete's own replies are kept unless you add ` + "`deleteown`" + `.
+      Add ` + "`threads`" + ` to give the channel's active threads the same settings, unless they have their own. Archived threads are left alone.
+      Use ` + "`set schedule:0 4 * * * tz:Europe/Berlin`" + ` to delete messages at fixed times, given as a cron expression.
+      Use ` + "`set inactive:24h`" + ` to clear the channel out once nobody has posted for that long; ` + "`keep:N`" + ` still keeps the newest N.
+      Add ` + "`quiet:22:00-06:00`" + ` to never delete during those hours, in the ` + "`tz:`" + ` time zone or UTC.
+      Add ` + "`from:now`" + ` or ` + "`from:2024-01-31`" + ` to leave older history alone and only delete messages posted since.
+      Add ` + "`moveto:#channel`" + ` to re-post messages in another channel before deleting them.
+      Add ` + "`links`" + ` or ` + "`embeds`" + ` to only delete messages with links or embeds.
+      Add ` + "`action:clearreactions`" + ` to clear the reactions from messages when they are due, instead of deleting them.
+      Add ` + "`system:keep`" + ` to keep join, boost and pin notices, or ` + "`system:delete`" + ` to delete them even if the other filters would keep them.
+      Add ` + "`match:PATTERN`" + ` at the end to only delete messages matching that regular expression.
+      Use ` + "`set default`" + ` to follow the server default instead.
+  @AutoDelete retention [duration: 3d12h] - changes how long messages are kept, without touching other settings
+  @AutoDelete config [retention=1d] [max=100] [keep=50] [minage=10m] - changes several limits at once, only if they all fit together
+  @AutoDelete setdefault [duration] [count] - sets the server default for channels using ` + "`set default`" + `
+  @AutoDelete category [off] - copies this channel's settings to the channels in its category that have none of their own, including new ones; ` + "`off`" + ` stops them all
+  @AutoDelete copyconfig [#from] [#to] - copies one channel's settings to another
+  @AutoDelete forum [#forum] [duration] [count] [keep:N] [action:archive] - removes old posts from a forum; ` + "`off`" + ` stops it
+      Posts are deleted, along with every message in them, unless you add ` + "`action:archive`" + ` to only archive them, which anyone can undo by posting in them.
+  @AutoDelete channels [page] - lists the channels in this server that AutoDelete is set up in
+  @AutoDelete check - checks that AutoDelete has the permissions it needs in this channel
+  @AutoDelete status - shows this channel's settings and when messages will next be deleted
+  @AutoDelete stats - shows how many messages have been deleted from this channel
+  @AutoDelete ages - shows how old the messages waiting to be deleted are, to help pick a retention
+  @AutoDelete reapnow - deletes everything that is due in this channel right away
+  @AutoDelete preview [count] - DMs you the oldest messages that will be deleted next
+  @AutoDelete disable [duration: 2h] - stops deleting messages in this channel, keeping its settings, until ` + "`enable`" + ` or the time is up
+  @AutoDelete enable - turns AutoDelete back on after ` + "`disable`" + `, or after it was disabled for missing permissions
   @AutoDelete help - prints this help message
   @AutoDelete adminhelp [anything...] - forwards your request to the help server
 For more help, join the help server: <https://discord.gg/FUGn8yE>`
 
 const adminUserID = `82592645502734336`
 
+var daysWeeksRe = regexp.MustCompile(`(\d+(?:\.\d+)?)([dw])`)
+
+// parseDuration is time.ParseDuration with days (d) and weeks (w) added, as
+// in "3d12h" or "2w".
+func parseDuration(s string) (time.Duration, error) {
+	var convErr error
+	s = daysWeeksRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := daysWeeksRe.FindStringSubmatch(m)
+		n, err := strconv.ParseFloat(sub[1], 64)
+		if err != nil {
+			convErr = err
+			return m
+		}
+		if sub[2] == "w" {
+			n *= 7
+		}
+		return strconv.FormatFloat(n*24, 'f', -1, 64) + "h"
+	})
+	if convErr != nil {
+		return 0, convErr
+	}
+	return time.ParseDuration(s)
+}
+
 func (b *Bot) GetMsgChGuild(m *discordgo.Message) (*discordgo.Channel, *discordgo.Guild) {
 	ch, err := b.s.Channel(m.ChannelID)
 	if err != nil {
@@ -30,6 +98,29 @@ func (b *Bot) GetMsgChGuild(m *discordgo.Message) (*discordgo.Channel, *discordg
 	return ch, guild
 }
 
+// displayEmoji turns a stored emoji (unicode, or name:id) back into
+// something Discord will render.
+func displayEmoji(e string) string {
+	if strings.Contains(e, ":") {
+		return "<:" + e + ">"
+	}
+	return e
+}
+
+// roleName returns the name of a role in the channel's server, without
+// mentioning it, or the ID if it can't be found.
+func (b *Bot) roleName(channelID, roleID string) string {
+	ch, err := b.s.State.Channel(channelID)
+	if err != nil {
+		return roleID
+	}
+	role, err := b.s.State.Role(ch.GuildID, roleID)
+	if err != nil {
+		return roleID
+	}
+	return "@" + role.Name
+}
+
 func CommandHelp(b *Bot, m *discordgo.Message, rest []string) {
 	b.s.ChannelMessageSend(m.ChannelID, textHelp)
 }
@@ -77,6 +168,32 @@ func CommandAdminSay(b *Bot, m *discordgo.Message, rest []string) {
 func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 	var duration time.Duration
 	var count int
+	var keep int
+	var keepNewest bool
+	var deletePinned bool
+	var useDefault bool
+	var keepBots bool
+	var deleteOwn bool
+	var threads bool
+	var noNotice bool
+	var announcement bool
+	var minAge time.Duration
+	var inactivity time.Duration
+	var effectiveFrom time.Time
+	var triggerEmoji string
+	var triggerCount int
+	var keepUsers []string
+	var pattern string
+	var onlyLinks, onlyEmbeds bool
+	var systemMode SystemMode
+	var action ReapAction
+	var roleTimes map[string]time.Duration
+	var schedule, timezone, quiet string
+	var moveTo string
+	var mode PolicyMode
+	var filesDuration time.Duration
+	var shortLength int
+	var shortDuration time.Duration
 	var anySet bool
 
 	const perm = discordgo.PermissionManageMessages
@@ -91,8 +208,208 @@ func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 		return
 	}
 
-	for _, v := range rest {
-		d, err := time.ParseDuration(v)
+	skip := 0
+	for i, v := range rest {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if strings.HasPrefix(v, "schedule:") {
+			schedule = strings.TrimPrefix(v, "schedule:")
+			if !strings.HasPrefix(schedule, "@") {
+				// a cron expression is five words
+				skip = 4
+				if len(rest) < i+5 {
+					skip = len(rest) - i - 1
+				}
+				schedule = strings.Join(append([]string{schedule}, rest[i+1:i+1+skip]...), " ")
+			}
+			anySet = true
+			continue
+		}
+		if strings.HasPrefix(v, "quiet:") {
+			quiet = strings.TrimPrefix(v, "quiet:")
+			continue
+		}
+		if strings.HasPrefix(v, "tz:") {
+			timezone = strings.TrimPrefix(v, "tz:")
+			continue
+		}
+		if strings.HasPrefix(v, "match:") {
+			// the pattern may contain spaces, so it takes the rest of the line
+			pattern = strings.Join(append([]string{strings.TrimPrefix(v, "match:")}, rest[i+1:]...), " ")
+			break
+		}
+		if v == "deletepins" {
+			deletePinned = true
+			continue
+		}
+		if strings.HasPrefix(v, "files:") {
+			d, err := parseDuration(strings.TrimPrefix(v, "files:"))
+			if err == nil && d > 0 {
+				filesDuration = d
+			}
+			continue
+		}
+		if strings.HasPrefix(v, "short:") {
+			// short:10:1h keeps messages under 10 characters for 1h
+			arg := strings.TrimPrefix(v, "short:")
+			sep := strings.IndexByte(arg, ':')
+			if sep == -1 {
+				sep = len(arg)
+			}
+			n, err := strconv.ParseInt(arg[:sep], 10, 64)
+			var d time.Duration
+			if err == nil && sep < len(arg) {
+				d, err = parseDuration(arg[sep+1:])
+			}
+			if err != nil || n <= 0 || d <= 0 {
+				b.s.ChannelMessageSend(m.ChannelID, "Bad `short:` use something like `short:10:1h` to keep messages under 10 characters for 1h.")
+				return
+			}
+			shortLength, shortDuration = int(n), d
+			continue
+		}
+		if strings.HasPrefix(v, "mode:") {
+			mode = parsePolicyMode(strings.TrimPrefix(v, "mode:"))
+			continue
+		}
+		if strings.HasPrefix(v, "trigger:") {
+			// custom emoji come through as <:name:id>
+			e := strings.Trim(strings.TrimPrefix(v, "trigger:"), "<>")
+			e = strings.TrimPrefix(strings.TrimPrefix(e, "a:"), ":")
+			triggerEmoji = e
+			continue
+		}
+		if strings.HasPrefix(v, "triggercount:") {
+			n, err := strconv.ParseInt(strings.TrimPrefix(v, "triggercount:"), 10, 64)
+			if err == nil && n > 0 {
+				triggerCount = int(n)
+			}
+			continue
+		}
+		if strings.HasPrefix(v, "minage:") {
+			d, err := parseDuration(strings.TrimPrefix(v, "minage:"))
+			if err == nil && d >= 0 {
+				minAge = d
+			}
+			continue
+		}
+		if strings.HasPrefix(v, "inactive:") {
+			d, err := parseDuration(strings.TrimPrefix(v, "inactive:"))
+			if err != nil || d <= 0 {
+				b.s.ChannelMessageSend(m.ChannelID, "Bad `inactive:` duration, use something like `inactive:24h`.")
+				return
+			}
+			inactivity = d
+			anySet = true
+			continue
+		}
+		if v == "announce" {
+			announcement = true
+			anySet = true
+			continue
+		}
+		if v == "keepbots" {
+			keepBots = true
+			continue
+		}
+		if v == "deleteown" {
+			deleteOwn = true
+			continue
+		}
+		if v == "threads" {
+			threads = true
+			continue
+		}
+		if v == "nonotice" {
+			noNotice = true
+			continue
+		}
+		if strings.HasPrefix(v, "role:") {
+			// role:<@&id>:30d, or a bare role ID
+			arg := strings.TrimPrefix(v, "role:")
+			sep := strings.LastIndexByte(arg, ':')
+			if sep == -1 {
+				continue
+			}
+			id := strings.Trim(arg[:sep], "<@&>")
+			d, err := parseDuration(arg[sep+1:])
+			if id != "" && err == nil && d > 0 {
+				if roleTimes == nil {
+					roleTimes = make(map[string]time.Duration)
+				}
+				roleTimes[id] = d
+			}
+			continue
+		}
+		if strings.HasPrefix(v, "system:") {
+			systemMode = parseSystemMode(strings.TrimPrefix(v, "system:"))
+			continue
+		}
+		if strings.HasPrefix(v, "action:") {
+			switch a := strings.TrimPrefix(v, "action:"); a {
+			case "delete", "clearreactions":
+				action = parseReapAction(a)
+			default:
+				b.s.ChannelMessageSend(m.ChannelID, "Bad `action:` use `delete` or `clearreactions`.")
+				return
+			}
+			continue
+		}
+		if v == "links" {
+			onlyLinks = true
+			continue
+		}
+		if v == "embeds" {
+			onlyEmbeds = true
+			continue
+		}
+		if strings.HasPrefix(v, "keepuser:") {
+			id := strings.Trim(strings.TrimPrefix(v, "keepuser:"), "<@!>")
+			if id != "" {
+				keepUsers = append(keepUsers, id)
+			}
+			continue
+		}
+		if v == "default" {
+			useDefault = true
+			anySet = true
+			continue
+		}
+		if strings.HasPrefix(v, "moveto:") {
+			moveTo = strings.Trim(strings.TrimPrefix(v, "moveto:"), "<#>")
+			continue
+		}
+		if strings.HasPrefix(v, "from:") {
+			from := strings.TrimPrefix(v, "from:")
+			if from == "now" {
+				effectiveFrom = b.now()
+				continue
+			}
+			t, err := time.Parse("2006-01-02", from)
+			if err != nil {
+				t, err = time.Parse(time.RFC3339, from)
+			}
+			if err != nil {
+				b.s.ChannelMessageSend(m.ChannelID, "Bad `from:` date, use `now`, `2006-01-02` or `2006-01-02T15:04:05Z`.")
+				return
+			}
+			effectiveFrom = t
+			continue
+		}
+		if v == "keepnewest" {
+			keepNewest = true
+			continue
+		}
+		if strings.HasPrefix(v, "keep:") {
+			n, err := strconv.ParseInt(strings.TrimPrefix(v, "keep:"), 10, 64)
+			if err == nil && n >= 0 {
+				keep = int(n)
+			}
+			continue
+		}
+		d, err := parseDuration(v)
 		if err == nil {
 			duration = d
 			anySet = true
@@ -106,25 +423,174 @@ func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 		}
 	}
 	if !anySet {
-		b.s.ChannelMessageSend(m.ChannelID, "Bad format for `set` command. Provide a count (20) and/or a duration (90m) to purge messages after. Maximum unit is hours.")
+		b.s.ChannelMessageSend(m.ChannelID, "Bad format for `set` command. Provide a count (20) and/or a duration (90m, 3d12h, 2w) to purge messages after.")
+		return
+	}
+	if count > 0 && keep > count {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't keep %d messages when the channel is capped at %d.", keep, count))
 		return
 	}
 
+	var sched *cronSchedule
+	if schedule != "" {
+		sched, err = parseSchedule(schedule, timezone)
+		if err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, "Bad `schedule:` "+err.Error())
+			return
+		}
+	}
+	var quietWindow *quietHours
+	if quiet != "" {
+		quietWindow, err = parseQuiet(quiet, timezone)
+		if err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, "Bad `quiet:` "+err.Error())
+			return
+		}
+		quiet = quietWindow.String()
+	}
+
+	if moveTo != "" {
+		here, err := b.s.Channel(m.ChannelID)
+		if err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, "could not look up this channel: "+err.Error())
+			return
+		}
+		dest, err := b.s.Channel(moveTo)
+		if err != nil || dest.GuildID != here.GuildID || dest.ID == here.ID {
+			b.s.ChannelMessageSend(m.ChannelID, "Bad `moveto:` it must be another channel in this server.")
+			return
+		}
+	}
+
+	if pattern != "" {
+		if _, err := regexp.Compile(pattern); err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, "Bad `match:` pattern: "+err.Error())
+			return
+		}
+	}
+
 	_, err = b.s.ChannelMessagesPinned(m.ChannelID)
 	hasPins := err == nil
 
 	var confMessage *discordgo.Message
+	var confText string
 
-	if duration != 0 && count != 0 {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will be deleted after %s or %d messages, whichever comes first.", duration, count))
+	if inactivity != 0 && count != 0 {
+		confText = fmt.Sprintf("All messages in this channel will be deleted once nobody has posted for %s, or after %d messages.", inactivity, count)
+	} else if inactivity != 0 {
+		confText = fmt.Sprintf("All messages in this channel will be deleted once nobody has posted for %s.", inactivity)
+	} else if sched != nil && count != 0 {
+		confText = fmt.Sprintf("Messages in this channel will be deleted on the schedule `%s` (%s), or after %d messages.", sched, sched.loc, count)
+	} else if sched != nil {
+		confText = fmt.Sprintf("Messages in this channel will be deleted on the schedule `%s` (%s). Next run: %s.", sched, sched.loc, sched.Next(b.now()).Format(time.RFC1123))
+	} else if duration != 0 && count != 0 && mode == PolicyBoth {
+		confText = fmt.Sprintf("Messages in this channel will be deleted after %s, but the newest %d messages will always be kept.", duration, count)
+	} else if duration != 0 && count != 0 {
+		confText = fmt.Sprintf("Messages in this channel will be deleted after %s or %d messages, whichever comes first.", duration, count)
 	} else if duration != 0 {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will be deleted after %s.", duration))
-
+		confText = fmt.Sprintf("Messages in this channel will be deleted after %s.", duration)
 	} else if count != 0 {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will be deleted after %d other messages.", count))
+		confText = fmt.Sprintf("Messages in this channel will be deleted after %d other messages.", count)
+	} else if announcement {
+		confText = "Each new message in this channel will replace the previous one."
+	} else if useDefault {
+		confText = "Messages in this channel will be deleted according to the server default."
 	} else {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will not be auto-deleted."))
+		confText = fmt.Sprintf("Messages in this channel will not be auto-deleted.")
+	}
+	enabled := duration != 0 || count != 0 || useDefault || announcement || sched != nil || inactivity != 0
+
+	prev, prevErr := b.readChannelConfig(m.ChannelID)
+	// A channel being set up for the first time isn't reaped straight away;
+	// changing the settings again during the grace period doesn't reset it.
+	graceUntil := timeOrZero(prev.GraceUntil)
+	if !graceUntil.After(b.now()) {
+		graceUntil = time.Time{}
+	}
+	prevEnabled := prevErr == nil && (prev.LiveTime != 0 || prev.MaxMessages != 0 || prev.GuildDefault ||
+		prev.Announcement || prev.Schedule != "" || prev.Inactivity != 0)
+	if !enabled {
+		graceUntil = time.Time{}
+	} else if !prevEnabled {
+		if d := b.firstReapDelay(duration); d > 0 {
+			graceUntil = b.now().Add(d)
+		}
+	}
+
+	if keep != 0 && enabled {
+		confText += fmt.Sprintf(" The newest %d messages will always be kept.", keep)
+	} else if keepNewest && enabled {
+		confText += " The newest message will always be kept."
+	}
+	if deletePinned && enabled {
+		confText += " Pinned messages will also be deleted."
+	}
+	if triggerEmoji != "" && triggerCount == 0 {
+		triggerCount = 1
+	}
+	if triggerEmoji != "" {
+		confText += fmt.Sprintf(" Messages with %d %s reactions will be deleted immediately.", triggerCount, displayEmoji(triggerEmoji))
+	}
+	if filesDuration != 0 && enabled {
+		confText += fmt.Sprintf(" Messages with attachments will be kept for %s instead.", filesDuration)
+	}
+	if shortLength != 0 && enabled {
+		confText += fmt.Sprintf(" Messages under %d characters will be kept for %s instead.", shortLength, shortDuration)
+	}
+	if len(roleTimes) != 0 && enabled {
+		var parts []string
+		for id, d := range roleTimes {
+			parts = append(parts, fmt.Sprintf("%s for %s", b.roleName(m.ChannelID, id), d))
+		}
+		sort.Strings(parts)
+		confText += " Messages from members with these roles will be kept for a different time: " + strings.Join(parts, ", ") + "."
+	}
+	if minAge != 0 && enabled {
+		confText += fmt.Sprintf(" Messages younger than %s will never be deleted.", minAge)
+	}
+	if !effectiveFrom.IsZero() && enabled {
+		confText += fmt.Sprintf(" Messages posted before <t:%d:f> will be left alone.", effectiveFrom.Unix())
+	}
+	if moveTo != "" && enabled {
+		confText += fmt.Sprintf(" Messages will be moved to <#%s> before they are deleted; AutoDelete needs the Manage Webhooks permission there.", moveTo)
+	}
+	if quietWindow != nil && enabled {
+		confText += fmt.Sprintf(" Nothing will be deleted between %s (%s); messages due then will go once it's over.", quietWindow, quietWindow.loc)
+	}
+	if keepBots && enabled {
+		confText += " Messages from bots and webhooks will be kept."
+	}
+	if deleteOwn && enabled && !keepBots {
+		confText += " AutoDelete's own replies will be deleted too."
+	}
+	if len(keepUsers) > 0 && enabled {
+		confText += fmt.Sprintf(" Messages from %d exempt users will be kept.", len(keepUsers))
+	}
+	if pattern != "" && enabled {
+		confText += fmt.Sprintf(" Only messages matching `%s` will be deleted.", pattern)
+	}
+	if action == ActionClearReactions && enabled {
+		confText += " Instead of being deleted, messages will only have their reactions cleared."
+	}
+	if systemMode == SystemKeep && enabled {
+		confText += " System messages like joins and pin notices will be kept."
+	} else if systemMode == SystemDelete && enabled {
+		confText += " System messages like joins and pin notices will always be deleted."
+	}
+	if onlyLinks && onlyEmbeds && enabled {
+		confText += " Only messages with links or embeds will be deleted."
+	} else if onlyLinks && enabled {
+		confText += " Only messages with links will be deleted."
+	} else if onlyEmbeds && enabled {
+		confText += " Only messages with embeds will be deleted."
+	}
+	if threads && enabled {
+		confText += " Its active threads will get the same settings, unless they have their own."
+	}
+	if !graceUntil.IsZero() {
+		confText += fmt.Sprintf(" Nothing will be deleted before <t:%d:f>, so there's time to adjust these settings.", graceUntil.Unix())
 	}
+	confMessage, err = b.s.ChannelMessageSend(m.ChannelID, confText)
 
 	if err != nil {
 		fmt.Println("Error sending config message:", err)
@@ -132,13 +598,57 @@ func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 		return
 	}
 
+	// The notice is only posted once per channel, however often it is
+	// set up again.
+	noticeID, noticePosted := prev.NoticeMessageID, prev.NoticePosted
+	if enabled && !noticePosted {
+		if noNotice || b.Config.DisableNotice {
+			noticePosted = true
+		} else if msg, err := b.postNotice(m.ChannelID, confText); err != nil {
+			fmt.Println("Error posting notice:", err)
+		} else {
+			noticeID, noticePosted = msg.ID, true
+		}
+	}
+
 	newManagedChannel := managedChannelMarshal{
-		ID:            m.ChannelID,
-		ConfMessageID: confMessage.ID,
-		LiveTime:      duration,
-		MaxMessages:   count,
-		HasPins:       hasPins,
-		IsDonor:       false, // TODO
+		ID:                 m.ChannelID,
+		ConfMessageID:      confMessage.ID,
+		NoticeMessageID:    noticeID,
+		NoticePosted:       noticePosted,
+		LiveTime:           duration,
+		MaxMessages:        count,
+		PolicyMode:         mode.String(),
+		AttachmentLiveTime: filesDuration,
+		ShortLength:        shortLength,
+		ShortLiveTime:      shortDuration,
+		KeepMessages:       keep,
+		KeepNewest:         keepNewest,
+		GuildDefault:       useDefault,
+		HasPins:            hasPins,
+		DeletePinned:       deletePinned,
+		KeepUsers:          keepUsers,
+		KeepBots:           keepBots,
+		DeleteOwn:          deleteOwn,
+		Threads:            threads,
+		MoveTo:             moveTo,
+		ContentPattern:     pattern,
+		OnlyWithLinks:      onlyLinks,
+		OnlyWithEmbeds:     onlyEmbeds,
+		SystemMessages:     systemMode.String(),
+		Action:             action.String(),
+		RoleLiveTimes:      roleTimes,
+		Schedule:           schedule,
+		QuietHours:         quiet,
+		Timezone:           timezone,
+		MinAge:             minAge,
+		Inactivity:         inactivity,
+		EffectiveFrom:      timePtr(effectiveFrom),
+		GraceUntil:         timePtr(graceUntil),
+		Announcement:       announcement,
+		TriggerEmoji:       triggerEmoji,
+		TriggerCount:       triggerCount,
+		IsDonor:            false, // TODO
 	}
 
 	err = b.setChannelConfig(newManagedChannel)
@@ -149,44 +659,1084 @@ func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 	fmt.Println("[load] Changed settings for channel", m.ChannelID, confMessage.Content)
 }
 
-func CommandLeave(b *Bot, m *discordgo.Message, rest []string) {
-	var guildID string
+// postNotice sends and pins the first-time notice for a channel. A failure to
+// pin is logged but still returns the message.
+func (b *Bot) postNotice(channelID, policy string) (*discordgo.Message, error) {
+	text := strings.NewReplacer(
+		"{policy}", policy,
+		"{channel}", "<#"+channelID+">",
+	).Replace(b.noticeTemplate())
+	msg, err := b.s.ChannelMessageSend(channelID, text)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.s.ChannelMessagePin(channelID, msg.ID); err != nil {
+		fmt.Println("Error pinning notice in", channelID, err)
+	}
+	return msg, nil
+}
 
-	if len(rest) == 0 {
-		channel, err := b.s.Channel(m.ChannelID)
+func CommandSetDefault(b *Bot, m *discordgo.Message, rest []string) {
+	var duration time.Duration
+	var count int
+
+	channel, err := b.s.Channel(m.ChannelID)
+	if err != nil {
+		return
+	}
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageServer == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Server permission to change the server default.")
+		return
+	}
+
+	for _, v := range rest {
+		d, err := parseDuration(v)
+		if err == nil {
+			duration = d
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			count = int(n)
+			continue
+		}
+	}
+
+	g, _ := b.guildDefault(channel.GuildID)
+	g.ID = channel.GuildID
+	g.LiveTime = duration
+	g.MaxMessages = count
+	err = b.setGuildDefault(g)
+	if err != nil {
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings were not changed.\n"+err.Error())
+		return
+	}
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
+		"Server default set to %s / %d messages. Channels set up with `set default` will use it.", duration, count))
+}
+
+func CommandCategory(b *Bot, m *discordgo.Message, rest []string) {
+	channel, err := b.s.Channel(m.ChannelID)
+	if err != nil {
+		return
+	}
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageServer == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Server permission to change category settings.")
+		return
+	}
+	parent, err := b.parentCategory(m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "Could not look up this channel's category: "+err.Error())
+		return
+	}
+	if parent == "" {
+		b.s.ChannelMessageSend(m.ChannelID, "This channel isn't in a category.")
+		return
+	}
+
+	if len(rest) > 0 && rest[0] == "off" {
+		n, err := b.removeCategoryConfig(channel.GuildID, parent)
 		if err != nil {
-			fmt.Println("[cmdE] channel does not exist", m.ChannelID)
+			fmt.Println("Error:", err)
+			b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
 			return
 		}
-		guildID = channel.GuildID
-		apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
-		perm := discordgo.PermissionManageServer
-		if apermissions&perm != perm {
-			b.s.ChannelMessageSend(m.ChannelID, "Leaving the current server requires MANAGE_SERVER permission.")
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Removed the category settings. Stopped AutoDelete in %d channels that were using them.", n))
+		return
+	}
+
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not set up in this channel. Use `@AutoDelete set` here first, then run this again to copy the settings to the category.")
+		return
+	}
+	n, err := b.setCategoryConfig(channel.GuildID, parent, mCh.Export())
+	if err != nil {
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
+		return
+	}
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
+		"Channels in this category will now use this channel's settings, unless they have their own. Applied to %d channels.", n))
+}
+
+func CommandCopyConfig(b *Bot, m *discordgo.Message, rest []string) {
+	if len(rest) < 2 {
+		b.s.ChannelMessageSend(m.ChannelID, "Name the channel to copy from and the one to copy to, like `copyconfig #old #new`.")
+		return
+	}
+	srcID := strings.Trim(rest[0], "<#>")
+	destID := strings.Trim(rest[1], "<#>")
+	if srcID == destID {
+		b.s.ChannelMessageSend(m.ChannelID, "Those are the same channel.")
+		return
+	}
+	for _, id := range []string{srcID, destID} {
+		if _, err := b.s.Channel(id); err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Could not find channel <#%s>: %v", id, err))
+			return
 		}
-	} else {
-		if m.Author.ID != adminUserID {
-			b.s.ChannelMessageSend(m.ChannelID, "Leaving other servers can only be done by the bot controller.")
+		apermissions, err := b.s.UserChannelPermissions(m.Author.ID, id)
+		if err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+			return
+		}
+		if apermissions&discordgo.PermissionManageMessages == 0 {
+			b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("You must have the Manage Messages permission in <#%s> to copy AutoDelete settings.", id))
 			return
 		}
-		guildID = rest[0]
 	}
 
-	msg := fmt.Sprintf("Leaving guild ID %s", guildID)
-	b.s.ChannelMessageSend(m.ChannelID, msg)
-	fmt.Println("[leav]", msg)
-	err := b.s.GuildLeave(guildID)
+	b.mu.RLock()
+	src := b.channels[srcID]
+	b.mu.RUnlock()
+	if src == nil {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("AutoDelete is not set up in <#%s>.", srcID))
+		return
+	}
+
+	conf := channelTemplate(src.Export())
+	conf.ID = destID
+	// Keep the destination's own notice, if it has one
+	if prev, err := b.readChannelConfig(destID); err == nil {
+		conf.NoticeMessageID, conf.NoticePosted = prev.NoticeMessageID, prev.NoticePosted
+	}
+	_, err := b.s.ChannelMessagesPinned(destID)
+	conf.HasPins = err == nil
+	err = b.setChannelConfig(conf)
 	if err != nil {
-		fmt.Println("[cmdE] error leaving:", err)
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
+		return
+	}
+
+	b.mu.RLock()
+	dest := b.channels[destID]
+	b.mu.RUnlock()
+	if dest == nil {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Copied the settings to <#%s>.", destID))
+		return
+	}
+	dest.mu.Lock()
+	policy := dest.describePolicy()
+	dest.mu.Unlock()
+	fmt.Println("[load] Copied settings from", srcID, "to", destID)
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Copied the settings from <#%s>. Messages in <#%s> are now deleted %s.", srcID, destID, policy))
+}
+
+// CommandForum sets up a forum channel, which can't take commands itself.
+// It takes the same duration, count and keep options as set, applied to the
+// forum's posts, plus action:archive to archive due posts instead of
+// deleting them.
+func CommandForum(b *Bot, m *discordgo.Message, rest []string) {
+	if len(rest) < 2 {
+		b.s.ChannelMessageSend(m.ChannelID, "Name the forum and the settings for its posts, like `forum #forum 30d keep:10`, or `forum #forum off`.")
+		return
+	}
+	forumID := strings.Trim(rest[0], "<#>")
+	here, err := b.s.Channel(m.ChannelID)
+	if err != nil {
+		return
+	}
+	forum, err := b.s.Channel(forumID)
+	if err != nil || forum.Type != channelTypeGuildForum || forum.GuildID != here.GuildID {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("<#%s> is not a forum in this server.", forumID))
+		return
+	}
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, forumID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageMessages == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("You must have the Manage Messages permission in <#%s> to change AutoDelete settings.", forumID))
+		return
+	}
+
+	if rest[1] == "off" {
+		b.deleteChannelConfig(forumID)
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("AutoDelete will leave the posts in <#%s> alone.", forumID))
+		return
+	}
+
+	var duration, minAge time.Duration
+	var count, keep int
+	var keepNewest, deletePinned bool
+	var action ReapAction
+	for _, v := range rest[1:] {
+		switch {
+		case v == "keepnewest":
+			keepNewest = true
+		case v == "deletepins":
+			deletePinned = true
+		case strings.HasPrefix(v, "keep:"):
+			n, err := strconv.ParseInt(strings.TrimPrefix(v, "keep:"), 10, 64)
+			if err == nil && n >= 0 {
+				keep = int(n)
+			}
+		case strings.HasPrefix(v, "minage:"):
+			d, err := parseDuration(strings.TrimPrefix(v, "minage:"))
+			if err == nil && d >= 0 {
+				minAge = d
+			}
+		case strings.HasPrefix(v, "action:"):
+			switch a := strings.TrimPrefix(v, "action:"); a {
+			case "delete", "archive":
+				action = parseReapAction(a)
+			default:
+				b.s.ChannelMessageSend(m.ChannelID, "Bad `action:` use `delete` or `archive`.")
+				return
+			}
+		default:
+			if d, err := parseDuration(v); err == nil {
+				duration = d
+			} else if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				count = int(n)
+			}
+		}
+	}
+	if duration == 0 && count == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "Provide a count (20) and/or a duration (30d, 2w) to remove posts after, or `off`.")
+		return
+	}
+	if count > 0 && keep > count {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't keep %d posts when the forum is capped at %d.", keep, count))
+		return
+	}
+
+	conf := managedChannelMarshal{
+		ID:           forumID,
+		LiveTime:     duration,
+		MaxMessages:  count,
+		KeepMessages: keep,
+		KeepNewest:   keepNewest,
+		MinAge:       minAge,
+		DeletePinned: deletePinned,
+		Action:       action.String(),
+	}
+	// As with set, a forum being set up for the first time isn't reaped
+	// straight away
+	prev, err := b.readChannelConfig(forumID)
+	if err == nil {
+		conf.GraceUntil = prev.GraceUntil
+	} else if d := b.firstReapDelay(duration); d > 0 {
+		conf.GraceUntil = timePtr(b.now().Add(d))
+	}
+	err = b.setChannelConfig(conf)
+	if err != nil {
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
+		return
+	}
+
+	b.mu.RLock()
+	mCh := b.channels[forumID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Saved the settings for <#%s>.", forumID))
+		return
+	}
+	mCh.mu.Lock()
+	policy := mCh.describePolicy()
+	mCh.mu.Unlock()
+	fmt.Println("[load] Changed settings for forum", forumID, policy)
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Posts in <#%s> will be removed %s.", forumID, policy))
+}
+
+func CommandLeave(b *Bot, m *discordgo.Message, rest []string) {
+	var guildID string
+
+	if len(rest) == 0 {
+		channel, err := b.s.Channel(m.ChannelID)
+		if err != nil {
+			fmt.Println("[cmdE] channel does not exist", m.ChannelID)
+			return
+		}
+		guildID = channel.GuildID
+		apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+		perm := discordgo.PermissionManageServer
+		if apermissions&perm != perm {
+			b.s.ChannelMessageSend(m.ChannelID, "Leaving the current server requires MANAGE_SERVER permission.")
+		}
+	} else {
+		if m.Author.ID != adminUserID {
+			b.s.ChannelMessageSend(m.ChannelID, "Leaving other servers can only be done by the bot controller.")
+			return
+		}
+		guildID = rest[0]
+	}
+
+	msg := fmt.Sprintf("Leaving guild ID %s", guildID)
+	b.s.ChannelMessageSend(m.ChannelID, msg)
+	fmt.Println("[leav]", msg)
+	err := b.s.GuildLeave(guildID)
+	if err != nil {
+		fmt.Println("[cmdE] error leaving:", err)
+	}
+}
+
+// A permission AutoDelete needs in a managed channel, and what to tell the
+// admin if it's missing.
+type requiredPermission struct {
+	perm int
+	name string
+	hint string
+}
+
+// The permissions whose absence makes handleCriticalPermissionsErrors
+// disable a channel, plus Send Messages for replies.
+var requiredPermissions = []requiredPermission{
+	{discordgo.PermissionReadMessages, "View Channel", "without it AutoDelete can't see the channel at all"},
+	{discordgo.PermissionReadMessageHistory, "Read Message History", "needed to find the messages that were posted while it was offline"},
+	{discordgo.PermissionManageMessages, "Manage Messages", "needed to delete other people's messages"},
+	{discordgo.PermissionSendMessages, "Send Messages", "needed to reply to commands and report problems"},
+}
+
+func CommandCheck(b *Bot, m *discordgo.Message, rest []string) {
+	perms, err := b.s.UserChannelPermissions(b.me.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "Could not check AutoDelete's permissions: "+err.Error())
+		return
+	}
+	var missing []string
+	for _, v := range requiredPermissions {
+		if perms&v.perm != v.perm {
+			missing = append(missing, fmt.Sprintf("- **%s**: %s", v.name, v.hint))
+		}
+	}
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh != nil {
+		if target := mCh.moveTarget(); target != "" {
+			movePerms, err := b.s.UserChannelPermissions(b.me.ID, target)
+			if err == nil && movePerms&discordgo.PermissionManageWebhooks == 0 {
+				missing = append(missing, fmt.Sprintf("- **Manage Webhooks** in <#%s>: needed to move messages there", target))
+			}
+		}
+	}
+	if len(missing) == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "PASS: AutoDelete has every permission it needs in this channel.")
+		return
+	}
+	msg := "FAIL: AutoDelete is missing these permissions:\n" + strings.Join(missing, "\n") +
+		"\nGrant them to the AutoDelete role in the channel or server settings, then run `@AutoDelete check` again."
+	_, err = b.s.ChannelMessageSend(m.ChannelID, msg)
+	if err != nil {
+		fmt.Println("[cmdE] could not send permission check to", m.ChannelID, err)
+	}
+}
+
+func CommandStatus(b *Bot, m *discordgo.Message, rest []string) {
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		if conf, err := b.readChannelConfig(m.ChannelID); err == nil && conf.Disabled {
+			msg := fmt.Sprintf("AutoDelete is disabled in this channel (%s).", conf.DisabledReason)
+			if conf.DisabledUntil != nil {
+				msg += fmt.Sprintf(" It turns back on <t:%d:R>.", conf.DisabledUntil.Unix())
+			}
+			b.s.ChannelMessageSend(m.ChannelID, msg)
+			return
+		}
+	}
+	if mCh == nil || !mCh.Enabled() {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not enabled in this channel.")
+		return
+	}
+
+	mCh.mu.Lock()
+	policy := mCh.describePolicy()
+	tracked := len(mCh.liveMessages)
+	mCh.mu.Unlock()
+
+	var next string
+	if lost, ok := b.reaper.waitingForGateway(); ok {
+		next = fmt.Sprintf("Deletions are on hold until the connection to Discord comes back; it dropped <t:%d:R>.", lost.Unix())
+	} else if b.reaper.isReaping(mCh) {
+		next = "Messages are being deleted right now."
+	} else if st := mCh.Stats(); st.BackoffUntil.After(b.now()) {
+		next = fmt.Sprintf("Deleting failed %d times in a row, so the next try is held off until <t:%d:R>.", st.ConsecutiveFailures, st.BackoffUntil.Unix())
+	} else {
+		next = fmt.Sprintf("Next deletion: <t:%d:R>.", mCh.GetNextDeletionTime().Unix())
+	}
+	inFlight := b.reaper.guildInFlight(mCh.Channel.GuildID)
+	msg := fmt.Sprintf(
+		"Messages in this channel are deleted %s.\nTracking %d messages. %s\nChannels in this server being cleaned up right now: %d.",
+		policy, tracked, next, inFlight)
+	if b.budget != nil {
+		used, limit, reset := b.budget.usage(b.now())
+		msg += fmt.Sprintf("\nBot-wide deletion budget: %d of %d used, resets <t:%d:R>.", used, limit, reset.Unix())
+	}
+	b.s.ChannelMessageSend(m.ChannelID, msg)
+}
+
+func CommandStats(b *Bot, m *discordgo.Message, rest []string) {
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not enabled in this channel.")
+		return
+	}
+
+	st := mCh.Stats()
+	lastReap := "never"
+	if !st.LastReap.IsZero() {
+		lastReap = fmt.Sprintf("<t:%d:R>", st.LastReap.Unix())
+	}
+	lastErr := "none"
+	if st.LastError != nil {
+		lastErr = st.LastError.Error()
+	}
+	if st.ConsecutiveFailures > 0 {
+		lastErr += fmt.Sprintf(" (%d failures in a row)", st.ConsecutiveFailures)
+	}
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
+		"Since the bot started: %d messages deleted, last run %s, %d rate limit retries.\nLast error: %s",
+		st.Deleted, lastReap, st.RateLimitRetries, lastErr))
+}
+
+func CommandAges(b *Bot, m *discordgo.Message, rest []string) {
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not enabled in this channel.")
+		return
+	}
+
+	counts := mCh.AgeHistogram()
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	labels := []string{"under 1 hour", "1 to 6 hours", "6 to 24 hours", "1 to 7 days", "over 7 days"}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Ages of the %d messages being tracked:", total)
+	for i, n := range counts {
+		fmt.Fprintf(&sb, "\n%s: %d", labels[i], n)
+	}
+	b.s.ChannelMessageSend(m.ChannelID, sb.String())
+}
+
+func CommandReapNow(b *Bot, m *discordgo.Message, rest []string) {
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageMessages == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to force a cleanup.")
+		return
+	}
+
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not enabled in this channel.")
+		return
+	}
+
+	count, err := b.reapNow(mCh)
+	if err == ErrReapInProgress {
+		b.s.ChannelMessageSend(m.ChannelID, "Messages are already being deleted from this channel.")
+		return
+	} else if err == ErrBudgetExhausted {
+		_, _, reset := b.budget.usage(b.now())
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("AutoDelete has used up its deletion budget for now. It resets <t:%d:R>.", reset.Unix()))
+		return
+	} else if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Deleted %d messages, then got an error: %v", count, err))
+		return
+	}
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Deleted %d messages.", count))
+}
+
+// Channels per page of the channels command, to stay under Discord's message
+// length limit.
+const channelsPerPage = 15
+
+// CommandChannels lists every channel in the server AutoDelete knows about.
+func CommandChannels(b *Bot, m *discordgo.Message, rest []string) {
+	channel, err := b.s.Channel(m.ChannelID)
+	if err != nil {
+		return
+	}
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageServer == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Server permission to list this server's channels.")
+		return
+	}
+	page := 1
+	if len(rest) > 0 {
+		if n, err := strconv.Atoi(rest[0]); err == nil && n > 0 {
+			page = n
+		}
+	}
+
+	next := make(map[string]time.Time)
+	for _, v := range b.QueueSnapshot() {
+		next[v.ChannelID] = v.NextReap
+	}
+
+	type row struct {
+		name, line string
+	}
+	var rows []row
+	var maybeDisabled []string
+	b.mu.RLock()
+	for id, mCh := range b.channels {
+		if mCh == nil {
+			maybeDisabled = append(maybeDisabled, id)
+			continue
+		}
+		if mCh.Channel.GuildID != channel.GuildID {
+			continue
+		}
+		mCh.mu.Lock()
+		liveTime, maxMessages, _ := mCh.effectivePolicy()
+		mode := mCh.PolicyMode
+		name := mCh.Channel.Name
+		enabled := liveTime > 0 || maxMessages > 0 || mCh.Announcement || mCh.Schedule != nil || mCh.Inactivity > 0
+		mCh.mu.Unlock()
+		line := fmt.Sprintf("<#%s> %s / %d messages (%s)", id, liveTime, maxMessages, mode)
+		if !enabled {
+			line = fmt.Sprintf("<#%s> off", id)
+		} else if t, ok := next[id]; ok {
+			line += fmt.Sprintf(", next <t:%d:R>", t.Unix())
+		} else if b.reaper.isReaping(mCh) {
+			line += ", deleting now"
+		} else {
+			line += ", nothing due"
+		}
+		rows = append(rows, row{name, line})
+	}
+	b.mu.RUnlock()
+	for _, id := range maybeDisabled {
+		disCh, err := b.s.State.Channel(id)
+		if err != nil || disCh.GuildID != channel.GuildID {
+			continue
+		}
+		conf, err := b.readChannelConfig(id)
+		if err != nil || !conf.Disabled {
+			continue
+		}
+		rows = append(rows, row{disCh.Name, fmt.Sprintf("<#%s> %s / %d messages (%s), disabled: %s",
+			id, conf.LiveTime, conf.MaxMessages, parsePolicyMode(conf.PolicyMode), conf.DisabledReason)})
+	}
+	if len(rows) == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete isn't set up in any channels in this server.")
+		return
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].name < rows[j].name })
+
+	pages := (len(rows) + channelsPerPage - 1) / channelsPerPage
+	if page > pages {
+		page = pages
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "AutoDelete is set up in %d channels here (page %d of %d):\n", len(rows), page, pages)
+	start := (page - 1) * channelsPerPage
+	for i := start; i < len(rows) && i < start+channelsPerPage; i++ {
+		buf.WriteString(rows[i].line)
+		buf.WriteByte('\n')
+	}
+	if page < pages {
+		fmt.Fprintf(&buf, "Use `channels %d` for the next page.", page+1)
+	}
+	b.s.ChannelMessageSend(m.ChannelID, buf.String())
+}
+
+func CommandQueue(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
+	}
+
+	const maxShown = 20
+	entries := b.QueueSnapshot()
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%d channels queued.\n", len(entries))
+	for i, v := range entries {
+		if i == maxShown {
+			fmt.Fprintf(&buf, "...and %d more", len(entries)-maxShown)
+			break
+		}
+		fmt.Fprintf(&buf, "<#%s> <t:%d:R>\n", v.ChannelID, v.NextReap.Unix())
+	}
+	b.s.ChannelMessageSend(m.ChannelID, buf.String())
+}
+
+// CommandHealth shows the bot-wide picture: how much is being deleted and
+// whether the queue is keeping up.
+func CommandHealth(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
+	}
+	sum := b.summary()
+	overdue := "nothing"
+	if sum.Overdue != nil {
+		overdue = fmt.Sprintf("<#%s>, due <t:%d:R>", sum.Overdue.Channel.ID, sum.OverdueSince.Unix())
+	}
+	state := "running"
+	if !sum.WaitingSince.IsZero() {
+		state = fmt.Sprintf("waiting for the gateway since <t:%d:R>", sum.WaitingSince.Unix())
+	} else if sum.Paused {
+		state = "paused"
+	}
+	inline := func(name, value string) *discordgo.MessageEmbedField {
+		return &discordgo.MessageEmbedField{Name: name, Value: value, Inline: true}
+	}
+	embed := &discordgo.MessageEmbed{
+		Title: "AutoDelete health",
+		Fields: []*discordgo.MessageEmbedField{
+			inline("Channels", fmt.Sprintf("%d managed, %d disabled", sum.Channels, sum.Disabled)),
+			inline("Tracked messages", strconv.Itoa(sum.Tracked)),
+			inline("Deleted in the last hour", strconv.Itoa(sum.DeletedLastHour)),
+			inline("Queue", fmt.Sprintf("%d channels", sum.QueueLength)),
+			inline("Workers", fmt.Sprintf("%d of %d busy (%d%%)", sum.BusyWorkers, sum.Workers, 100*sum.BusyWorkers/sum.Workers)),
+			inline("Scheduler", state),
+			{Name: "Most overdue", Value: overdue},
+		},
+	}
+	_, err := b.s.ChannelMessageSendEmbed(m.ChannelID, embed)
+	if err != nil {
+		fmt.Println("Error sending health:", err)
+	}
+}
+
+// CommandRetention changes how long messages in an already set up channel
+// are kept, leaving the other settings alone.
+func CommandRetention(b *Bot, m *discordgo.Message, rest []string) {
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageMessages == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to change AutoDelete settings.")
+		return
+	}
+
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not set up in this channel. Use `@AutoDelete set` first.")
+		return
+	}
+
+	if len(rest) == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "Provide a duration, like `retention 3d12h` or `retention 2w`.")
+		return
+	}
+	d, err := parseDuration(rest[0])
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "Could not understand that duration: "+err.Error())
+		return
+	}
+	if min := b.minRetention(); d < min {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Retention must be at least %s.", min))
+		return
+	}
+	mCh.mu.Lock()
+	minAge := mCh.MinAge
+	mCh.mu.Unlock()
+	if d < minAge {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Retention can't be shorter than this channel's minimum age of %s.", minAge))
+		return
+	}
+
+	mCh.SetLiveTime(d)
+	err = b.SaveChannelConfig(m.ChannelID)
+	if err != nil {
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
+	}
+	b.QueueReap(mCh)
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will now be deleted after %s.", d))
+}
+
+// CommandConfig changes several limits of an existing channel in one go, like
+// `config retention=1d keep=50`. Nothing is changed unless all of them are
+// valid together.
+func CommandConfig(b *Bot, m *discordgo.Message, rest []string) {
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageMessages == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to change AutoDelete settings.")
+		return
+	}
+
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not set up in this channel. Use `@AutoDelete set` first.")
+		return
+	}
+	if len(rest) == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "Provide the settings to change, like `config retention=1d keep=50`. Options: `retention`, `max`, `keep`, `minage`.")
+		return
+	}
+
+	old := mCh.limits()
+	l := old
+	for _, v := range rest {
+		i := strings.IndexAny(v, "=:")
+		if i == -1 {
+			b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Expected `name=value`, got `%s`.", v))
+			return
+		}
+		name, value := strings.ToLower(v[:i]), v[i+1:]
+		switch name {
+		case "retention", "duration":
+			if value == "-" || value == "0" {
+				l.LiveTime = 0
+				break
+			}
+			l.LiveTime, err = parseDuration(value)
+		case "max", "count":
+			l.MaxMessages, err = strconv.Atoi(value)
+		case "keep":
+			l.KeepMessages, err = strconv.Atoi(value)
+		case "minage":
+			l.MinAge, err = parseDuration(value)
+		default:
+			b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown setting `%s`. Options: `retention`, `max`, `keep`, `minage`.", name))
+			return
+		}
+		if err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Bad value for `%s`: %v", name, err))
+			return
+		}
+	}
+
+	switch {
+	case l.LiveTime == 0 && l.MaxMessages == 0:
+		err = fmt.Errorf("that would turn off deletion; use `set 0` if that's what you want")
+	case l.MaxMessages < 0 || l.KeepMessages < 0 || l.LiveTime < 0 || l.MinAge < 0:
+		err = fmt.Errorf("settings can't be negative")
+	case l.LiveTime != 0 && l.LiveTime < b.minRetention():
+		err = fmt.Errorf("retention must be at least %s", b.minRetention())
+	case l.LiveTime != 0 && l.LiveTime < l.MinAge:
+		err = fmt.Errorf("retention of %s is shorter than the minimum age of %s", l.LiveTime, l.MinAge)
+	case l.MaxMessages > 0 && l.KeepMessages > l.MaxMessages:
+		err = fmt.Errorf("can't keep %d messages when the channel is capped at %d", l.KeepMessages, l.MaxMessages)
+	}
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "Nothing was changed: "+err.Error()+".")
+		return
+	}
+
+	mCh.setLimits(l)
+	err = b.SaveChannelConfig(m.ChannelID)
+	if err != nil {
+		mCh.setLimits(old)
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, nothing was changed.\n"+err.Error())
+		return
+	}
+	b.QueueReap(mCh)
+	mCh.mu.Lock()
+	policy := mCh.describePolicy()
+	mCh.mu.Unlock()
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Updated. Messages in this channel are now deleted %s.", policy))
+}
+
+// Most messages the preview command will list; more wouldn't fit in an embed.
+const maxPreviewMessages = 15
+
+// CommandPreview DMs the caller the oldest messages that the next reap will
+// delete, so the listing doesn't land in the channel and get deleted itself.
+func CommandPreview(b *Bot, m *discordgo.Message, rest []string) {
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageMessages == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to preview deletions.")
+		return
+	}
+
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil || !mCh.Enabled() {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not enabled in this channel.")
+		return
+	}
+
+	k := 10
+	if len(rest) > 0 {
+		n, err := strconv.ParseInt(rest[0], 10, 64)
+		if err == nil && n > 0 {
+			k = int(n)
+		}
+	}
+	if k > maxPreviewMessages {
+		k = maxPreviewMessages
+	}
+
+	due := mCh.PreviewDeletion(k)
+	var desc strings.Builder
+	for _, v := range due {
+		fmt.Fprintf(&desc, "<t:%d:R> https://discord.com/channels/%s/%s/%s\n", v.PostedAt.Unix(), mCh.Channel.GuildID, mCh.Channel.ID, v.MessageID)
+	}
+	if len(due) == 0 {
+		desc.WriteString("Nothing is due to be deleted yet.")
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Next deletions in #%s", mCh.Channel.Name),
+		Description: desc.String(),
+	}
+
+	dm, err := b.s.UserChannelCreate(m.Author.ID)
+	if err == nil {
+		_, err = b.s.ChannelMessageSendEmbed(dm.ID, embed)
+	}
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "I couldn't DM you the preview: "+err.Error())
+	}
+}
+
+// CommandEnable turns a channel back on after it was disabled for missing
+// permissions.
+func CommandEnable(b *Bot, m *discordgo.Message, rest []string) {
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageMessages == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to change AutoDelete settings.")
+		return
+	}
+
+	conf, err := b.readChannelConfig(m.ChannelID)
+	if err != nil || !conf.Disabled {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete has not been disabled in this channel.")
+		return
+	}
+
+	const need = discordgo.PermissionManageMessages | discordgo.PermissionReadMessageHistory
+	mypermissions, err := b.s.UserChannelPermissions(b.me.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check my permissions: "+err.Error())
+		return
+	}
+	if mypermissions&need != need {
+		b.s.ChannelMessageSend(m.ChannelID, "I still need the Manage Messages and Read Message History permissions in this channel.")
+		return
+	}
+
+	err = b.enableChannel(m.ChannelID)
+	if err != nil {
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
+		return
+	}
+	b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is enabled in this channel again.")
+}
+
+func CommandDisable(b *Bot, m *discordgo.Message, rest []string) {
+	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		return
+	}
+	if apermissions&discordgo.PermissionManageMessages == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to change AutoDelete settings.")
+		return
+	}
+
+	var until time.Time
+	if len(rest) > 0 {
+		d, err := parseDuration(rest[0])
+		if err != nil || d <= 0 {
+			b.s.ChannelMessageSend(m.ChannelID, "Bad duration for `disable`. Try something like 2h or 3d.")
+			return
+		}
+		until = b.now().Add(d)
+	}
+
+	conf, err := b.readChannelConfig(m.ChannelID)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is not enabled in this channel.")
+		return
+	}
+	if conf.Disabled && conf.DisabledUntil == nil && until.IsZero() {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is already disabled in this channel.")
+		return
+	}
+
+	err = b.disableChannel(m.ChannelID, "disabled by "+m.Author.String(), until)
+	if err != nil {
+		fmt.Println("Error:", err)
+		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
+		return
+	}
+	fmt.Println("[load] Disabled channel", m.ChannelID, "by", m.Author.ID)
+	if until.IsZero() {
+		b.s.ChannelMessageSend(m.ChannelID, "AutoDelete is disabled in this channel. Nothing will be deleted until someone says `@AutoDelete enable`.")
+	} else {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("AutoDelete is disabled in this channel until <t:%d:f>. Say `@AutoDelete enable` to turn it back on sooner.", until.Unix()))
+	}
+}
+
+func CommandReload(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
+	}
+	res, err := b.Reload()
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "Reload failed, nothing was changed: "+err.Error())
+		return
+	}
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Reloaded: %d channels added, %d removed, %d changed.", res.Added, res.Removed, res.Changed))
+}
+
+// CommandImport applies a config file attached to the message, as written by
+// export. Add `dryrun` to only report what would change.
+func CommandImport(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
+	}
+	if len(m.Attachments) == 0 {
+		b.s.ChannelMessageSend(m.ChannelID, "Attach the config file to import, as written by `export`.")
+		return
+	}
+	dryRun := len(rest) > 0 && rest[0] == "dryrun"
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(m.Attachments[0].URL)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "could not download the attachment: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	res, err := b.ImportConfig(resp.Body, dryRun)
+	if err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "Import failed, nothing was changed: "+err.Error())
+		return
+	}
+	msg := res.String()
+	if r := []rune(msg); len(r) > maxMessageLength {
+		msg = string(r[:maxMessageLength-3]) + "..."
+	}
+	b.s.ChannelMessageSend(m.ChannelID, msg)
+}
+
+// CommandExport replies with every channel config as a file that import
+// takes back.
+func CommandExport(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
+	}
+	var buf bytes.Buffer
+	if err := b.ExportConfig(&buf); err != nil {
+		b.s.ChannelMessageSend(m.ChannelID, "Export failed: "+err.Error())
+		return
+	}
+	_, err := b.s.ChannelFileSend(m.ChannelID, "autodelete-config.yml", &buf)
+	if err != nil {
+		fmt.Println("Error sending export:", err)
+	}
+}
+
+const defaultDrainTimeout = 5 * time.Minute
+
+func CommandDrain(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
+	}
+	timeout := defaultDrainTimeout
+	if len(rest) > 0 {
+		d, err := time.ParseDuration(rest[0])
+		if err != nil {
+			b.s.ChannelMessageSend(m.ChannelID, "Bad timeout: "+err.Error())
+			return
+		}
+		timeout = d
+	}
+	fmt.Println("[drn ] draining, requested by", m.Author.ID)
+	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Draining: no new deletions will start. %d reaps in flight, waiting up to %s...", b.reaper.inFlight(), timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := b.Drain(ctx, func(n int) {
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%d reaps in flight, waiting...", n))
+	})
+	if err != nil {
+		fmt.Println("[drn ] drain failed:", err)
+		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Drain did not finish: %v. %d reaps still in flight.", err, b.reaper.inFlight()))
+	} else {
+		fmt.Println("[drn ] drained")
+		b.s.ChannelMessageSend(m.ChannelID, "Drained. Nothing is in flight and the queue is saved.")
+	}
+	if b.OnDrained != nil {
+		b.OnDrained(err)
+	}
+}
+
+func CommandPause(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
+	}
+	b.Pause()
+	b.s.ChannelMessageSend(m.ChannelID, "Paused all deletions.")
+}
+
+func CommandResume(b *Bot, m *discordgo.Message, rest []string) {
+	if m.Author.ID != adminUserID {
+		return
 	}
+	b.Resume()
+	b.s.ChannelMessageSend(m.ChannelID, "Resumed deletions.")
 }
 
 var commands = map[string]func(b *Bot, m *discordgo.Message, rest []string){
-	"help":  CommandHelp,
-	"set":   CommandModify,
-	"start": CommandModify,
-	"setup": CommandModify,
-	"leave": CommandLeave,
+	"help":       CommandHelp,
+	"set":        CommandModify,
+	"start":      CommandModify,
+	"setup":      CommandModify,
+	"leave":      CommandLeave,
+	"status":     CommandStatus,
+	"stats":      CommandStats,
+	"reapnow":    CommandReapNow,
+	"ages":       CommandAges,
+	"enable":     CommandEnable,
+	"disable":    CommandDisable,
+	"retention":  CommandRetention,
+	"config":     CommandConfig,
+	"preview":    CommandPreview,
+	"setdefault": CommandSetDefault,
+	"category":   CommandCategory,
+	"copyconfig": CommandCopyConfig,
+	"forum":      CommandForum,
+	"channels":   CommandChannels,
+	"check":      CommandCheck,
 
 	"ahelp":     CommandAdminHelp,
 	"adminhelp": CommandAdminHelp,
@@ -194,4 +1744,12 @@ var commands = map[string]func(b *Bot, m *discordgo.Message, rest []string){
 	"adminmsg":  CommandAdminHelp,
 	"support":   CommandAdminHelp,
 	"adminsay":  CommandAdminSay,
+	"drain":     CommandDrain,
+	"export":    CommandExport,
+	"health":    CommandHealth,
+	"import":    CommandImport,
+	"pause":     CommandPause,
+	"queue":     CommandQueue,
+	"reload":    CommandReload,
+	"resume":    CommandResume,
 }
@@ -3,12 +3,16 @@ package autodelete
 import (
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete/metrics"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,20 +20,92 @@ type Bot struct {
 	Config
 	s  *discordgo.Session
 	me *discordgo.User
+	// what reaps and backlog loads talk to; s unless Config.Client is set
+	client DiscordClient
 
 	mu       sync.RWMutex
 	channels map[string]*ManagedChannel
 
-	reaper *reapQueue
+	guildMu sync.RWMutex
+	guilds  map[string]guildConfigMarshal
+
+	log       *slog.Logger
+	limiter   RateLimiter
+	budget    *deleteBudget
+	reaper    *reapQueue
+	store     configStore
+	archive   ArchiveSink
+	auditSink AuditSink
+	events    *eventHub
+
+	// webhooks for moving messages, by archive channel ID
+	webhookMu sync.Mutex
+	webhooks  map[string]*discordgo.Webhook
+
+	// serializes syncThreads
+	threadMu sync.Mutex
+
+	// OnReapError, if set, is called after a failed reap, except when the
+	// channel was dropped for missing permissions. It runs in its own
+	// goroutine so it can't hold up the workers. Set it before connecting.
+	OnReapError func(ch *ManagedChannel, err error)
+	// OnDrained, if set, is called when the drain command finishes, with
+	// Drain's result. The bot does nothing more after draining, so this
+	// is where to exit.
+	OnDrained func(err error)
 }
 
 func New(c Config) *Bot {
+	log := c.Logger
+	if log == nil {
+		level := slog.LevelInfo
+		level.UnmarshalText([]byte(c.LogLevel))
+		log = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	}
 	b := &Bot{
 		Config:   c,
+		log:      log,
 		channels: make(map[string]*ManagedChannel),
-		reaper:   newReapQueue(),
+		guilds:   make(map[string]guildConfigMarshal),
+		reaper:   newReapQueue(log.With("component", "reap")),
+		events:   newEventHub(),
+	}
+	b.store = fileStore{dir: b.dataDir()}
+	b.limiter = c.Limiter
+	if b.limiter == nil {
+		b.limiter = newTokenBucket(c.DeleteRate, c.DeleteBurst)
+	}
+	b.budget = newDeleteBudget(c.DeleteBudget, c.DeleteBudgetWindow)
+	b.archive = c.Archive
+	if b.archive == nil && c.ArchiveFile != "" {
+		b.archive = &FileArchive{Path: c.ArchiveFile}
+	} else if b.archive == nil && c.ArchiveWebhook != "" {
+		b.archive = &WebhookArchive{URL: c.ArchiveWebhook}
+	}
+	b.auditSink = c.Audit
+	if b.auditSink == nil && c.AuditFile != "" {
+		b.auditSink = &FileAudit{Path: c.AuditFile, MaxSize: c.AuditMaxSize, MaxBackups: c.AuditBackups}
+	} else if b.auditSink == nil && c.AuditWebhook != "" {
+		b.auditSink = &WebhookAudit{URL: c.AuditWebhook}
+	} else if b.auditSink == nil && c.AuditSyslog != "" {
+		b.auditSink = newSyslogAudit(c.AuditSyslog)
 	}
-	go b.reapScheduler()
+	if b.auditSink != nil && c.AuditBuffer > 0 {
+		b.auditSink = NewBufferedAudit(b.auditSink, c.AuditBuffer, b.reaper.log)
+	}
+	if c.Clock != nil {
+		b.reaper.clock = c.Clock
+	}
+	if c.TimerSlack > 0 {
+		b.reaper.slack = c.TimerSlack
+	}
+	b.loadQueueState()
+	if c.DryRun {
+		b.reaper.log.Warn("DRY RUN: no messages will be deleted")
+	}
+	b.reaper.wg.Add(2)
+	go b.reapScheduler(b.workerCount())
+	go b.reconcileLoop()
 	return b
 }
 
@@ -38,28 +114,365 @@ type Config struct {
 	ClientSecret string `yaml:"clientsecret"`
 	BotToken     string `yaml:"bottoken"`
 	ErrorLogCh   string `yaml:"errorlog"`
-	HTTP         struct {
+	// Where channel configs and queue state are kept. Defaults to ./data.
+	DataDir string `yaml:"data_dir"`
+	// Number of concurrent reap workers. Defaults to 4.
+	Workers int `yaml:"workers"`
+	// Retries for a delete call that gets rate limited. Defaults to 3.
+	ReapRetries int `yaml:"reap_retries"`
+	// Initial backoff after a rate limit, doubled on each retry. Defaults to 1s.
+	ReapBackoff time.Duration `yaml:"reap_backoff"`
+	// Most workers that channels from a single guild may occupy at once.
+	// Defaults to half of Workers, rounded up. Set to -1 for no limit.
+	GuildWorkers int `yaml:"guild_workers"`
+	// Most workers that may delete from one channel at once. A worker that
+	// finds more than a chunk due hands further chunks to idle workers,
+	// which speeds up catching up on a big backlog. Defaults to 1.
+	ChannelWorkers int `yaml:"channel_workers"`
+	// Messages per bulk delete call, at most 100. Defaults to 100.
+	BulkDeleteSize int `yaml:"bulk_delete_size"`
+	// LoadBacklog stops after this many messages, or once it reaches
+	// messages older than BacklogMaxAge. The rest are picked up after the
+	// loaded ones are deleted. Default to 500 and no age limit.
+	BacklogLimit  int           `yaml:"backlog_limit"`
+	BacklogMaxAge time.Duration `yaml:"backlog_max_age"`
+	// Most messages a worker deletes from one channel before moving on to
+	// the next due channel. Defaults to 500.
+	ReapChunkSize int `yaml:"reap_chunk_size"`
+	// Retention shorter than this is raised to it when a channel loads,
+	// and refused by the retention command. Defaults to 10m.
+	MinRetention time.Duration `yaml:"min_retention"`
+	// With FirstReapGrace, a channel that is newly set up isn't reaped
+	// until FirstReapDelay after the set command, giving admins time to
+	// adjust the settings. The delay defaults to the channel's live time,
+	// or 1h if it has none.
+	FirstReapGrace bool          `yaml:"first_reap_grace"`
+	FirstReapDelay time.Duration `yaml:"first_reap_delay"`
+	// Skip the MinRetention check, for channels that really want
+	// sub-minute retention.
+	AllowShortRetention bool `yaml:"allow_short_retention"`
+	// Give up on a single Reap after this long. Defaults to 5m.
+	ReapTimeout time.Duration `yaml:"reap_timeout"`
+	// A channel marked as being reaped for longer than this is assumed to
+	// have lost its worker, and is put back in the queue. Defaults to 30m;
+	// keep it well above ReapTimeout.
+	StaleReapTimeout time.Duration `yaml:"stale_reap_timeout"`
+	// Maximum per-channel scheduling delay as a percentage of the channel's
+	// live time. Defaults to 5; negative disables jitter.
+	ReapJitter float64 `yaml:"reap_jitter"`
+	// Added to each scheduler sleep so it doesn't wake just before a
+	// deadline on systems with coarse timers. Defaults to 2ms.
+	TimerSlack time.Duration `yaml:"timer_slack"`
+	// Log what would be deleted instead of deleting anything.
+	DryRun bool `yaml:"dry_run"`
+	// Minimum log level: debug, info, warn or error. Defaults to info.
+	LogLevel string `yaml:"log_level"`
+	// Logger overrides the default stdout logger, e.g. for tests.
+	Logger *slog.Logger `yaml:"-"`
+	// The health check fails if the scheduler hasn't woken up in this
+	// long. Defaults to 10m.
+	HealthTimeout time.Duration `yaml:"health_timeout"`
+	// Delete calls per second across all workers, and the burst allowed
+	// above that. Default to 2 and 5.
+	DeleteRate  float64 `yaml:"delete_rate"`
+	DeleteBurst int     `yaml:"delete_burst"`
+	// Limiter overrides the token bucket built from the above.
+	Limiter RateLimiter `yaml:"-"`
+	// Most messages deleted across the whole bot in each window. Channels
+	// due once it is used up wait for the next window. Defaults to no
+	// limit and a 1m window.
+	DeleteBudget       int           `yaml:"delete_budget"`
+	DeleteBudgetWindow time.Duration `yaml:"delete_budget_window"`
+	// Alert when a channel is tracking more than BacklogAlert messages, by
+	// POSTing a BacklogAlert to the webhook and/or a DM to the user ID.
+	// Each channel alerts at most once per BacklogAlertInterval, which
+	// defaults to 1h.
+	BacklogAlert         int           `yaml:"backlog_alert"`
+	BacklogAlertWebhook  string        `yaml:"backlog_alert_webhook"`
+	BacklogAlertUser     string        `yaml:"backlog_alert_user"`
+	BacklogAlertInterval time.Duration `yaml:"backlog_alert_interval"`
+	// Save messages here before deleting them: a file to append JSON lines
+	// to, or a URL to POST them to. Archive overrides both.
+	ArchiveFile    string      `yaml:"archive_file"`
+	ArchiveWebhook string      `yaml:"archive_webhook"`
+	Archive        ArchiveSink `yaml:"-"`
+	// Write a JSON record of every reap that deleted something: to a file
+	// rotated past AuditMaxSize bytes (default 10MB) keeping AuditBackups
+	// old copies, POSTed to a URL, or to syslog under the given tag. Audit
+	// overrides all three. With AuditBuffer, up to that many records are
+	// queued and written in the background, and flushed at shutdown.
+	AuditFile    string    `yaml:"audit_file"`
+	AuditMaxSize int64     `yaml:"audit_max_size"`
+	AuditBackups int       `yaml:"audit_backups"`
+	AuditWebhook string    `yaml:"audit_webhook"`
+	AuditSyslog  string    `yaml:"audit_syslog"`
+	AuditBuffer  int       `yaml:"audit_buffer"`
+	Audit        AuditSink `yaml:"-"`
+	// Client overrides the session for deleting messages and loading
+	// backlogs. See DiscordClient.
+	Client DiscordClient `yaml:"-"`
+	// Clock overrides the wall clock used for scheduling. Meant for tests.
+	Clock Clock `yaml:"-"`
+	// If set, stream reap events over a websocket at /events to clients
+	// presenting this token.
+	EventsToken string `yaml:"events_token"`
+	// If set, export and import channel configs at /admin/config with
+	// this as a bearer token.
+	AdminToken string `yaml:"admin_token"`
+	// Text of the notice pinned in a channel the first time it is set up.
+	// {policy} is replaced with the channel's settings and {channel} with
+	// a mention of it. Defaults to defaultNotice.
+	Notice string `yaml:"notice"`
+	// Don't post the first-time notice at all.
+	DisableNotice bool `yaml:"disable_notice"`
+	// Serve Prometheus metrics at /metrics on the HTTP listener.
+	Metrics bool `yaml:"metrics"`
+	HTTP    struct {
 		Listen string `yaml:"listen"`
 		Public string `yaml:"public"`
 	} `yaml:"http"`
-	//Database struct {
-	//	Driver string `yaml:"driver"`
-	//	URL    string `yaml:"url"`
-	//} `yaml:"db,flow"`
+	// If Driver is set, configs are kept in this database instead of
+	// ./data. Existing files are imported on the first start.
+	Database struct {
+		Driver string `yaml:"driver"`
+		URL    string `yaml:"url"`
+	} `yaml:"db,flow"`
+}
+
+// MetricsHandler serves the bot's Prometheus metrics. It returns a 404 handler
+// if metrics are disabled in the config.
+func (b *Bot) MetricsHandler() http.Handler {
+	if !b.Config.Metrics {
+		return http.NotFoundHandler()
+	}
+	return metrics.Default
+}
+
+const defaultWorkers = 4
+
+// workerCount returns the effective size of the reap worker pool.
+func (b *Bot) workerCount() int {
+	if b.Config.Workers == 0 {
+		return defaultWorkers
+	}
+	if b.Config.Workers < 1 {
+		return 1
+	}
+	return b.Config.Workers
+}
+
+const defaultReapRetries = 3
+const defaultReapBackoff = 1 * time.Second
+
+func (b *Bot) reapRetries() int {
+	if b.Config.ReapRetries <= 0 {
+		return defaultReapRetries
+	}
+	return b.Config.ReapRetries
+}
+
+func (b *Bot) reapBackoff() time.Duration {
+	if b.Config.ReapBackoff <= 0 {
+		return defaultReapBackoff
+	}
+	return b.Config.ReapBackoff
+}
+
+const defaultReapJitter = 5
+
+func (b *Bot) guildWorkers() int {
+	if b.Config.GuildWorkers < 0 {
+		return 0
+	}
+	if b.Config.GuildWorkers == 0 {
+		return (b.workerCount() + 1) / 2
+	}
+	return b.Config.GuildWorkers
+}
+
+func (b *Bot) channelWorkers() int {
+	if b.Config.ChannelWorkers < 1 {
+		return 1
+	}
+	return b.Config.ChannelWorkers
+}
+
+// Discord's limit for a single bulk delete call.
+const maxBulkDeleteSize = 100
+
+func (b *Bot) bulkDeleteSize() int {
+	// Bulk delete needs at least 2 messages
+	if b.Config.BulkDeleteSize < 2 || b.Config.BulkDeleteSize > maxBulkDeleteSize {
+		return maxBulkDeleteSize
+	}
+	return b.Config.BulkDeleteSize
+}
+
+const defaultBacklogLimit = 500
+
+func (b *Bot) backlogLimit() int {
+	if b.Config.BacklogLimit <= 0 {
+		return defaultBacklogLimit
+	}
+	return b.Config.BacklogLimit
+}
+
+const defaultBacklogAlertInterval = 1 * time.Hour
+
+func (b *Bot) backlogAlertInterval() time.Duration {
+	if b.Config.BacklogAlertInterval <= 0 {
+		return defaultBacklogAlertInterval
+	}
+	return b.Config.BacklogAlertInterval
+}
+
+const defaultReapChunkSize = 500
+
+func (b *Bot) reapChunkSize() int {
+	if b.Config.ReapChunkSize <= 0 {
+		return defaultReapChunkSize
+	}
+	return b.Config.ReapChunkSize
+}
+
+const defaultMinRetention = 10 * time.Minute
+
+// minRetention returns the shortest retention allowed, or zero if there is no
+// limit.
+func (b *Bot) minRetention() time.Duration {
+	if b.Config.AllowShortRetention {
+		return 0
+	}
+	if b.Config.MinRetention <= 0 {
+		return defaultMinRetention
+	}
+	return b.Config.MinRetention
+}
+
+const defaultFirstReapDelay = time.Hour
+
+// firstReapDelay returns how long a newly set up channel with the given live
+// time waits before its first reap, or zero if there is no grace period.
+func (b *Bot) firstReapDelay(liveTime time.Duration) time.Duration {
+	switch {
+	case !b.Config.FirstReapGrace:
+		return 0
+	case b.Config.FirstReapDelay > 0:
+		return b.Config.FirstReapDelay
+	case liveTime > 0:
+		return liveTime
+	}
+	return defaultFirstReapDelay
+}
+
+const defaultNotice = "AutoDelete is now managing {channel}. {policy}\n" +
+	"This notice is pinned and won't be deleted."
+
+func (b *Bot) noticeTemplate() string {
+	if b.Config.Notice == "" {
+		return defaultNotice
+	}
+	return b.Config.Notice
+}
+
+const defaultReapTimeout = 5 * time.Minute
+
+func (b *Bot) reapTimeout() time.Duration {
+	if b.Config.ReapTimeout <= 0 {
+		return defaultReapTimeout
+	}
+	return b.Config.ReapTimeout
+}
+
+const defaultStaleReapTimeout = 30 * time.Minute
+
+func (b *Bot) staleReapTimeout() time.Duration {
+	if b.Config.StaleReapTimeout <= 0 {
+		return defaultStaleReapTimeout
+	}
+	return b.Config.StaleReapTimeout
+}
+
+func (b *Bot) jitterPercent() float64 {
+	if b.Config.ReapJitter == 0 {
+		return defaultReapJitter
+	}
+	return b.Config.ReapJitter
 }
 
 type managedChannelMarshal struct {
-	ID             string        `yaml:"id"`
-	ConfMessageID  string        `yaml:"conf_message_id"`
-	LiveTime       time.Duration `yaml:"live_time"`
-	MaxMessages    int           `yaml:"max_messages"`
-	LastSentUpdate int           `yaml:"last_critical_msg"`
-	HasPins        bool          `yaml:"has_pins,omitempty"`
-	IsDonor        bool          `yaml:"is_donor,omitempty"`
+	ID                 string        `yaml:"id"`
+	ConfMessageID      string        `yaml:"conf_message_id"`
+	NoticeMessageID    string        `yaml:"notice_message_id,omitempty"`
+	NoticePosted       bool          `yaml:"notice_posted,omitempty"`
+	LiveTime           time.Duration `yaml:"live_time"`
+	MaxMessages        int           `yaml:"max_messages"`
+	PolicyMode         string        `yaml:"policy_mode,omitempty"`
+	AttachmentLiveTime time.Duration `yaml:"attachment_live_time,omitempty"`
+	ShortLength        int           `yaml:"short_length,omitempty"`
+	ShortLiveTime      time.Duration `yaml:"short_live_time,omitempty"`
+	KeepMessages       int           `yaml:"keep_messages,omitempty"`
+	KeepNewest         bool          `yaml:"keep_newest,omitempty"`
+	GuildDefault       bool          `yaml:"guild_default,omitempty"`
+	MinAge             time.Duration `yaml:"min_age,omitempty"`
+	Inactivity         time.Duration `yaml:"inactivity,omitempty"`
+	EffectiveFrom      *time.Time    `yaml:"effective_from,omitempty"`
+	GraceUntil         *time.Time    `yaml:"grace_until,omitempty"`
+	Announcement       bool          `yaml:"announcement,omitempty"`
+	LastSentUpdate     int           `yaml:"last_critical_msg"`
+	HasPins            bool          `yaml:"has_pins,omitempty"`
+	DeletePinned       bool          `yaml:"delete_pinned,omitempty"`
+	KeepUsers          []string      `yaml:"keep_users,omitempty"`
+	KeepBots           bool          `yaml:"keep_bots,omitempty"`
+	DeleteOwn          bool          `yaml:"delete_own,omitempty"`
+	MoveTo             string        `yaml:"move_to,omitempty"`
+	ContentPattern     string        `yaml:"content_pattern,omitempty"`
+	OnlyWithLinks      bool          `yaml:"only_with_links,omitempty"`
+	OnlyWithEmbeds     bool          `yaml:"only_with_embeds,omitempty"`
+	SystemMessages     string        `yaml:"system_messages,omitempty"`
+	Action             string        `yaml:"action,omitempty"`
+	Schedule           string        `yaml:"schedule,omitempty"`
+	QuietHours         string        `yaml:"quiet_hours,omitempty"`
+	Timezone           string        `yaml:"timezone,omitempty"`
+	TriggerEmoji       string        `yaml:"trigger_emoji,omitempty"`
+	TriggerCount       int           `yaml:"trigger_count,omitempty"`
+	IsDonor            bool          `yaml:"is_donor,omitempty"`
+	// Role ID to how long messages from members with it are kept
+	RoleLiveTimes map[string]time.Duration `yaml:"role_live_times,omitempty"`
+	// Set when the bot lost its permissions or someone used the disable
+	// command; cleared by the enable command, or at DisabledUntil if set.
+	Disabled       bool       `yaml:"disabled,omitempty"`
+	DisabledReason string     `yaml:"disabled_reason,omitempty"`
+	DisabledUntil  *time.Time `yaml:"disabled_until,omitempty"`
+	// The category these settings were copied from, or the parent channel
+	// for a thread, if any. They are updated or removed along with the
+	// source's.
+	InheritedFrom string `yaml:"inherited_from,omitempty"`
+	// Whether the channel's threads get a copy of its settings
+	Threads bool `yaml:"threads,omitempty"`
+}
+
+// guildConfigMarshal is the per-guild default policy for channels that opt in
+// with UseGuildDefault.
+type guildConfigMarshal struct {
+	ID          string        `yaml:"id"`
+	LiveTime    time.Duration `yaml:"live_time"`
+	MaxMessages int           `yaml:"max_messages"`
+	// Category ID to the settings its channels inherit
+	Categories map[string]managedChannelMarshal `yaml:"categories,omitempty"`
+}
+
+const defaultDataDir = "./data"
+
+func (b *Bot) dataDir() string {
+	if b.Config.DataDir == "" {
+		return defaultDataDir
+	}
+	return b.Config.DataDir
 }
 
-const pathChannelConfDir = "./data"
-const pathChannelConfig = "./data/%s.yml"
+// Not a .yml file, so LoadChannelConfigs doesn't mistake it for a channel.
+const fileQueueState = "queue_state.yaml"
 
 func (b *Bot) ReportToLogChannel(msg string) {
 	_, err := b.s.ChannelMessageSend(b.Config.ErrorLogCh, msg)
@@ -109,34 +522,106 @@ func (b *Bot) SaveChannelConfig(channelID string) error {
 }
 
 func (b *Bot) saveChannelConfig(conf managedChannelMarshal) error {
-	by, err := yaml.Marshal(conf)
-	if err != nil {
-		panic(err)
+	return b.store.SaveChannel(conf)
+}
+
+func (b *Bot) guildDefault(guildID string) (guildConfigMarshal, bool) {
+	b.guildMu.RLock()
+	defer b.guildMu.RUnlock()
+	g, ok := b.guilds[guildID]
+	return g, ok
+}
+
+// setGuildDefault saves the guild default policy and reschedules every channel
+// in the guild that follows it. The category settings are kept as they are.
+func (b *Bot) setGuildDefault(conf guildConfigMarshal) error {
+	b.guildMu.Lock()
+	conf.Categories = b.guilds[conf.ID].Categories
+	err := b.store.SaveGuild(conf)
+	if err == nil {
+		b.guilds[conf.ID] = conf
 	}
-	fileName := fmt.Sprintf(pathChannelConfig, conf.ID)
-	f, err := os.Create(fileName)
+	b.guildMu.Unlock()
 	if err != nil {
 		return err
 	}
-	f.Write(by)
-	err = f.Close()
+
+	var affected []*ManagedChannel
+	b.mu.RLock()
+	for _, v := range b.channels {
+		if v != nil && v.Channel.GuildID == conf.ID {
+			affected = append(affected, v)
+		}
+	}
+	b.mu.RUnlock()
+	for _, v := range affected {
+		v.mu.Lock()
+		_, _, source := v.effectivePolicy()
+		v.mu.Unlock()
+		if source == policyGuild {
+			b.QueueReap(v)
+		}
+	}
+	return nil
+}
+
+func (b *Bot) loadGuildConfigs() error {
+	guilds, err := b.store.LoadGuilds()
 	if err != nil {
 		return err
 	}
+	b.guildMu.Lock()
+	for _, conf := range guilds {
+		b.guilds[conf.ID] = conf
+	}
+	b.guildMu.Unlock()
 	return nil
 }
 
+func (b *Bot) saveQueueState(entries []QueueEntry) error {
+	by, err := yaml.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(b.dataDir(), fileQueueState), by, 0644)
+}
+
+// loadQueueState restores reap deadlines saved at the last shutdown.
+func (b *Bot) loadQueueState() {
+	by, err := ioutil.ReadFile(filepath.Join(b.dataDir(), fileQueueState))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fmt.Println("could not read queue state:", err)
+		return
+	}
+	var entries []QueueEntry
+	err = yaml.Unmarshal(by, &entries)
+	if err != nil {
+		fmt.Println("could not parse queue state:", err)
+		return
+	}
+	b.reaper.restoreState(entries)
+	b.reaper.log.Info("restored deadlines from last shutdown", "count", len(entries))
+}
+
 func (b *Bot) deleteChannelConfig(chID string) error {
-	fileName := fmt.Sprintf(pathChannelConfig, chID)
-	err := os.Remove(fileName)
+	err := b.store.DeleteChannel(chID)
 	if err != nil {
 		fmt.Println("failed to delete channel config for", chID, ":", err)
 		// do NOT return
 	}
 
 	b.mu.Lock()
+	mCh := b.channels[chID]
 	delete(b.channels, chID)
 	b.mu.Unlock()
+	if mCh != nil {
+		b.reaper.Remove(mCh)
+		if mCh.threadsEnabled() {
+			go b.syncThreads(chID)
+		}
+	}
 	return nil
 }
 
@@ -148,27 +633,39 @@ func (b *Bot) setChannelConfig(conf managedChannelMarshal) error {
 	}
 
 	b.mu.Lock()
+	oldCh := b.channels[conf.ID]
 	delete(b.channels, conf.ID)
 	b.mu.Unlock()
+	if oldCh != nil {
+		b.reaper.Remove(oldCh)
+	}
 
-	return b.loadChannel(conf.ID)
+	err = b.loadChannel(conf.ID)
+	if conf.Threads || (oldCh != nil && oldCh.threadsEnabled()) {
+		go b.syncThreads(conf.ID)
+	}
+	return err
 }
 
+// handleCriticalPermissionsErrors stops managing a channel when srcErr shows
+// the bot can't work there. A deleted channel's config is removed; a channel
+// where the bot lost access or permissions is disabled until someone runs the
+// enable command, and the server owner gets a DM about it.
 func (b *Bot) handleCriticalPermissionsErrors(channelID string, srcErr error) bool {
 	if rErr, ok := srcErr.(*discordgo.RESTError); ok && rErr != nil && rErr.Message != nil {
-		shouldRemoveChannel := false
-		shouldNotifyChannel := false
-		var logMsg string
-
 		switch rErr.Message.Code {
-		case discordgo.ErrCodeUnknownChannel, discordgo.ErrCodeMissingAccess:
-			shouldRemoveChannel = true
-			logMsg = fmt.Sprintf("Removed unknown channel ID %s", channelID)
-		case discordgo.ErrCodeMissingPermissions:
-			shouldRemoveChannel = true
-			shouldNotifyChannel = true
+		case discordgo.ErrCodeUnknownChannel:
+			b.ReportToLogChannel(fmt.Sprintf("Removed unknown channel ID %s", channelID))
+			b.deleteChannelConfig(channelID)
+			return true
+		case errCodeThreadArchived:
+			b.threadArchived(channelID)
+			return true
+		case discordgo.ErrCodeMissingAccess, discordgo.ErrCodeMissingPermissions:
+			var logMsg, guildID string
 			channelObj, _ := b.s.Channel(channelID)
 			if channelObj != nil {
+				guildID = channelObj.GuildID
 				guildObj, _ := b.s.Guild(channelObj.GuildID)
 				if guildObj != nil {
 					logMsg = fmt.Sprintf("AutoDelete disabled from channel #%s (%s) (server %s (%s)) due to missing critical permissions", channelObj.Name, channelID, guildObj.Name, channelObj.GuildID)
@@ -178,40 +675,126 @@ func (b *Bot) handleCriticalPermissionsErrors(channelID string, srcErr error) bo
 			} else {
 				logMsg = fmt.Sprintf("AutoDelete disabled from channel (%s) (server unknown) due to missing critical permissions", channelID)
 			}
-		}
 
-		if shouldRemoveChannel {
+			err := b.disableChannel(channelID, rErr.Message.Message, time.Time{})
+			if err != nil {
+				fmt.Println("error disabling channel", channelID, ":", err)
+			}
 			b.ReportToLogChannel(logMsg)
-			if shouldNotifyChannel {
+			if rErr.Message.Code == discordgo.ErrCodeMissingPermissions {
 				_, err := b.s.ChannelMessageSend(channelID, logMsg)
-				fmt.Println("error reporting removal to channel", channelID, ":", err)
+				if err != nil {
+					fmt.Println("error reporting removal to channel", channelID, ":", err)
+				}
+			}
+			if guildID != "" {
+				b.notifyGuildOwner(guildID, logMsg+". Fix the bot's permissions, then say `@AutoDelete enable` in the channel to turn it back on.")
 			}
-			b.deleteChannelConfig(channelID)
 			return true
 		}
 	}
 	return false
 }
 
-func (b *Bot) LoadChannelConfigs() error {
-	files, err := ioutil.ReadDir(pathChannelConfDir)
+// disableChannel stops managing a channel but keeps its config on disk,
+// marked disabled, so it isn't picked up again on restart. If until is set,
+// the channel is enabled again at that time.
+func (b *Bot) disableChannel(chID, reason string, until time.Time) error {
+	b.mu.Lock()
+	mCh := b.channels[chID]
+	b.channels[chID] = nil
+	b.mu.Unlock()
+
+	var conf managedChannelMarshal
+	if mCh != nil {
+		conf = mCh.Export()
+		mCh.mu.Lock()
+		mCh.disabled = true
+		mCh.mu.Unlock()
+		b.reaper.Remove(mCh)
+	} else {
+		var err error
+		conf, err = b.readChannelConfig(chID)
+		if err != nil {
+			return err
+		}
+	}
+	conf.Disabled = true
+	conf.DisabledReason = reason
+	conf.DisabledUntil = nil
+	if !until.IsZero() {
+		conf.DisabledUntil = &until
+		b.scheduleEnable(chID, until)
+	}
+	return b.saveChannelConfig(conf)
+}
+
+// enableChannel clears the disabled flag on a channel's config and starts
+// managing it again.
+func (b *Bot) enableChannel(chID string) error {
+	conf, err := b.readChannelConfig(chID)
 	if err != nil {
 		return err
 	}
-	for _, v := range files {
-		n := v.Name()
-		if !strings.HasSuffix(n, ".yml") {
-			continue
+	if !conf.Disabled {
+		return nil
+	}
+	conf.Disabled = false
+	conf.DisabledReason = ""
+	conf.DisabledUntil = nil
+	return b.setChannelConfig(conf)
+}
+
+// scheduleEnable turns a disabled channel back on at the given time, unless
+// it was enabled, or disabled again with a different end, in the meantime.
+func (b *Bot) scheduleEnable(chID string, until time.Time) {
+	b.reaper.clock.AfterFunc(until.Sub(b.now()), func() {
+		select {
+		case <-b.reaper.done:
+			return
+		default:
 		}
-		chID := strings.TrimSuffix(n, ".yml")
-		err = b.loadChannel(chID)
+		conf, err := b.readChannelConfig(chID)
+		if err != nil || !conf.Disabled || conf.DisabledUntil == nil || !conf.DisabledUntil.Equal(until) {
+			return
+		}
+		err = b.enableChannel(chID)
+		if err != nil {
+			fmt.Println("error re-enabling channel", chID, ":", err)
+			return
+		}
+		fmt.Println("[load] re-enabled channel", chID, "after a timed disable")
+		b.s.ChannelMessageSend(chID, "AutoDelete is enabled in this channel again.")
+	})
+}
+
+// notifyGuildOwner sends a DM to the owner of the server.
+func (b *Bot) notifyGuildOwner(guildID, msg string) {
+	guild, err := b.s.Guild(guildID)
+	if err != nil {
+		fmt.Println("error looking up server", guildID, ":", err)
+		return
+	}
+	dm, err := b.s.UserChannelCreate(guild.OwnerID)
+	if err == nil {
+		_, err = b.s.ChannelMessageSend(dm.ID, msg)
+	}
+	if err != nil {
+		fmt.Println("error sending DM to owner of", guildID, ":", err)
+	}
+}
+
+func (b *Bot) LoadChannelConfigs() error {
+	err := b.loadGuildConfigs()
+	if err != nil {
+		fmt.Println("error loading guild configs:", err)
+	}
+	err = b.store.EachChannel(func(conf managedChannelMarshal) {
+		chID := conf.ID
+		err := b.startChannel(conf)
 
 		errHandled := b.handleCriticalPermissionsErrors(chID, err)
 
-		if os.IsNotExist(err) {
-			fmt.Printf("Error loading configuration for %s: configuration file does not exist\n", chID)
-			errHandled = true
-		}
 		if err != nil && !errHandled {
 			channelObj, _ := b.s.Channel(chID)
 			if channelObj != nil {
@@ -226,18 +809,22 @@ func (b *Bot) LoadChannelConfigs() error {
 			fmt.Printf("Error loading configuration for %s: %v\n", chID, err)
 			errHandled = true
 		}
+	})
+	if err != nil {
+		return err
+	}
+	if n := b.reaper.dropRestored(); n > 0 {
+		b.reaper.log.Info("dropped saved deadlines for channels that no longer exist", "count", n)
 	}
 	return nil
 }
 
-func (b *Bot) loadChannel(channelID string) error {
-	_, err := b.s.Channel(channelID)
-	if err != nil {
-		return err
-	}
+func (b *Bot) readChannelConfig(channelID string) (managedChannelMarshal, error) {
+	return b.store.LoadChannel(channelID)
+}
 
-	fileName := fmt.Sprintf(pathChannelConfig, channelID)
-	f, err := os.Open(fileName)
+func (b *Bot) loadChannel(channelID string) error {
+	conf, err := b.readChannelConfig(channelID)
 	if os.IsNotExist(err) {
 		b.mu.Lock()
 		b.channels[channelID] = nil
@@ -246,18 +833,37 @@ func (b *Bot) loadChannel(channelID string) error {
 	} else if err != nil {
 		return err
 	}
-	by, err := ioutil.ReadAll(f)
-	f.Close()
+	conf.ID = channelID
+	return b.startChannel(conf)
+}
+
+// startChannel begins managing a channel with the given saved config.
+func (b *Bot) startChannel(conf managedChannelMarshal) error {
+	channelID := conf.ID
+	_, err := b.s.Channel(channelID)
 	if err != nil {
 		return err
 	}
-	var conf managedChannelMarshal
-	err = yaml.Unmarshal(by, &conf)
-	if err != nil {
-		return err
+	if conf.Disabled && conf.DisabledUntil != nil && !conf.DisabledUntil.After(b.now()) {
+		// The timed disable ran out while we were down
+		conf.Disabled = false
+		conf.DisabledReason = ""
+		conf.DisabledUntil = nil
+		err = b.saveChannelConfig(conf)
+		if err != nil {
+			return err
+		}
+	}
+	if conf.Disabled {
+		b.mu.Lock()
+		b.channels[channelID] = nil
+		b.mu.Unlock()
+		if conf.DisabledUntil != nil {
+			b.scheduleEnable(channelID, *conf.DisabledUntil)
+		}
+		return nil
 	}
 
-	conf.ID = channelID
 	mCh, err := InitChannel(b, conf)
 	if err != nil {
 		return err
@@ -274,3 +880,208 @@ func (b *Bot) loadChannel(channelID string) error {
 	}
 	return nil
 }
+
+// ReloadResult counts what a Reload changed.
+type ReloadResult struct {
+	Added, Removed, Changed int
+}
+
+// Reload re-reads the config store and applies the differences to the
+// running bot: new channels are started, channels that were removed or
+// disabled are dropped from the queue, and changed channels are restarted
+// with their new settings. The store is read in full before anything is
+// touched, so a read error leaves everything as it was. The new channels are
+// all set up before being swapped in together, so a channel is never missing
+// in between; their backlogs are loaded after the swap.
+func (b *Bot) Reload() (ReloadResult, error) {
+	var res ReloadResult
+
+	guilds, err := b.store.LoadGuilds()
+	if err != nil {
+		return res, err
+	}
+	confs := make(map[string]managedChannelMarshal)
+	err = b.store.EachChannel(func(conf managedChannelMarshal) {
+		confs[conf.ID] = conf
+	})
+	if err != nil {
+		return res, err
+	}
+
+	b.guildMu.Lock()
+	b.guilds = make(map[string]guildConfigMarshal, len(guilds))
+	for _, g := range guilds {
+		b.guilds[g.ID] = g
+	}
+	b.guildMu.Unlock()
+
+	// Work out the whole diff first. old is what each changed ID held then,
+	// so the swap can leave alone anything changed since.
+	old := make(map[string]*ManagedChannel)
+	var started []managedChannelMarshal
+	b.mu.RLock()
+	for id, mCh := range b.channels {
+		conf, ok := confs[id]
+		if !ok || conf.Disabled {
+			old[id] = mCh
+			continue
+		}
+		if mCh != nil && b.sameChannelConfig(mCh.Export(), conf) {
+			continue
+		}
+		old[id] = mCh
+		started = append(started, conf)
+	}
+	for id, conf := range confs {
+		if _, ok := b.channels[id]; !ok && !conf.Disabled {
+			old[id] = nil
+			started = append(started, conf)
+		}
+	}
+	b.mu.RUnlock()
+
+	// Build the new channels while the old ones keep running
+	built := make(map[string]*ManagedChannel, len(started))
+	failed := make(map[string]error)
+	for _, conf := range started {
+		mCh, err := InitChannel(b, conf)
+		if err != nil {
+			failed[conf.ID] = err
+			continue
+		}
+		built[conf.ID] = mCh
+	}
+
+	// Swap them all in at once, so messages arriving meanwhile never find a
+	// channel missing and load it on their own
+	var loaded []*ManagedChannel
+	b.mu.Lock()
+	for id, prev := range old {
+		if b.channels[id] != prev {
+			// Changed by someone else since
+			delete(built, id)
+			delete(failed, id)
+			continue
+		}
+		if prev != nil {
+			// keep stray QueueReaps on the old object out of the queue
+			prev.mu.Lock()
+			prev.disabled = true
+			prev.mu.Unlock()
+			b.reaper.Remove(prev)
+		}
+		switch mCh, ok := built[id]; {
+		case ok:
+			b.channels[id] = mCh
+			loaded = append(loaded, mCh)
+			if prev != nil {
+				res.Changed++
+			} else {
+				res.Added++
+			}
+		case failed[id] != nil:
+			delete(b.channels, id)
+			if prev != nil {
+				res.Changed++
+			} else {
+				res.Added++
+			}
+		default:
+			delete(b.channels, id)
+			if prev != nil {
+				res.Removed++
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for id, err := range failed {
+		if !b.handleCriticalPermissionsErrors(id, err) {
+			fmt.Printf("[load] error reloading %s: %v\n", id, err)
+		}
+	}
+	for _, mCh := range loaded {
+		if err := mCh.LoadBacklog(); err != nil {
+			fmt.Println("Loading backlog for", mCh.Channel.ID, err)
+			b.handleCriticalPermissionsErrors(mCh.Channel.ID, err)
+		}
+	}
+
+	// Channels following a guild default may have a new deadline
+	b.mu.RLock()
+	var all []*ManagedChannel
+	for _, mCh := range b.channels {
+		if mCh != nil {
+			all = append(all, mCh)
+		}
+	}
+	b.mu.RUnlock()
+	for _, mCh := range all {
+		b.QueueReap(mCh)
+	}
+	fmt.Printf("[load] reloaded configs: %d added, %d removed, %d changed\n", res.Added, res.Removed, res.Changed)
+	return res, nil
+}
+
+// normalizeChannelConfig returns conf with the limits InitChannel applies:
+// keep_messages no higher than max_messages, and retention times no shorter
+// than the minimum. logf, if not nil, is told about each change.
+func (b *Bot) normalizeChannelConfig(conf managedChannelMarshal, logf func(format string, args ...interface{})) managedChannelMarshal {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	if conf.MaxMessages > 0 && conf.KeepMessages > conf.MaxMessages {
+		logf("keep_messages %d is over max_messages %d, lowering it", conf.KeepMessages, conf.MaxMessages)
+		conf.KeepMessages = conf.MaxMessages
+	}
+	min := b.minRetention()
+	if min <= 0 {
+		return conf
+	}
+	if conf.LiveTime > 0 && conf.LiveTime < min {
+		logf("live_time %s is under the minimum of %s, raising it", conf.LiveTime, min)
+		conf.LiveTime = min
+	}
+	if conf.AttachmentLiveTime > 0 && conf.AttachmentLiveTime < min {
+		logf("attachment_live_time %s is under the minimum of %s, raising it", conf.AttachmentLiveTime, min)
+		conf.AttachmentLiveTime = min
+	}
+	if conf.ShortLiveTime > 0 && conf.ShortLiveTime < min {
+		logf("short_live_time %s is under the minimum of %s, raising it", conf.ShortLiveTime, min)
+		conf.ShortLiveTime = min
+	}
+	var roleTimes map[string]time.Duration
+	for role, d := range conf.RoleLiveTimes {
+		if d > 0 && d < min {
+			logf("live time %s for role %s is under the minimum of %s, raising it", d, role, min)
+			d = min
+		}
+		if roleTimes == nil {
+			// Copied, as the caller's map may be live
+			roleTimes = make(map[string]time.Duration, len(conf.RoleLiveTimes))
+		}
+		roleTimes[role] = d
+	}
+	conf.RoleLiveTimes = roleTimes
+	return conf
+}
+
+// sameChannelConfig reports whether two configs describe the same settings
+// once InitChannel has applied them.
+func (b *Bot) sameChannelConfig(x, y managedChannelMarshal) bool {
+	x = b.normalizeChannelConfig(x, nil)
+	y = b.normalizeChannelConfig(y, nil)
+	x.PolicyMode = parsePolicyMode(x.PolicyMode).String()
+	y.PolicyMode = parsePolicyMode(y.PolicyMode).String()
+	x.SystemMessages = parseSystemMode(x.SystemMessages).String()
+	y.SystemMessages = parseSystemMode(y.SystemMessages).String()
+	x.Action = parseReapAction(x.Action).String()
+	y.Action = parseReapAction(y.Action).String()
+	if len(x.KeepUsers) == 0 && len(y.KeepUsers) == 0 {
+		x.KeepUsers, y.KeepUsers = nil, nil
+	}
+	if len(x.RoleLiveTimes) == 0 && len(y.RoleLiveTimes) == 0 {
+		x.RoleLiveTimes, y.RoleLiveTimes = nil, nil
+	}
+	return reflect.DeepEqual(x, y)
+}
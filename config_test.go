@@ -0,0 +1,90 @@
+package autodelete
+
+import (
+	"testing"
+	"time"
+)
+
+// A saved config that InitChannel will clamp is the same as the clamped one
+// that is running.
+func TestSameChannelConfigNormalizes(t *testing.T) {
+	b := &Bot{}
+	saved := managedChannelMarshal{
+		ID:            "1",
+		LiveTime:      time.Minute,
+		MaxMessages:   10,
+		KeepMessages:  20,
+		RoleLiveTimes: map[string]time.Duration{"2": time.Minute},
+	}
+	running := managedChannelMarshal{
+		ID:            "1",
+		LiveTime:      defaultMinRetention,
+		MaxMessages:   10,
+		KeepMessages:  10,
+		PolicyMode:    parsePolicyMode("").String(),
+		Action:        parseReapAction("").String(),
+		RoleLiveTimes: map[string]time.Duration{"2": defaultMinRetention},
+	}
+	if !b.sameChannelConfig(saved, running) {
+		t.Errorf("clamped config reported as changed")
+	}
+	if saved.RoleLiveTimes["2"] != time.Minute {
+		t.Errorf("comparing changed the caller's map")
+	}
+
+	running.LiveTime = 2 * defaultMinRetention
+	if b.sameChannelConfig(saved, running) {
+		t.Errorf("different live_time reported as the same")
+	}
+}
+
+// Deadlines saved at shutdown are picked up again by the next run. Ones that
+// passed in between come due within the next minute, and channels that are
+// gone are dropped.
+func TestQueueStateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	first, clock := newTestBot()
+	first.Config.DataDir = dir
+	now := clock.Now()
+	want := map[string]time.Time{
+		"10": now.Add(time.Hour),
+		"11": now.Add(2 * time.Hour),
+		"12": now.Add(time.Minute),
+		"13": now.Add(3 * time.Hour),
+	}
+	for id, at := range want {
+		first.reaper.Update(testChannel(id), at)
+	}
+	if err := first.saveQueueState(first.reaper.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	first.reaper.stop()
+
+	second, clock := newTestBot()
+	defer second.reaper.stop()
+	second.Config.DataDir = dir
+	clock.Advance(10 * time.Minute)
+	second.loadQueueState()
+	for _, id := range []string{"10", "11", "12"} {
+		ch := testChannel(id)
+		ch.bot = second
+		ch.MessageLiveTime = 24 * time.Hour
+		second.channels[id] = ch
+		second.QueueReap(ch)
+	}
+	if n := second.reaper.dropRestored(); n != 1 {
+		t.Errorf("dropped %d deadlines for missing channels, want 1", n)
+	}
+	got := make(map[string]time.Time)
+	for _, e := range second.reaper.Snapshot() {
+		got[e.ChannelID] = e.NextReap
+	}
+	for _, id := range []string{"10", "11"} {
+		if !got[id].Equal(want[id]) {
+			t.Errorf("channel %s: deadline %s after restart, want %s", id, got[id], want[id])
+		}
+	}
+	if at := got["12"]; at.Before(clock.Now()) || !at.Before(clock.Now().Add(time.Minute)) {
+		t.Errorf("passed deadline restored as %s, want within a minute of %s", at, clock.Now())
+	}
+}
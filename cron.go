@@ -0,0 +1,206 @@
+package autodelete
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cronSchedule is a standard five-field cron expression (minute, hour, day
+// of month, month, day of week) evaluated in a time zone.
+type cronSchedule struct {
+	expr string
+	loc  *time.Location
+
+	minute, hour, dom, month, dow uint64
+	// As in cron, if both day fields are restricted a day matching either
+	// one will do.
+	domStar, dowStar bool
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCron parses a cron expression. A nil loc means UTC.
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	s := &cronSchedule{expr: expr, loc: loc}
+	full := expr
+	if v, ok := cronShorthands[strings.ToLower(expr)]; ok {
+		full = v
+	}
+	fields := strings.Fields(full)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q: want 5 fields, got %d", expr, len(fields))
+	}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron minute: %v", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron hour: %v", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron day of month: %v", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("cron month: %v", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("cron day of week: %v", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		// 7 is Sunday too
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseCronField turns a field like "1-5", "*/15" or "mon,wed,fri" into a
+// bitset. names, if given, are accepted for the values starting at min.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			lo, err = cronValue(bounds[0], min, names)
+			if err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = cronValue(bounds[1], min, names)
+				if err != nil {
+					return 0, err
+				}
+			} else if step != 1 {
+				// "5/10" means from 5 to the end
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, min int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return i + min, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	return n, nil
+}
+
+func (s *cronSchedule) String() string {
+	return s.expr
+}
+
+func (s *cronSchedule) dayMatches(y int, m time.Month, d int) bool {
+	if s.month&(1<<uint(m)) == 0 {
+		return false
+	}
+	domOK := s.dom&(1<<uint(d)) != 0
+	wd := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Weekday()
+	dowOK := s.dow&(1<<uint(wd)) != 0
+	if !s.domStar && !s.dowStar {
+		return domOK || dowOK
+	}
+	return domOK && dowOK
+}
+
+// How far ahead Next looks before giving up on an expression that never
+// matches, like February 30th.
+const cronSearchDays = 5 * 366
+
+// Next returns the first time the schedule fires after t, or the zero time if
+// it never does.
+//
+// Times are matched against the wall clock in the schedule's zone. A time
+// skipped by a DST change fires at the matching instant after the jump (2:30
+// becomes 3:30), and a time that happens twice fires only once, so a change
+// never causes a double or missed run.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	local := t.In(s.loc)
+	y, m, d := local.Date()
+	// Step through calendar days in UTC, where every day is 24 hours long.
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < cronSearchDays; i++ {
+		y, m, d = day.Date()
+		if s.dayMatches(y, m, d) {
+			if next, ok := s.nextInDay(y, m, d, t); ok {
+				return next
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// nextInDay finds the earliest firing on the given day that is after t.
+func (s *cronSchedule) nextInDay(y int, m time.Month, d int, t time.Time) (time.Time, bool) {
+	var best time.Time
+	for h := 0; h < 24; h++ {
+		if s.hour&(1<<uint(h)) == 0 {
+			continue
+		}
+		for min := 0; min < 60; min++ {
+			if s.minute&(1<<uint(min)) == 0 {
+				continue
+			}
+			c := time.Date(y, m, d, h, min, 0, 0, s.loc)
+			if want, got := h*60+min, c.Hour()*60+c.Minute(); c.Day() == d && got < want {
+				// In a DST gap, time.Date may pick the instant
+				// before the jump. Move it to the one after.
+				c = c.Add(time.Duration(want-got) * time.Minute)
+			}
+			if !c.After(t) {
+				continue
+			}
+			if best.IsZero() || c.Before(best) {
+				best = c
+			}
+			if c.Hour() == h && c.Minute() == min {
+				// Not moved by a DST gap, so nothing later in
+				// the day can be sooner.
+				return best, true
+			}
+		}
+	}
+	return best, !best.IsZero()
+}
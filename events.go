@@ -14,18 +14,25 @@ func (b *Bot) ConnectDiscord() error {
 	if err != nil {
 		return err
 	}
-	b.s = s
 	s.AddHandler(b.OnReady)
 	s.AddHandler(b.OnResume)
+	s.AddHandler(b.OnDisconnect)
 	s.AddHandler(b.OnChannelCreate)
+	s.AddHandler(b.OnChannelUpdate)
+	s.AddHandler(b.OnChannelDelete)
 	s.AddHandler(b.OnChannelPins)
 	s.AddHandler(b.HandleMentions)
 	s.AddHandler(b.OnMessage)
+	s.AddHandler(b.OnMessageUpdate)
+	s.AddHandler(b.OnReactionAdd)
 	me, err := s.User("@me")
 	if err != nil {
 		return errors.Wrap(err, "get me")
 	}
-	b.me = me
+	err = b.ConnectSession(s, me)
+	if err != nil {
+		return err
+	}
 
 	err = s.Open()
 	if err != nil {
@@ -34,6 +41,23 @@ func (b *Bot) ConnectDiscord() error {
 	return nil
 }
 
+// ConnectSession makes the bot use an existing session, acting as the user
+// me, and opens the config store. It doesn't add event handlers or open the
+// gateway; ConnectDiscord does that. Tests use it to talk to a fake API.
+func (b *Bot) ConnectSession(s *discordgo.Session, me *discordgo.User) error {
+	err := b.openStore()
+	if err != nil {
+		return errors.Wrap(err, "open config database")
+	}
+	b.s = s
+	b.me = me
+	b.client = sessionClient{s}
+	if b.Config.Client != nil {
+		b.client = b.Config.Client
+	}
+	return nil
+}
+
 func (b *Bot) HandleMentions(s *discordgo.Session, m *discordgo.MessageCreate) {
 	found := false
 	for _, v := range m.Message.Mentions {
@@ -98,8 +122,44 @@ func (b *Bot) OnMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
 	}
 }
 
+func (b *Bot) OnMessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh != nil {
+		mCh.UpdateMessage(m.Message)
+	}
+}
+
+func (b *Bot) OnReactionAdd(s *discordgo.Session, ev *discordgo.MessageReactionAdd) {
+	b.mu.RLock()
+	mCh := b.channels[ev.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil || !mCh.isTriggerEmoji(&ev.Emoji) {
+		return
+	}
+
+	msg, err := s.ChannelMessage(ev.ChannelID, ev.MessageID)
+	if err != nil {
+		fmt.Println("[reac] could not fetch message", ev.ChannelID, ev.MessageID, err)
+		return
+	}
+	if mCh.reactionTriggered(msg) {
+		go b.reapMessages(mCh, []string{ev.MessageID})
+	}
+}
+
 func (b *Bot) OnChannelCreate(s *discordgo.Session, ch *discordgo.ChannelCreate) {
-	// No action, need a config message
+	// Otherwise no action, need a config message
+	go b.channelCreated(ch.Channel)
+}
+
+func (b *Bot) OnChannelUpdate(s *discordgo.Session, ch *discordgo.ChannelUpdate) {
+	go b.channelUpdated(ch.Channel)
+}
+
+func (b *Bot) OnChannelDelete(s *discordgo.Session, ch *discordgo.ChannelDelete) {
+	go b.channelDeleted(ch.Channel)
 }
 
 func (b *Bot) OnChannelPins(s *discordgo.Session, ev *discordgo.ChannelPinsUpdate) {
@@ -122,15 +182,24 @@ func (b *Bot) OnReady(s *discordgo.Session, m *discordgo.Ready) {
 	}
 
 	go func() {
+		b.gatewayUp()
 		err := b.LoadChannelConfigs()
 		if err != nil {
 			fmt.Println("error loading configs:", err)
 		}
+		b.reconcileQueue()
 	}()
 }
 
+// OnDisconnect holds reaps while discordgo reconnects. They start again on
+// the next Ready or Resumed.
+func (b *Bot) OnDisconnect(s *discordgo.Session, d *discordgo.Disconnect) {
+	b.gatewayDown()
+}
+
 func (b *Bot) OnResume(s *discordgo.Session, r *discordgo.Resumed) {
 	fmt.Println("Reconnected!")
+	go b.gatewayUp()
 	go func() {
 		time.Sleep(3 * time.Second)
 		b.LoadAllBacklogs()
@@ -0,0 +1,151 @@
+package autodelete
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A ReapEvent is one line of the live event stream.
+type ReapEvent struct {
+	// "reap" after a channel is reaped, "queue" when the queue depth
+	// changes.
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	ChannelID string    `json:"channel_id,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	GuildID   string    `json:"guild_id,omitempty"`
+	Count     int       `json:"count,omitempty"`
+	// Seconds spent in Reap.
+	Duration   float64 `json:"duration,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	QueueDepth int     `json:"queue_depth"`
+}
+
+// Events buffered for each subscriber. One that falls further behind than
+// this is disconnected.
+const eventBufferSize = 64
+
+const eventWriteTimeout = 10 * time.Second
+
+// eventHub fans reap events out to websocket subscribers. Publishing never
+// blocks.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan []byte]struct{})}
+}
+
+func (h *eventHub) subscribe() chan []byte {
+	ch := make(chan []byte, eventBufferSize)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) publish(ev ReapEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	by, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- by:
+		default:
+			// Too slow; drop it rather than hold up the workers.
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishReap sends the result of a reap to the event stream.
+func (b *Bot) publishReap(ch *ManagedChannel, count int, took time.Duration, err error) {
+	ev := ReapEvent{
+		Type:       "reap",
+		Time:       time.Now(),
+		ChannelID:  ch.Channel.ID,
+		Channel:    ch.Channel.Name,
+		GuildID:    ch.Channel.GuildID,
+		Count:      count,
+		Duration:   took.Seconds(),
+		QueueDepth: b.reaper.Len(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	b.events.publish(ev)
+}
+
+// EventsHandler streams ReapEvents as JSON text messages over a websocket.
+// Clients authenticate with the configured token, either as a bearer token or
+// a token query parameter. It returns a 404 handler if no token is set.
+func (b *Bot) EventsHandler() http.Handler {
+	token := b.Config.EventsToken
+	if token == "" {
+		return http.NotFoundHandler()
+	}
+	upgrader := websocket.Upgrader{
+		// Browsers can't set headers on a websocket, so dashboards on
+		// other origins pass the token in the URL. It is the only guard.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sub := b.events.subscribe()
+
+		// Read and discard until the client goes away, so control
+		// frames are handled.
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					b.events.unsubscribe(sub)
+					return
+				}
+			}
+		}()
+
+		defer conn.Close()
+		for by := range sub {
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, by); err != nil {
+				b.events.unsubscribe(sub)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package autodelete
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A forum channel has no messages of its own: each post is a thread. A
+// managed forum tracks its open posts in place of messages, dated by when
+// they were started, so the usual age, count and keep limits apply to posts.
+// Pinned posts are kept unless DeletePinned is set.
+//
+// When a post is due it is deleted, or with ActionArchive archived. Deleting
+// removes the post and every message in it for good. Archiving only closes
+// it: it drops out of the forum's list, but anyone who can see the forum can
+// still find it and post to reopen it, and a reopened post is tracked again
+// from when it was started.
+//
+// Posts come from the same raw thread listing as threads do (see
+// thread.go), and syncThreads reloads each managed forum's posts. Forums
+// can't take commands, so they are set up with CommandForum from another
+// channel.
+
+// channelTypeGuildForum is also missing from the vendored discordgo.
+const channelTypeGuildForum discordgo.ChannelType = 15
+
+// channelFlagPinned marks the pinned post of a forum.
+const channelFlagPinned = 1 << 1
+
+func (c *ManagedChannel) isForum() bool {
+	return c.Channel.Type == channelTypeGuildForum
+}
+
+// loadPosts is loadFullBacklog for a forum: it replaces the tracked posts
+// with the forum's open ones.
+func (c *ManagedChannel) loadPosts() error {
+	threads, err := c.bot.client.ActiveThreads(c.Channel.GuildID)
+	if err != nil {
+		fmt.Println("could not load posts for", c.Channel.ID, err)
+		return err
+	}
+
+	defer c.bot.QueueReap(c)    // requires mutex unlocked
+	defer c.bot.checkBacklog(c) // same
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.liveMessages = nil
+	c.pinMessages = nil
+	for _, th := range threads {
+		if th.ParentID != c.Channel.ID || th.Metadata.Archived {
+			continue
+		}
+		if idLess(c.lastSeenID, th.ID) {
+			c.lastSeenID = th.ID
+		}
+		ts := snowflakeTime(th.ID)
+		if th.Flags&channelFlagPinned != 0 && c.KeepPinned {
+			c.pinMessages = append(c.pinMessages, smallMessage{MessageID: th.ID, PostedAt: ts})
+			continue
+		}
+		if ts.Before(c.EffectiveFrom) {
+			continue
+		}
+		c.liveMessages = append(c.liveMessages, smallMessage{MessageID: th.ID, PostedAt: ts})
+	}
+	// By ID, not PostedAt: posts started in the same millisecond have the
+	// same date
+	sort.Slice(c.liveMessages, func(i, j int) bool { return idLess(c.liveMessages[i].MessageID, c.liveMessages[j].MessageID) })
+
+	inited := "reloaded"
+	select {
+	case <-c.isStarted:
+	default:
+		close(c.isStarted)
+		inited = "initialized"
+	}
+	fmt.Printf("[load] %s #%s %s, %d posts %d pinned\n", c.Channel.ID, c.Channel.Name, inited, len(c.liveMessages), len(c.pinMessages))
+	return nil
+}
+
+// reapPosts is Reap for a forum: it deletes or archives each post, one call
+// per post. Posts that are already gone are skipped.
+func (c *ManagedChannel) reapPosts(ctx context.Context, posts []string) ReapResult {
+	var res ReapResult
+	archive := c.reapAction() == ActionArchive
+	for i, post := range posts {
+		limited, err := c.withRetry(ctx, func() error {
+			if archive {
+				return c.bot.client.ThreadArchive(post)
+			}
+			_, err := c.bot.client.ChannelDelete(post)
+			return err
+		})
+		res.RateLimited += limited
+		if isErrorCode(err, discordgo.ErrCodeUnknownChannel) {
+			res.Skipped++
+			continue
+		} else if err != nil {
+			res.Err = err
+			res.Failed = posts[i:]
+			return res
+		}
+		if archive {
+			res.Archived++
+		} else {
+			res.SingleDeleted++
+		}
+	}
+	return res
+}
@@ -0,0 +1,138 @@
+package autodelete_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+func TestForumPostsDeleted(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{GuildWorkers: -1})
+	general := h.AddChannel("general")
+	forum := h.AddForum("forum")
+	first := h.AddThread(forum, "first")
+	second := h.AddThread(forum, "second")
+	pinned := h.AddThread(forum, "pinned")
+	h.PinPost(pinned)
+
+	h.Command(general, "forum", "<#"+forum+">", "1h", "keep:1")
+	waitQueued(t, h, forum, true)
+	h.Advance(61 * time.Minute)
+	if got := h.WaitDeleted(1); len(got) != 1 || got[0] != first {
+		t.Fatalf("deleted %v, want %s", got, first)
+	}
+
+	// New posts are found by syncing, and the newest is kept
+	third := h.AddThread(forum, "third")
+	h.Bot.SyncThreads()
+	h.Advance(61 * time.Minute)
+	h.WaitDeleted(2)
+	time.Sleep(50 * time.Millisecond)
+	got := h.Deleted()
+	if len(got) != 2 || got[1] != second {
+		t.Errorf("deleted %v, want %s then %s; %s and pinned %s kept", got, first, second, third, pinned)
+	}
+}
+
+func TestForumPostsArchived(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{GuildWorkers: -1})
+	general := h.AddChannel("general")
+	forum := h.AddForum("forum")
+	post := h.AddThread(forum, "post")
+	h.Post(post, "hello")
+
+	h.Command(general, "forum", "<#"+forum+">", "1h", "action:archive")
+	waitQueued(t, h, forum, true)
+	h.Advance(61 * time.Minute)
+	h.WaitRequest("PATCH", "channels/"+post, 1)
+	if !h.Archived(post) {
+		t.Error("post was not archived")
+	}
+	if n := len(h.Messages(post)); n != 1 {
+		t.Errorf("archived post has %d messages, want 1", n)
+	}
+	if got := h.Deleted(); len(got) != 0 {
+		t.Errorf("deleted %v, want nothing", got)
+	}
+
+	// A reopened post is still due
+	h.ArchiveThread(post, false)
+	h.Bot.SyncThreads()
+	h.WaitRequest("PATCH", "channels/"+post, 2)
+}
+
+func TestForumCommandChecksChannel(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{})
+	general := h.AddChannel("general")
+	other := h.AddChannel("other")
+	h.Command(general, "forum", "<#"+other+">", "1h")
+	time.Sleep(50 * time.Millisecond)
+	if queued(h, other) {
+		t.Error("text channel was set up as a forum")
+	}
+}
+
+// postClient serves one forum's posts and records deletes, to show forum
+// loads and reaps go through Config.Client.
+type postClient struct {
+	flakyClient
+	mu      sync.Mutex
+	forum   string
+	posts   []string
+	removed []string
+}
+
+func (c *postClient) ActiveThreads(guildID string) ([]autodelete.Thread, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []autodelete.Thread
+	for _, id := range c.posts {
+		out = append(out, autodelete.Thread{ID: id, ParentID: c.forum})
+	}
+	return out, nil
+}
+
+func (c *postClient) ChannelDelete(channelID string) (*discordgo.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removed = append(c.removed, channelID)
+	return &discordgo.Channel{ID: channelID}, nil
+}
+
+func TestForumReapUsesClient(t *testing.T) {
+	client := &postClient{}
+	h := autodeletetest.New(t, autodelete.Config{Client: client, GuildWorkers: -1})
+	general := h.AddChannel("general")
+	forum := h.AddForum("forum")
+	post := h.AddThread(forum, "post")
+	client.mu.Lock()
+	client.forum, client.posts = forum, []string{post}
+	client.mu.Unlock()
+
+	h.Command(general, "forum", "<#"+forum+">", "1h")
+	waitQueued(t, h, forum, true)
+	h.Advance(61 * time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.mu.Lock()
+		removed := append([]string(nil), client.removed...)
+		client.mu.Unlock()
+		if len(removed) > 0 {
+			if removed[0] != post {
+				t.Errorf("deleted %v, want %s", removed, post)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("post was not deleted through the client")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := h.Requests("DELETE", "channels/"+post); n != 0 {
+		t.Errorf("deleted the post through the session %d times", n)
+	}
+}
@@ -0,0 +1,159 @@
+package autodelete
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultHealthTimeout = 10 * time.Minute
+
+type healthStatus struct {
+	OK     bool `json:"ok"`
+	Paused bool `json:"paused"`
+	// Set while reaps are held for a gateway reconnect. That counts as
+	// healthy until it has gone on for the health timeout.
+	WaitingForGateway bool      `json:"waiting_for_gateway"`
+	GatewayLost       time.Time `json:"gateway_lost,omitempty"`
+	LastTick          time.Time `json:"last_tick"`
+	QueueLength       int       `json:"queue_length"`
+	Workers           int       `json:"workers"`
+}
+
+// HealthHandler reports whether the reap scheduler is still making progress.
+// It responds 200 if the scheduler woke up recently (or reaping is paused),
+// and 503 otherwise, with a JSON body describing the queue.
+func (b *Bot) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := b.Config.HealthTimeout
+		if timeout <= 0 {
+			timeout = defaultHealthTimeout
+		}
+		st := healthStatus{
+			Paused:      b.reaper.isPaused(),
+			LastTick:    b.reaper.lastTickTime(),
+			QueueLength: b.reaper.Len(),
+			Workers:     b.workerCount(),
+		}
+		st.GatewayLost, st.WaitingForGateway = b.reaper.waitingForGateway()
+		now := b.now()
+		st.OK = st.Paused || now.Sub(st.LastTick) < timeout
+		if st.WaitingForGateway && now.Sub(st.GatewayLost) >= timeout {
+			st.OK = false
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !st.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(st)
+	})
+}
+
+var expvarOnce sync.Once
+
+// PublishExpvar adds the reaper's internals to expvar as "autodelete", for a
+// quick look at /debug/vars without Prometheus. expvar names are global, so
+// only the first Bot to call this is published.
+func (b *Bot) PublishExpvar() {
+	expvarOnce.Do(func() {
+		expvar.Publish("autodelete", expvar.Func(func() interface{} {
+			return map[string]interface{}{
+				"queue_length": b.reaper.Len(),
+				"in_flight":    b.reaper.inFlight(),
+				"workers":      b.workerCount(),
+				"reaps":        b.reaper.reapCount(),
+				"paused":       b.reaper.isPaused(),
+				"waiting_for_gateway": func() bool {
+					_, waiting := b.reaper.waitingForGateway()
+					return waiting
+				}(),
+			}
+		}))
+	})
+}
+
+// A deleteWindow counts deletions over the last hour, in one-minute buckets.
+// The zero value is ready to use.
+type deleteWindow struct {
+	mu      sync.Mutex
+	buckets [60]int
+	// the minute, in Unix minutes, that each bucket is counting
+	minutes [60]int64
+}
+
+func (w *deleteWindow) add(now time.Time, n int) {
+	if n == 0 {
+		return
+	}
+	minute := now.Unix() / 60
+	i := minute % int64(len(w.buckets))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.minutes[i] != minute {
+		w.minutes[i], w.buckets[i] = minute, 0
+	}
+	w.buckets[i] += n
+}
+
+// lastHour returns how many deletions were added in the hour before now.
+func (w *deleteWindow) lastHour(now time.Time) int {
+	minute := now.Unix() / 60
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	total := 0
+	for i, m := range w.minutes {
+		if minute-m < int64(len(w.buckets)) {
+			total += w.buckets[i]
+		}
+	}
+	return total
+}
+
+// A botSummary is the bot-wide picture shown by the health command.
+type botSummary struct {
+	Channels, Disabled int
+	Tracked            int
+	DeletedLastHour    int
+	QueueLength        int
+	// The channel that has waited longest past its deadline, if any
+	Overdue      *ManagedChannel
+	OverdueSince time.Time
+	BusyWorkers  int
+	Workers      int
+	Paused       bool
+	WaitingSince time.Time
+}
+
+func (b *Bot) summary() botSummary {
+	now := b.now()
+	sum := botSummary{
+		DeletedLastHour: b.reaper.recent.lastHour(now),
+		QueueLength:     b.reaper.Len(),
+		BusyWorkers:     b.reaper.busyWorkers(),
+		Workers:         b.workerCount(),
+		Paused:          b.reaper.isPaused(),
+	}
+	sum.WaitingSince, _ = b.reaper.waitingForGateway()
+	sum.Overdue, sum.OverdueSince, _ = b.reaper.mostOverdue(now)
+
+	b.mu.RLock()
+	var chans []*ManagedChannel
+	for _, mCh := range b.channels {
+		if mCh == nil {
+			sum.Disabled++
+		} else {
+			chans = append(chans, mCh)
+		}
+	}
+	b.mu.RUnlock()
+	sum.Channels = len(chans)
+	for _, mCh := range chans {
+		mCh.mu.Lock()
+		sum.Tracked += len(mCh.liveMessages)
+		mCh.mu.Unlock()
+	}
+	return sum
+}
@@ -0,0 +1,156 @@
+// Package metrics is a minimal Prometheus-compatible metrics registry for the
+// reaper. It only implements what the bot needs: counters, gauges and
+// fixed-bucket histograms, served in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// A Registry holds a set of metrics and serves them over HTTP.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	sort.Slice(r.collectors, func(i, j int) bool {
+		return r.collectors[i].name() < r.collectors[j].name()
+	})
+	r.mu.Unlock()
+}
+
+// ServeHTTP writes all registered metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.mu.Lock()
+	cs := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+// A Counter is a monotonically increasing value.
+type Counter struct {
+	n, help string
+	v       uint64
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{n: name, help: help}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc()         { atomic.AddUint64(&c.v, 1) }
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.v, n) }
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) name() string { return c.n }
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.n, c.help, c.n, c.n, c.Value())
+}
+
+// A Gauge is a value that can go up and down.
+type Gauge struct {
+	n, help string
+	bits    uint64
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{n: name, help: help}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) name() string { return g.n }
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.n, g.help, g.n, g.n, g.Value())
+}
+
+// A Histogram counts observations into fixed, cumulative buckets.
+type Histogram struct {
+	n, help string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the given upper bounds, which must be
+// sorted in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{n: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *Histogram) name() string { return h.n }
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.n, h.help, h.n)
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.n, upper, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.n, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.n, h.sum, h.n, h.count)
+}
+
+// Default is the registry the bot's metrics live in.
+var Default = NewRegistry()
+
+var (
+	MessagesDeleted = Default.NewCounter("autodelete_messages_deleted_total", "Messages deleted by the reaper.")
+	MessagesSkipped = Default.NewCounter("autodelete_messages_skipped_total", "Messages that were already gone when the reaper tried to delete them.")
+	ReapErrors      = Default.NewCounter("autodelete_reap_errors_total", "Reaps that ended in an error.")
+	RateLimitHits   = Default.NewCounter("autodelete_rate_limit_hits_total", "Delete calls that were rate limited.")
+	ReapDuration    = Default.NewHistogram("autodelete_reap_duration_seconds", "Time spent in a single Reap call.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300})
+	LimiterWaits       = Default.NewCounter("autodelete_limiter_waits_total", "Delete calls that had to wait for the rate limiter.")
+	LimiterWaitSeconds = Default.NewHistogram("autodelete_limiter_wait_seconds", "Time spent waiting for the rate limiter.",
+		[]float64{0.1, 0.5, 1, 2.5, 5, 10, 30})
+	QueueDepth       = Default.NewGauge("autodelete_queue_depth", "Channels waiting in the reap queue.")
+	DeleteBudgetUsed = Default.NewGauge("autodelete_delete_budget_used", "Deletions counted against the bot-wide budget in the current window.")
+	QueueStaleness   = Default.NewGauge("autodelete_queue_staleness_seconds", "How long the most overdue channel has been waiting past its deadline.")
+	GatewayWaiting   = Default.NewGauge("autodelete_gateway_waiting", "1 while reaps are held waiting for the Discord gateway to reconnect.")
+)
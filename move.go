@@ -0,0 +1,125 @@
+package autodelete
+
+import (
+	"context"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A channel with MoveTo set has each message re-posted to the archive
+// channel before it is deleted, through a webhook so the copy shows the
+// original author's name and avatar. Messages are moved oldest first, and
+// only the ones that made it across are deleted; if a re-post fails, the
+// rest stay in the channel and are tried again later.
+
+const moveWebhookName = "AutoDelete"
+
+// Discord's limit on message length.
+const maxMessageLength = 2000
+
+func (c *ManagedChannel) moveTarget() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.MoveTo
+}
+
+// moveWebhook returns the webhook used to post into an archive channel,
+// creating it the first time.
+func (b *Bot) moveWebhook(channelID string) (*discordgo.Webhook, error) {
+	b.webhookMu.Lock()
+	defer b.webhookMu.Unlock()
+	if w, ok := b.webhooks[channelID]; ok {
+		return w, nil
+	}
+	hooks, err := b.s.ChannelWebhooks(channelID)
+	if err != nil {
+		return nil, err
+	}
+	var hook *discordgo.Webhook
+	for _, v := range hooks {
+		if v.Name == moveWebhookName && v.User != nil && b.me != nil && v.User.ID == b.me.ID && v.Token != "" {
+			hook = v
+			break
+		}
+	}
+	if hook == nil {
+		hook, err = b.s.WebhookCreate(channelID, moveWebhookName, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b.webhooks == nil {
+		b.webhooks = make(map[string]*discordgo.Webhook)
+	}
+	b.webhooks[channelID] = hook
+	return hook, nil
+}
+
+// forgetWebhook drops a cached webhook that stopped working, so the next
+// move looks it up again.
+func (b *Bot) forgetWebhook(channelID string) {
+	b.webhookMu.Lock()
+	delete(b.webhooks, channelID)
+	b.webhookMu.Unlock()
+}
+
+// moveMessages re-posts msgs, oldest first, to the channel's archive channel.
+// It returns how many made it before the first failure; only those may be
+// deleted.
+func (b *Bot) moveMessages(ctx context.Context, ch *ManagedChannel, msgs []string) (int, error) {
+	target := ch.moveTarget()
+	hook, err := b.moveWebhook(target)
+	if err != nil {
+		return 0, err
+	}
+	for i, a := range ch.archivedMessages(msgs) {
+		if a.Content == "" && len(a.Attachments) == 0 {
+			// Not seen since startup; look it up
+			m, err := b.s.ChannelMessage(ch.Channel.ID, a.ID)
+			if isUnknownMessage(err) {
+				// Already gone, nothing to move
+				continue
+			} else if err != nil {
+				return i, err
+			}
+			a = newArchivedMessage(ch.Channel.GuildID, m, a.Timestamp)
+		}
+		params := movedMessage(a)
+		_, err := ch.withRetry(ctx, func() error {
+			return b.s.WebhookExecute(hook.ID, hook.Token, true, params)
+		})
+		if err != nil {
+			if isErrorCode(err, errCodeUnknownWebhook) {
+				// The webhook was deleted
+				b.forgetWebhook(target)
+			}
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// movedMessage builds the webhook post for a message being moved.
+func movedMessage(a ArchivedMessage) *discordgo.WebhookParams {
+	content := a.Content
+	for _, v := range a.Attachments {
+		content += "\n" + v
+	}
+	if content == "" {
+		// Nothing but an embed, which we don't keep
+		content = "(no text)"
+	}
+	if r := []rune(content); len(r) > maxMessageLength {
+		content = string(r[:maxMessageLength-3]) + "..."
+	}
+	name := a.Author
+	if i := strings.LastIndexByte(name, '#'); i > 0 {
+		name = name[:i]
+	}
+	return &discordgo.WebhookParams{
+		Content:   content,
+		Username:  name,
+		AvatarURL: a.AvatarURL,
+	}
+}
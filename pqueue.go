@@ -0,0 +1,110 @@
+package autodelete
+
+import (
+	"time"
+)
+
+// A pqItem is an entry in a priorityQueue or readyQueue. The heaps only look
+// at the times, the key and the index; value is carried along for the
+// caller, a *ManagedChannel in the reapQueue.
+type pqItem[T any] struct {
+	value T
+	// key breaks ties between items with the same times, in snowflake
+	// order. The reapQueue uses the channel ID.
+	key      string
+	nextReap time.Time // The priority of the item in the queue.
+	// due is when the channel first came due. It is later than nextReap
+	// only for a channel that was put off because it couldn't be reaped
+	// yet; those keep their place among the other overdue channels.
+	due time.Time
+	// ready is set once nextReap has passed and the item has moved to the
+	// ready queue.
+	ready bool
+	// The index is needed by update and is maintained by the heap.Interface methods.
+	index int // The index of the item in the heap.
+}
+
+// A priorityQueue implements heap.Interface and holds pqItems, soonest
+// nextReap first. Items with the same time come out in key order.
+type priorityQueue[T any] []*pqItem[T]
+
+func (pq priorityQueue[T]) Len() int { return len(pq) }
+
+func (pq priorityQueue[T]) Less(i, j int) bool {
+	a, b := pq[i], pq[j]
+	if !a.nextReap.Equal(b.nextReap) {
+		return a.nextReap.Before(b.nextReap)
+	}
+	return idLess(a.key, b.key)
+}
+
+// idLess orders snowflake IDs numerically, oldest first, without parsing
+// them.
+func idLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func (pq priorityQueue[T]) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *priorityQueue[T]) Push(x interface{}) {
+	n := len(*pq)
+	item := x.(*pqItem[T])
+	item.index = n
+	*pq = append(*pq, item)
+}
+
+func (pq *priorityQueue[T]) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	item.index = -1 // for safety
+	*pq = old[0 : n-1]
+	return item
+}
+
+func (pq priorityQueue[T]) Peek() *pqItem[T] {
+	if len(pq) == 0 {
+		return nil
+	}
+	return pq[0]
+}
+
+// A readyQueue holds the channels that are already due, oldest deadline
+// first, so overdue channels are reaped in the order they came due no matter
+// how often they were put off.
+type readyQueue[T any] struct {
+	priorityQueue[T]
+}
+
+func (rq readyQueue[T]) Less(i, j int) bool {
+	a, b := rq.priorityQueue[i], rq.priorityQueue[j]
+	if !a.due.Equal(b.due) {
+		return a.due.Before(b.due)
+	}
+	if !a.nextReap.Equal(b.nextReap) {
+		return a.nextReap.Before(b.nextReap)
+	}
+	return idLess(a.key, b.key)
+}
+
+// The reapQueue's instantiations.
+type (
+	channelItem       = pqItem[*ManagedChannel]
+	channelQueue      = priorityQueue[*ManagedChannel]
+	channelReadyQueue = readyQueue[*ManagedChannel]
+)
+
+// channelKey is a channel's tie-breaker in the queues.
+func channelKey(ch *ManagedChannel) string {
+	if ch == nil || ch.Channel == nil {
+		return ""
+	}
+	return ch.Channel.ID
+}
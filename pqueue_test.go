@@ -0,0 +1,109 @@
+package autodelete
+
+import (
+	"container/heap"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var pqBase = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func pqAt(min int) time.Time { return pqBase.Add(time.Duration(min) * time.Minute) }
+
+func testItem(key string, nextReap, due time.Time) *pqItem[string] {
+	return &pqItem[string]{value: "v" + key, key: key, nextReap: nextReap, due: due}
+}
+
+// popAll empties h, returning the keys in the order they came out.
+func popAll(t *testing.T, h heap.Interface) []string {
+	t.Helper()
+	var keys []string
+	for h.Len() > 0 {
+		it := heap.Pop(h).(*pqItem[string])
+		if it.index != -1 {
+			t.Errorf("popped %s still has index %d", it.key, it.index)
+		}
+		if it.value != "v"+it.key {
+			t.Errorf("popped %s with value %q", it.key, it.value)
+		}
+		keys = append(keys, it.key)
+	}
+	return keys
+}
+
+func TestPriorityQueuePushPop(t *testing.T) {
+	pq := new(priorityQueue[string])
+	for i, min := range []int{5, 1, 4, 2, 3} {
+		heap.Push(pq, testItem(string(rune('a'+i)), pqAt(min), pqAt(min)))
+	}
+	if got, want := popAll(t, pq), []string{"b", "d", "e", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+	if pq.Peek() != nil {
+		t.Errorf("Peek on an empty queue returned an item")
+	}
+}
+
+func TestPriorityQueuePeek(t *testing.T) {
+	pq := new(priorityQueue[string])
+	heap.Push(pq, testItem("a", pqAt(2), pqAt(2)))
+	heap.Push(pq, testItem("b", pqAt(1), pqAt(1)))
+	if it := pq.Peek(); it == nil || it.key != "b" {
+		t.Fatalf("Peek: got %v, want b", it)
+	}
+	if pq.Len() != 2 {
+		t.Errorf("Peek removed an item")
+	}
+}
+
+func TestPriorityQueueFix(t *testing.T) {
+	pq := new(priorityQueue[string])
+	items := map[string]*pqItem[string]{}
+	for i, key := range []string{"a", "b", "c", "d"} {
+		items[key] = testItem(key, pqAt(i), pqAt(i))
+		heap.Push(pq, items[key])
+	}
+	for _, it := range *pq {
+		if (*pq)[it.index] != it {
+			t.Fatalf("%s has index %d, but is not there", it.key, it.index)
+		}
+	}
+	items["a"].nextReap = pqAt(10)
+	heap.Fix(pq, items["a"].index)
+	items["d"].nextReap = pqAt(-1)
+	heap.Fix(pq, items["d"].index)
+	heap.Remove(pq, items["c"].index)
+	if got, want := popAll(t, pq), []string{"d", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+}
+
+// Items with the same time come out in snowflake order, however they went in.
+func TestPriorityQueueStable(t *testing.T) {
+	keys := []string{"1000", "999", "1002", "1001", "998"}
+	want := []string{"998", "999", "1000", "1001", "1002"}
+	for round := 0; round < len(keys); round++ {
+		pq := new(priorityQueue[string])
+		for i := range keys {
+			key := keys[(i+round)%len(keys)]
+			heap.Push(pq, testItem(key, pqAt(0), pqAt(0)))
+		}
+		if got := popAll(t, pq); !reflect.DeepEqual(got, want) {
+			t.Errorf("round %d: popped %v, want %v", round, got, want)
+		}
+	}
+}
+
+// The ready queue goes by when items first came due, then by deadline.
+func TestReadyQueueOrder(t *testing.T) {
+	rq := new(readyQueue[string])
+	heap.Push(rq, testItem("a", pqAt(5), pqAt(1)))
+	heap.Push(rq, testItem("b", pqAt(2), pqAt(2)))
+	heap.Push(rq, testItem("c", pqAt(3), pqAt(1)))
+	heap.Push(rq, testItem("d", pqAt(3), pqAt(1)))
+	heap.Push(rq, testItem("e", pqAt(0), pqAt(0)))
+	if got, want := popAll(t, rq), []string{"e", "c", "d", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+}
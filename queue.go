@@ -2,192 +2,1331 @@ package autodelete
 
 import (
 	"container/heap"
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/riking/AutoDelete/metrics"
 )
 
-// An Item is something we manage in a priority queue.
-type pqItem struct {
-	ch       *ManagedChannel
-	nextReap time.Time // The priority of the item in the queue.
-	// The index is needed by update and is maintained by the heap.Interface methods.
-	index int // The index of the item in the heap.
+// A reapWorkItem is a claimed channel waiting for a worker. The worker picks
+// the messages to delete when it starts, so they are up to date, and takes at
+// most Config.ReapChunkSize of them; the channel then goes to the back of the
+// line for the rest.
+//
+// A part is a share of a claimed channel's messages handed to an idle worker
+// by the one that claimed it, see reapHelpers. It carries its messages, and
+// the result goes back on done.
+type reapWorkItem struct {
+	ch   *ManagedChannel
+	msgs []string
+	done chan ReapResult
 }
 
-// A priorityQueue implements heap.Interface and holds Items.
-type priorityQueue []*pqItem
+type reapQueue struct {
+	items *channelQueue
+	// ready holds the items whose time has come, waiting to be handed out.
+	ready *channelReadyQueue
+	// index maps each channel to its heap entry. Protected by cond.L.
+	index map[*ManagedChannel]*channelItem
+	// overdue remembers when each channel handed out by WaitForNextBatch
+	// came due, until it is reaped, so Defer can keep its place.
+	// Protected by cond.L.
+	overdue map[*ManagedChannel]time.Time
+	cond    *sync.Cond
+	// workCh is created by reapScheduler, buffered to the worker count.
+	workCh chan reapWorkItem
+	// helpCh hands parts to idle workers. It is unbuffered, so a part is
+	// only handed off if a worker is waiting for it.
+	helpCh chan reapWorkItem
 
-func (pq priorityQueue) Len() int { return len(pq) }
+	curMu sync.Mutex
+	// curWork holds the channels being reaped, and when each was claimed.
+	curWork map[*ManagedChannel]time.Time
+	// curGuild counts the entries in curWork for each guild ID.
+	curGuild map[string]int
 
-func (pq priorityQueue) Less(i, j int) bool {
-	// We want Pop to give us the highest, not lowest, priority so we use greater than here.
-	return pq[i].nextReap.Before(pq[j].nextReap)
+	log   *slog.Logger
+	clock Clock
+	// slack is added to every scheduler sleep. Timers may fire a little
+	// early on some systems; waking before the head of the queue is due
+	// would just mean going straight back to sleep for the remainder.
+	slack time.Duration
+
+	// paused is non-zero while reaping is suspended. Accessed atomically.
+	paused int32
+	// gatewayLost is when the gateway connection dropped, in UnixNano, or
+	// zero while it is up. Nothing is dispatched until it is back, since
+	// the calls would just fail. Accessed atomically.
+	gatewayLost int64
+	// lastTick is when the scheduler last woke, in UnixNano. Accessed atomically.
+	lastTick int64
+	// reaps counts finished calls to Reap. Accessed atomically.
+	reaps uint64
+	// busy counts the workers deleting right now. Accessed atomically.
+	busy int32
+	// recent counts deletions over the last hour
+	recent deleteWindow
+
+	// done is closed when the bot is shutting down.
+	done     chan struct{}
+	stopOnce sync.Once
+	// wg tracks the scheduler and the workers.
+	wg sync.WaitGroup
+
+	// restored holds deadlines saved by a previous run, keyed by channel
+	// ID, until the channel is first queued. Protected by cond.L.
+	restored map[string]time.Time
 }
 
-func (pq priorityQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].index = i
-	pq[j].index = j
+// A QueueEntry is a channel waiting in the reap queue. It is also the
+// on-disk form of the queue saved at shutdown.
+type QueueEntry struct {
+	ChannelID string    `yaml:"channel_id"`
+	NextReap  time.Time `yaml:"next_reap"`
 }
 
-func (pq *priorityQueue) Push(x interface{}) {
-	n := len(*pq)
-	item := x.(*pqItem)
-	item.index = n
-	*pq = append(*pq, item)
+func newReapQueue(log *slog.Logger) *reapQueue {
+	var locker sync.Mutex
+	q := &reapQueue{
+		log:      log,
+		clock:    realClock{},
+		slack:    defaultTimerSlack,
+		items:    new(channelQueue),
+		ready:    new(channelReadyQueue),
+		index:    make(map[*ManagedChannel]*channelItem),
+		overdue:  make(map[*ManagedChannel]time.Time),
+		cond:     sync.NewCond(&locker),
+		curWork:  make(map[*ManagedChannel]time.Time),
+		curGuild: make(map[string]int),
+		done:     make(chan struct{}),
+	}
+	heap.Init(q.items)
+	heap.Init(q.ready)
+	return q
 }
 
-func (pq *priorityQueue) Pop() interface{} {
-	old := *pq
-	n := len(old)
-	item := old[n-1]
-	item.index = -1 // for safety
-	*pq = old[0 : n-1]
-	return item
+// Update adds or inserts the expiry time for the given item in the queue.
+func (q *reapQueue) Update(ch *ManagedChannel, t time.Time) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.set(ch, t, t)
 }
 
-func (pq priorityQueue) Peek() *pqItem {
-	if len(pq) == 0 {
-		return nil
+// Defer puts off a channel that was due but couldn't be reaped yet. Unlike
+// Update, the channel keeps the deadline it first came due at, so once t
+// passes it goes ahead of channels that came due after it.
+func (q *reapQueue) Defer(ch *ManagedChannel, t time.Time) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	due := t
+	if ov, ok := q.overdue[ch]; ok && ov.Before(due) {
+		due = ov
 	}
-	return pq[0]
+	if it, ok := q.index[ch]; ok && it.due.Before(due) {
+		due = it.due
+	}
+	q.set(ch, t, due)
 }
 
-type reapWorkItem struct {
-	ch   *ManagedChannel
-	msgs []string
+// set must be called with cond.L held.
+func (q *reapQueue) set(ch *ManagedChannel, t, due time.Time) {
+	if it, ok := q.index[ch]; ok {
+		if it.nextReap.Equal(t) && it.due.Equal(due) {
+			return
+		}
+		if it.ready {
+			// Back to waiting; it moves over again once t passes.
+			heap.Remove(q.ready, it.index)
+			it.ready = false
+			it.nextReap, it.due = t, due
+			heap.Push(q.items, it)
+		} else {
+			it.nextReap, it.due = t, due
+			heap.Fix(q.items, it.index)
+		}
+	} else {
+		it = &channelItem{
+			value:    ch,
+			key:      channelKey(ch),
+			nextReap: t,
+			due:      due,
+		}
+		heap.Push(q.items, it)
+		q.index[ch] = it
+	}
+	q.cond.Signal()
 }
 
-type reapQueue struct {
-	items  *priorityQueue
-	cond   *sync.Cond
-	timer  *time.Timer
-	workCh chan reapWorkItem
+// requeueIfQueued moves a channel that is already queued to time t, as a
+// fresh deadline. A channel that has been removed stays removed.
+func (q *reapQueue) requeueIfQueued(ch *ManagedChannel, t time.Time) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if it, ok := q.index[ch]; ok && it.nextReap.Before(t) {
+		q.set(ch, t, t)
+	}
+}
 
-	curMu   sync.Mutex
-	curWork map[*ManagedChannel]struct{}
+// reaped forgets the deadline a channel was handed out with, once it has
+// been reaped.
+func (q *reapQueue) reaped(ch *ManagedChannel) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	delete(q.overdue, ch)
 }
 
-func newReapQueue() *reapQueue {
-	var locker sync.Mutex
-	q := &reapQueue{
-		items:   new(priorityQueue),
-		cond:    sync.NewCond(&locker),
-		timer:   time.NewTimer(0),
-		workCh:  make(chan reapWorkItem),
-		curWork: make(map[*ManagedChannel]struct{}),
-	}
-	go func() {
-		// Signal the condition variable every time the timer expires.
-		for {
-			<-q.timer.C
-			q.cond.Signal()
-		}
-	}()
-	heap.Init(q.items)
-	return q
+const defaultTimerSlack = 2 * time.Millisecond
+
+// The scheduler wakes up at least this often, so the health check can tell
+// it is still alive.
+const maxSchedulerSleep = 1 * time.Minute
+
+// tick records that the scheduler is alive.
+func (q *reapQueue) tick() {
+	atomic.StoreInt64(&q.lastTick, q.clock.Now().UnixNano())
 }
 
-// Update adds or inserts the expiry time for the given item in the queue.
-func (q *reapQueue) Update(ch *ManagedChannel, t time.Time) {
+// lastTickTime returns when the scheduler last woke up.
+func (q *reapQueue) lastTickTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&q.lastTick))
+}
+
+// Len returns the number of channels in the queue.
+func (q *reapQueue) Len() int {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
+	return q.items.Len() + q.ready.Len()
+}
 
-	idx := -1
-	for i, v := range *q.items {
-		if v.ch == ch {
-			idx = i
-			break
+// claim marks the channel as being reaped. It returns false if another
+// worker already has it, if limit is positive and that many channels from
+// the same guild are already being reaped, or once the queue is stopped.
+func (q *reapQueue) claim(ch *ManagedChannel, limit int) bool {
+	q.curMu.Lock()
+	defer q.curMu.Unlock()
+	if q.stopped() {
+		return false
+	}
+	if _, ok := q.curWork[ch]; ok {
+		return false
+	}
+	guildID := ch.Channel.GuildID
+	if limit > 0 && q.curGuild[guildID] >= limit {
+		return false
+	}
+	q.curWork[ch] = q.clock.Now()
+	q.curGuild[guildID]++
+	return true
+}
+
+func (q *reapQueue) release(ch *ManagedChannel) {
+	q.curMu.Lock()
+	q.releaseLocked(ch)
+	q.curMu.Unlock()
+}
+
+// Must be called with curMu held.
+func (q *reapQueue) releaseLocked(ch *ManagedChannel) {
+	if _, ok := q.curWork[ch]; ok {
+		delete(q.curWork, ch)
+		guildID := ch.Channel.GuildID
+		q.curGuild[guildID]--
+		if q.curGuild[guildID] <= 0 {
+			delete(q.curGuild, guildID)
 		}
 	}
-	if idx == -1 {
-		heap.Push(q.items, &pqItem{
-			ch:       ch,
-			nextReap: t,
+}
+
+// takeGuildSlot counts a helper against its guild's limit, like claim does
+// for a channel. It returns false if the guild has no slot free.
+func (q *reapQueue) takeGuildSlot(guildID string, limit int) bool {
+	q.curMu.Lock()
+	defer q.curMu.Unlock()
+	if q.stopped() || (limit > 0 && q.curGuild[guildID] >= limit) {
+		return false
+	}
+	q.curGuild[guildID]++
+	return true
+}
+
+func (q *reapQueue) releaseGuildSlot(guildID string) {
+	q.curMu.Lock()
+	defer q.curMu.Unlock()
+	q.curGuild[guildID]--
+	if q.curGuild[guildID] <= 0 {
+		delete(q.curGuild, guildID)
+	}
+}
+
+// reclaimStale releases every channel that was claimed more than maxAge ago
+// and returns them, with how long each was held.
+func (q *reapQueue) reclaimStale(maxAge time.Duration) map[*ManagedChannel]time.Duration {
+	q.curMu.Lock()
+	defer q.curMu.Unlock()
+	var stale map[*ManagedChannel]time.Duration
+	now := q.clock.Now()
+	for ch, since := range q.curWork {
+		if held := now.Sub(since); held > maxAge {
+			if stale == nil {
+				stale = make(map[*ManagedChannel]time.Duration)
+			}
+			stale[ch] = held
+			q.releaseLocked(ch)
+		}
+	}
+	return stale
+}
+
+// inFlight returns how many channels are being reaped.
+func (q *reapQueue) inFlight() int {
+	q.curMu.Lock()
+	defer q.curMu.Unlock()
+	return len(q.curWork)
+}
+
+// busyWorkers returns how many workers are deleting right now.
+func (q *reapQueue) busyWorkers() int {
+	return int(atomic.LoadInt32(&q.busy))
+}
+
+// reapCount returns how many reaps have finished since startup.
+func (q *reapQueue) reapCount() uint64 {
+	return atomic.LoadUint64(&q.reaps)
+}
+
+// guildInFlight returns how many of the guild's channels are being reaped.
+func (q *reapQueue) guildInFlight(guildID string) int {
+	q.curMu.Lock()
+	defer q.curMu.Unlock()
+	return q.curGuild[guildID]
+}
+
+// isReaping reports whether a worker is currently deleting from the channel.
+func (q *reapQueue) isReaping(ch *ManagedChannel) bool {
+	q.curMu.Lock()
+	defer q.curMu.Unlock()
+	_, ok := q.curWork[ch]
+	return ok
+}
+
+// Snapshot returns a copy of the queue contents, soonest first.
+func (q *reapQueue) Snapshot() []QueueEntry {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	entries := make([]QueueEntry, 0, q.items.Len()+q.ready.Len())
+	for _, it := range *q.items {
+		entries = append(entries, QueueEntry{
+			ChannelID: it.value.Channel.ID,
+			NextReap:  it.nextReap,
 		})
+	}
+	for _, it := range q.ready.priorityQueue {
+		entries = append(entries, QueueEntry{
+			ChannelID: it.value.Channel.ID,
+			NextReap:  it.nextReap,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.NextReap.Equal(b.NextReap) {
+			return a.NextReap.Before(b.NextReap)
+		}
+		return idLess(a.ChannelID, b.ChannelID)
+	})
+	return entries
+}
+
+// QueueSnapshot returns the upcoming reap schedule, soonest first.
+func (b *Bot) QueueSnapshot() []QueueEntry {
+	return b.reaper.Snapshot()
+}
+
+// Next returns the channel the scheduler will hand out next and when it is
+// due. A channel that is already due, waiting for a worker, comes before
+// anything still waiting for its deadline.
+func (q *reapQueue) Next() (*ManagedChannel, time.Time, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if it := q.ready.Peek(); it != nil {
+		return it.value, it.nextReap, true
+	}
+	if it := q.items.Peek(); it != nil {
+		return it.value, it.nextReap, true
+	}
+	return nil, time.Time{}, false
+}
+
+// mostOverdue returns the queued channel that has been due the longest, and
+// since when. It returns false if nothing is past its deadline.
+func (q *reapQueue) mostOverdue(now time.Time) (*ManagedChannel, time.Time, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if it := q.ready.Peek(); it != nil {
+		return it.value, it.due, true
+	}
+	// The scheduler moves these over when it next wakes
+	if it := q.items.Peek(); it != nil && !it.nextReap.After(now) {
+		return it.value, it.due, true
+	}
+	return nil, time.Time{}, false
+}
+
+// TimeUntilNextReap returns how long until the next reap anywhere, and which
+// channel it is for. The duration is zero if a channel is already due. It
+// returns false if nothing is queued.
+func (b *Bot) TimeUntilNextReap() (time.Duration, *ManagedChannel, bool) {
+	ch, t, ok := b.reaper.Next()
+	if !ok {
+		return 0, nil, false
+	}
+	d := t.Sub(b.now())
+	if d < 0 {
+		d = 0
+	}
+	return d, ch, true
+}
+
+// restoreState stashes deadlines from a previous run. They are applied the
+// first time each channel is queued.
+func (q *reapQueue) restoreState(entries []QueueEntry) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.restored = make(map[string]time.Time, len(entries))
+	for _, v := range entries {
+		q.restored[v.ChannelID] = v.NextReap
+	}
+}
+
+// takeRestored returns and forgets the saved deadline for a channel. Deadlines
+// that passed while we were down are spread over the next minute so they
+// don't all fire at once.
+func (q *reapQueue) takeRestored(channelID string) (time.Time, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	t, ok := q.restored[channelID]
+	if !ok {
+		return t, false
+	}
+	delete(q.restored, channelID)
+	now := q.clock.Now()
+	if t.Before(now) {
+		t = now.Add(time.Duration(rand.Int63n(int64(time.Minute))))
+	}
+	return t, true
+}
+
+// dropRestored forgets saved deadlines for channels that never came back.
+func (q *reapQueue) dropRestored() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	n := len(q.restored)
+	q.restored = nil
+	return n
+}
+
+// has reports whether the channel has an entry in the queue.
+func (q *reapQueue) has(ch *ManagedChannel) bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	_, ok := q.index[ch]
+	return ok
+}
+
+// Remove takes the given channel out of the queue, if present.
+func (q *reapQueue) Remove(ch *ManagedChannel) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	delete(q.overdue, ch)
+	it, ok := q.index[ch]
+	if !ok {
+		return
+	}
+	if it.ready {
+		heap.Remove(q.ready, it.index)
 	} else {
-		(*q.items)[idx].nextReap = t
-		heap.Fix(q.items, idx)
+		heap.Remove(q.items, it.index)
 	}
+	delete(q.index, ch)
+	// Wake the scheduler so it recomputes its sleep if we removed the head.
 	q.cond.Signal()
 }
 
+func (q *reapQueue) stopped() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop makes WaitForNext return nil from now on.
+func (q *reapQueue) stop() {
+	q.stopOnce.Do(func() {
+		close(q.done)
+		q.cond.L.Lock()
+		q.cond.Broadcast()
+		q.cond.L.Unlock()
+	})
+}
+
+// WaitForNext blocks until the next channel is due for a reap and returns it.
+// Returns nil once the queue has been stopped.
 func (q *reapQueue) WaitForNext() *ManagedChannel {
+	batch := q.WaitForNextBatch(1)
+	if batch == nil {
+		return nil
+	}
+	return batch[0]
+}
+
+// WaitForNextBatch blocks until at least one channel is due, then returns
+// every channel that is due, up to max, taken under a single lock.
+// Returns nil once the queue has been stopped.
+//
+// A channel queued with a nearer deadline while it sleeps wakes it through
+// the cond, and it goes back to sleep on a new timer for the new head. There
+// is no timer to Reset or drain, so the old, later deadline can't win.
+func (q *reapQueue) WaitForNextBatch(max int) []*ManagedChannel {
+	if max < 1 {
+		max = 1
+	}
 	q.cond.L.Lock()
 start:
+	q.tick()
+	select {
+	case <-q.done:
+		q.cond.L.Unlock()
+		return nil
+	default:
+	}
+	now := q.clock.Now()
+	for {
+		it := q.items.Peek()
+		if it == nil || it.nextReap.After(now) {
+			break
+		}
+		heap.Pop(q.items)
+		it.ready = true
+		heap.Push(q.ready, it)
+	}
+	if q.ready.Len() > 0 {
+		// The head of the ready queue is the channel that has been
+		// waiting longest.
+		metrics.QueueStaleness.Set(now.Sub(q.ready.Peek().due).Seconds())
+		var batch []*ManagedChannel
+		for len(batch) < max && q.ready.Len() > 0 {
+			it := heap.Pop(q.ready).(*channelItem)
+			delete(q.index, it.value)
+			if ov, ok := q.overdue[it.value]; !ok || it.due.Before(ov) {
+				q.overdue[it.value] = it.due
+			}
+			batch = append(batch, it.value)
+		}
+		q.cond.L.Unlock()
+		return batch
+	}
+	metrics.QueueStaleness.Set(0)
+
+	var waitTime time.Duration
 	it := q.items.Peek()
 	if it == nil {
-		fmt.Println("[reap] waiting for insertion")
-		q.cond.Wait()
-		goto start
+		q.log.Debug("waiting for insertion")
+		waitTime = maxSchedulerSleep
+	} else {
+		waitTime = it.nextReap.Sub(now)
+		if waitTime > maxSchedulerSleep {
+			waitTime = maxSchedulerSleep
+		}
+		q.log.Debug("sleeping", "duration", roundForLog(waitTime+q.slack), "until", it.nextReap, "channel_id", it.value.Channel.ID)
 	}
-	now := time.Now()
-	if it.nextReap.After(now) {
-		waitTime := it.nextReap.Sub(now)
-		fmt.Println("[reap] sleeping for ", waitTime-(waitTime%time.Second))
-		q.timer.Reset(waitTime + 2*time.Millisecond)
-		q.cond.Wait()
-		goto start
+	// Each sleep gets its own timer, so a tick left over from an
+	// earlier wait can never wake us. The callback takes the lock so
+	// the signal can't slip in before we are waiting on the cond.
+	timer := q.clock.AfterFunc(waitTime+q.slack, func() {
+		q.cond.L.Lock()
+		q.cond.Signal()
+		q.cond.L.Unlock()
+	})
+	q.cond.Wait()
+	timer.Stop()
+	goto start
+}
+
+// roundForLog rounds a sleep to something readable without hiding short ones.
+func roundForLog(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
+
+// reapJitter returns a fixed per-channel delay, up to the configured
+// percentage of the channel's live time, so channels with the same settings
+// don't all come due together. It is never negative, so messages are never
+// deleted before their retention is up.
+func (b *Bot) reapJitter(c *ManagedChannel) time.Duration {
+	pct := b.jitterPercent()
+	c.mu.Lock()
+	liveTime, _, _ := c.effectivePolicy()
+	c.mu.Unlock()
+	if pct <= 0 || liveTime <= 0 {
+		return 0
 	}
-	x := heap.Pop(q.items)
-	q.cond.L.Unlock()
-	it = x.(*pqItem)
-	return it.ch
+	h := fnv.New32a()
+	h.Write([]byte(c.Channel.ID))
+	frac := float64(h.Sum32()) / float64(1<<32)
+	return time.Duration(frac * pct / 100 * float64(liveTime))
 }
 
+// QueueReap recomputes when the channel is next due and updates the queue.
+// Concurrent calls for the same channel are coalesced: if one is already
+// running, the others just ask it to go around once more, so the deadline
+// that ends up in the queue always reflects the latest channel state. A
+// channel that has been disabled or removed is taken out of the queue
+// instead, so a reap finishing late can't put it back.
 func (b *Bot) QueueReap(c *ManagedChannel) {
+	if !atomic.CompareAndSwapInt32(&c.queueing, 0, 1) {
+		atomic.StoreInt32(&c.requeue, 1)
+		return
+	}
+	for {
+		atomic.StoreInt32(&c.requeue, 0)
+		b.queueReap(c)
+		if atomic.LoadInt32(&c.requeue) != 0 {
+			continue
+		}
+		atomic.StoreInt32(&c.queueing, 0)
+		// Someone may have asked between our check and the release
+		if atomic.LoadInt32(&c.requeue) == 0 || !atomic.CompareAndSwapInt32(&c.queueing, 0, 1) {
+			return
+		}
+	}
+}
+
+// managing reports whether c is still the bot's live object for its channel:
+// not disabled, removed, or replaced by a reload.
+func (b *Bot) managing(c *ManagedChannel) bool {
+	c.mu.Lock()
+	disabled := c.disabled
+	c.mu.Unlock()
+	if disabled {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.channels[c.Channel.ID] == c
+}
+
+func (b *Bot) queueReap(c *ManagedChannel) {
 	var reapTime time.Time
 
+	if !b.managing(c) {
+		b.reaper.Remove(c)
+		return
+	}
+
 	reapTime = c.GetNextDeletionTime()
-	//fmt.Println("got reap queue for", c.Channel.ID, c.Channel.Name, reapTime)
+	if reapTime.After(b.now()) {
+		reapTime = reapTime.Add(b.reapJitter(c))
+	}
+	if t, ok := b.reaper.takeRestored(c.Channel.ID); ok {
+		reapTime = t
+	}
+	if until := c.backoffUntil(); reapTime.Before(until) {
+		reapTime = until
+	}
+	if until := c.graceUntil(); reapTime.Before(until) {
+		reapTime = until
+	}
+	b.reaper.log.Debug("queued", "channel_id", c.Channel.ID, "channel", c.Channel.Name, "next_reap", reapTime)
 	b.reaper.Update(c, reapTime)
+	// Disabling or removing a channel takes it out of the map before taking
+	// it out of the queue, so checking again here catches one that went away
+	// while we were working out the deadline.
+	if !b.managing(c) {
+		b.reaper.Remove(c)
+	}
 }
 
-func (b *Bot) reapScheduler() {
-	for i := 0; i < 4; i++ {
-		go b.reapWorker()
+// How often reconcileLoop checks for channels missing from the queue.
+const reconcileInterval = 10 * time.Minute
+
+// reconcileQueue re-queues every managed channel that is neither in the queue
+// nor being reaped. Every channel should always be in one of those states, so
+// anything this finds points at a missed QueueReap somewhere.
+func (b *Bot) reconcileQueue() int {
+	var missing []*ManagedChannel
+	b.mu.RLock()
+	for _, ch := range b.channels {
+		if ch != nil && !b.reaper.has(ch) && !b.reaper.isReaping(ch) {
+			missing = append(missing, ch)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, ch := range missing {
+		b.reaper.log.Warn("channel was missing from the queue", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name)
+		b.QueueReap(ch)
+	}
+	if len(missing) > 0 {
+		b.reaper.log.Warn("recovered channels missing from the queue", "count", len(missing))
+	}
+	return len(missing)
+}
+
+// reclaimStaleWork is a safety net for a worker that died or hung without
+// releasing its channel, which would otherwise never be reaped again. Any
+// channel held for longer than the stale timeout is released and requeued. If
+// the worker was only slow, it may finish a reap at the same time as the next
+// one; deletes of messages that are already gone are skipped.
+func (b *Bot) reclaimStaleWork() int {
+	stale := b.reaper.reclaimStale(b.staleReapTimeout())
+	for ch, held := range stale {
+		b.reaper.log.Error("reclaimed channel from a stuck worker", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "held", held)
+		b.QueueReap(ch)
+	}
+	return len(stale)
+}
+
+// reconcileLoop runs reclaimStaleWork, reconcileQueue and syncThreads
+// periodically until shutdown.
+func (b *Bot) reconcileLoop() {
+	defer b.reaper.wg.Done()
+	t := time.NewTicker(reconcileInterval)
+	defer t.Stop()
+	threads := time.NewTicker(threadSyncInterval)
+	defer threads.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.reclaimStaleWork()
+			b.reconcileQueue()
+		case <-threads.C:
+			b.syncThreads("")
+		case <-b.reaper.done:
+			return
+		}
+	}
+}
+
+// Pause stops all deletions until Resume is called. Channels keep their
+// place in the queue.
+func (b *Bot) Pause() {
+	atomic.StoreInt32(&b.reaper.paused, 1)
+	b.reaper.log.Info("paused")
+}
+
+// Resume restarts deletions after a Pause.
+func (b *Bot) Resume() {
+	atomic.StoreInt32(&b.reaper.paused, 0)
+	b.reaper.cond.L.Lock()
+	b.reaper.cond.Signal()
+	b.reaper.cond.L.Unlock()
+	b.reaper.log.Info("resumed")
+}
+
+func (q *reapQueue) isPaused() bool {
+	return atomic.LoadInt32(&q.paused) != 0
+}
+
+// gatewayDown holds off dispatching until gatewayUp. Reaps already running
+// carry on, and retry or re-queue as usual if their calls fail.
+func (b *Bot) gatewayDown() {
+	if atomic.CompareAndSwapInt64(&b.reaper.gatewayLost, 0, b.now().UnixNano()) {
+		metrics.GatewayWaiting.Set(1)
+		b.reaper.log.Warn("gateway disconnected, holding reaps")
+	}
+}
+
+// gatewayUp restarts dispatching once the session is ready again, and
+// re-queues any channel that was missed while it was down.
+func (b *Bot) gatewayUp() {
+	lost := atomic.SwapInt64(&b.reaper.gatewayLost, 0)
+	if lost == 0 {
+		return
 	}
+	metrics.GatewayWaiting.Set(0)
+	b.reaper.cond.L.Lock()
+	b.reaper.cond.Signal()
+	b.reaper.cond.L.Unlock()
+	b.reaper.log.Info("gateway ready, resuming reaps", "down_for", b.now().Sub(time.Unix(0, lost)))
+	b.reconcileQueue()
+}
+
+// waitingForGateway reports whether dispatching is held for a reconnect,
+// and since when.
+func (q *reapQueue) waitingForGateway() (time.Time, bool) {
+	lost := atomic.LoadInt64(&q.gatewayLost)
+	if lost == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, lost), true
+}
+
+// held reports whether dispatching is stopped, by Pause or a reconnect.
+func (q *reapQueue) held() bool {
+	_, waiting := q.waitingForGateway()
+	return q.isPaused() || waiting
+}
+
+// waitUnpaused blocks until the queue is resumed and the gateway is up, or
+// the queue is stopped.
+func (q *reapQueue) waitUnpaused() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for q.held() {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+		q.cond.Wait()
+	}
+}
+
+// Shutdown stops dispatching new reaps and waits for the workers to finish
+// any in-flight deletes, or for the context to expire.
+func (b *Bot) Shutdown(ctx context.Context) error {
+	return b.Drain(ctx, nil)
+}
+
+// How often Drain reports progress.
+const drainReportInterval = 5 * time.Second
 
+// Drain is Shutdown with progress reports: while reaps are still running,
+// report is called every drainReportInterval with how many. Once it starts,
+// nothing new is dispatched, including ReapNow and reaction triggers. Once
+// the workers are done, the archive and audit sinks are flushed.
+func (b *Bot) Drain(ctx context.Context, report func(inFlight int)) error {
+	b.reaper.stop()
+
+	finished := make(chan struct{})
+	go func() {
+		b.reaper.wg.Wait()
+		close(finished)
+	}()
+	tick := time.NewTicker(drainReportInterval)
+	defer tick.Stop()
 	for {
-		ch := b.reaper.WaitForNext()
+		select {
+		case <-finished:
+			err := b.saveQueueState(b.reaper.Snapshot())
+			if ferr := b.flushSinks(ctx); err == nil {
+				err = ferr
+			}
+			return err
+		case <-ctx.Done():
+			// Still report what the sinks couldn't write
+			b.flushSinks(ctx)
+			return ctx.Err()
+		case <-tick.C:
+			if report != nil {
+				report(b.reaper.inFlight())
+			}
+		}
+	}
+}
+
+// How long to wait before retrying a channel that was already being reaped.
+const busyRetryDelay = 5 * time.Second
+
+func (b *Bot) reapScheduler(workers int) {
+	defer b.reaper.wg.Done()
+	b.reaper.log.Info("starting workers", "workers", workers)
+	// One slot per worker, so a full batch can be queued up while the
+	// workers are busy.
+	b.reaper.workCh = make(chan reapWorkItem, workers)
+	b.reaper.helpCh = make(chan reapWorkItem)
+	for i := 0; i < workers; i++ {
+		b.reaper.wg.Add(1)
+		go b.reapWorker()
+	}
 
-		b.reaper.curMu.Lock()
-		_, channelAlreadyBeingDeleted := b.reaper.curWork[ch]
-		if !channelAlreadyBeingDeleted {
-			b.reaper.curWork[ch] = struct{}{}
+	lastDepth := -1
+	for {
+		batch := b.reaper.WaitForNextBatch(workers)
+		if batch == nil {
+			// Shutting down. Workers drain what's left and exit.
+			close(b.reaper.workCh)
+			return
+		}
+		depth := b.reaper.Len()
+		metrics.QueueDepth.Set(float64(depth))
+		if depth != lastDepth {
+			b.events.publish(ReapEvent{Type: "queue", Time: time.Now(), QueueDepth: depth})
+			lastDepth = depth
 		}
-		b.reaper.curMu.Unlock()
 
-		if channelAlreadyBeingDeleted {
+		if b.reaper.held() {
+			// Put them back and don't look at the queue again until resumed
+			for _, ch := range batch {
+				b.QueueReap(ch)
+			}
+			b.reaper.waitUnpaused()
 			continue
 		}
 
-		msgs := ch.collectMessagesToDelete()
-		b.reaper.workCh <- reapWorkItem{ch: ch, msgs: msgs}
+		for _, ch := range batch {
+			b.dispatch(ch)
+		}
+	}
+}
+
+// dispatch hands a due channel to the worker pool.
+func (b *Bot) dispatch(ch *ManagedChannel) {
+	if !b.reaper.claim(ch, b.guildWorkers()) {
+		// Either a worker has it, which re-queues it when done (this is
+		// a backstop in case that races with us popping it), or its
+		// guild is using all the slots it may.
+		b.reaper.Defer(ch, b.now().Add(busyRetryDelay))
+		return
+	}
+
+	select {
+	case b.reaper.workCh <- reapWorkItem{ch: ch}:
+	default:
+		// Every worker is busy and the buffer is full. Try again shortly
+		// rather than blocking, so the scheduler keeps up with the queue.
+		b.reaper.release(ch)
+		b.reaper.log.Debug("workers busy, requeued", "channel_id", ch.Channel.ID)
+		b.reaper.Defer(ch, b.now().Add(busyRetryDelay))
 	}
 }
 
 func (b *Bot) reapWorker() {
-	for work := range b.reaper.workCh {
-		ch := work.ch
-		msgs := work.msgs
+	defer b.reaper.wg.Done()
+	for {
+		select {
+		case work, ok := <-b.reaper.workCh:
+			if !ok {
+				return
+			}
+			atomic.AddInt32(&b.reaper.busy, 1)
+			b.runWork(work)
+			atomic.AddInt32(&b.reaper.busy, -1)
+		case part := <-b.reaper.helpCh:
+			atomic.AddInt32(&b.reaper.busy, 1)
+			b.runPart(part)
+			atomic.AddInt32(&b.reaper.busy, -1)
+		}
+	}
+}
 
-		fmt.Printf("[reap] %s #%s: deleting %d messages\n", ch.Channel.ID, ch.Channel.Name, len(msgs))
-		count, err := ch.Reap(msgs)
-		if b.handleCriticalPermissionsErrors(ch.Channel.ID, err) {
-			continue
+// How long to wait before retrying a channel whose reap panicked.
+const panicRetryDelay = 1 * time.Minute
+
+// runWork reaps one channel. A panic is logged and counted as a failed reap,
+// and the channel is tried again later, so a bad message can't take a worker
+// out of the pool.
+func (b *Bot) runWork(work reapWorkItem) {
+	ch := work.ch
+	var msgs []string
+	var more bool
+	var parts []reapWorkItem
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		b.reaper.log.Error("reap panicked", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "panic", r, "stack", string(debug.Stack()))
+		metrics.ReapErrors.Inc()
+		ch.recordReap(ReapResult{Err: fmt.Errorf("panic: %v", r)})
+		// Keep the claim until the helpers are done with the channel.
+		// What was taken out to delete is tracked again; any of it that
+		// did get deleted is skipped next time.
+		ch.retrack(msgs)
+		for _, part := range parts {
+			res := <-part.done
+			ch.retrack(res.Failed)
+		}
+		b.reaper.release(ch)
+		b.reaper.Defer(ch, laterOf(b.now().Add(panicRetryDelay), ch.backoffUntil()))
+	}()
+	now := b.now()
+	granted, reset := b.budget.take(now, b.reapChunkSize())
+	if granted == 0 {
+		b.reaper.log.Info("deletion budget used up, waiting for the next window", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "until", reset)
+		b.reaper.release(ch)
+		b.reaper.Defer(ch, reset)
+		return
+	}
+	msgs, more = ch.collectChunk(granted)
+	b.budget.refund(now, granted-len(msgs))
+	var res ReapResult
+	collected := len(msgs)
+	if more {
+		parts, more = b.reapHelpers(ch, now)
+	}
+	if len(parts) > 0 {
+		for _, part := range parts {
+			collected += len(part.msgs)
+		}
+		res = b.doReapParts(ch, msgs, parts)
+	} else {
+		res = b.doReap(ch, msgs)
+	}
+	b.budget.refund(now, collected-res.Deleted()-res.Cleared-res.Archived)
+	if more && res.Err == nil {
+		// Let channels that have been waiting longer go first
+		b.reaper.requeueIfQueued(ch, b.now())
+	}
+}
+
+// reapHelpers splits more of a claimed channel's due messages off for idle
+// workers, so a channel with a big backlog isn't stuck with one worker: up to
+// ChannelWorkers-1 more chunks, each taking a slot of the channel's guild.
+// collectChunk takes each chunk out of the tracked set under the channel's
+// lock, so no two workers are ever given the same message, and the caller
+// keeps the channel claimed until every part is back, so nothing else can
+// reload the backlog and track an in-flight message again. A chunk with no
+// idle worker to take it is tracked again. It returns the parts handed off,
+// and whether there may be more due messages left.
+func (b *Bot) reapHelpers(ch *ManagedChannel, now time.Time) ([]reapWorkItem, bool) {
+	limit := b.channelWorkers()
+	if limit < 2 || ch.moveTarget() != "" {
+		// Moves have to go in order, so they stay on one worker
+		return nil, true
+	}
+	guildID := ch.Channel.GuildID
+	var parts []reapWorkItem
+	more := true
+	for len(parts) < limit-1 && more {
+		if !b.reaper.takeGuildSlot(guildID, b.guildWorkers()) {
+			break
+		}
+		granted, _ := b.budget.take(now, b.reapChunkSize())
+		var msgs []string
+		if granted > 0 {
+			msgs, more = ch.collectChunk(granted)
+			b.budget.refund(now, granted-len(msgs))
+		}
+		if len(msgs) == 0 {
+			b.reaper.releaseGuildSlot(guildID)
+			break
+		}
+		part := reapWorkItem{ch: ch, msgs: msgs, done: make(chan ReapResult, 1)}
+		select {
+		case b.reaper.helpCh <- part:
+			parts = append(parts, part)
+		default:
+			// Nobody is free to help
+			ch.retrack(msgs)
+			b.budget.refund(now, len(msgs))
+			b.reaper.releaseGuildSlot(guildID)
+			return parts, true
 		}
+	}
+	return parts, more
+}
+
+// runPart deletes a part of a channel for the worker that claimed it, which
+// does the bookkeeping once all of its parts are back.
+func (b *Bot) runPart(part reapWorkItem) {
+	ch := part.ch
+	var res ReapResult
+	defer func() {
+		if r := recover(); r != nil {
+			b.reaper.log.Error("reap panicked", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "panic", r, "stack", string(debug.Stack()))
+			res = ReapResult{Err: fmt.Errorf("panic: %v", r), Failed: part.msgs}
+		}
+		b.reaper.releaseGuildSlot(ch.Channel.GuildID)
+		part.done <- res
+		close(part.done)
+	}()
+	res = b.reapPart(ch, part.msgs)
+}
+
+// reapPart archives and deletes msgs. Nothing is deleted if archiving fails;
+// the messages are all listed in Failed.
+func (b *Bot) reapPart(ch *ManagedChannel, msgs []string) ReapResult {
+	ctx, cancel := context.WithTimeout(context.Background(), b.reapTimeout())
+	defer cancel()
+	if b.archive != nil && len(msgs) > 0 && !b.Config.DryRun && ch.reapAction() == ActionDelete {
+		if err := b.archive.Archive(ctx, ch.archivedMessages(msgs)); err != nil {
+			return ReapResult{Err: fmt.Errorf("archive: %w", err), Failed: msgs}
+		}
+	}
+	res := ch.Reap(ctx, msgs)
+	ch.forgetArchived(msgs)
+	return res
+}
+
+// doReapParts is doReap for a channel whose messages were split between
+// workers: msgs are deleted here while the parts are deleted by others, and
+// the channel's next reap is scheduled once they are all done.
+func (b *Bot) doReapParts(ch *ManagedChannel, msgs []string, parts []reapWorkItem) ReapResult {
+	b.reaper.log.Info("deleting messages", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "count", len(msgs), "helpers", len(parts))
+	start := time.Now()
+	res := b.reapPart(ch, msgs)
+	for _, part := range parts {
+		res = res.add(<-part.done)
+	}
+	return b.finishReap(ch, res, start, nil, nil)
+}
+
+// doReap deletes msgs from a channel the caller has claimed, then releases it
+// and schedules its next reap.
+func (b *Bot) doReap(ch *ManagedChannel, msgs []string) ReapResult {
+	b.reaper.log.Info("deleting messages", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "count", len(msgs))
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), b.reapTimeout())
+	deleting := ch.reapAction() == ActionDelete
+	if b.archive != nil && len(msgs) > 0 && !b.Config.DryRun && deleting {
+		err := b.archive.Archive(ctx, ch.archivedMessages(msgs))
 		if err != nil {
-			fmt.Printf("[reap] %s #%s: deleted %d, got error: %v\n", ch.Channel.ID, ch.Channel.Name, count, err)
-			ch.LoadBacklog()
-		} else if count == -1 {
-			fmt.Printf("[reap] %s #%s: doing single-message delete\n", ch.Channel.ID, ch.Channel.Name)
+			cancel()
+			// Nothing was deleted. Track the messages again, and try
+			// later.
+			b.reaper.log.Error("archive failed, not deleting", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "count", len(msgs), "error", err)
+			b.reaper.release(ch)
+			ch.retrack(msgs)
+			retry := archiveRetryDelay
+			if delay, err := b.reloadBacklog(ch, false); err != nil && delay > retry {
+				retry = delay
+			}
+			b.reaper.Defer(ch, b.now().Add(retry))
+			return ReapResult{Err: err}
+		}
+	}
+	var moveErr error
+	var unmoved []string
+	if len(msgs) > 0 && ch.moveTarget() != "" && !b.Config.DryRun && deleting {
+		var n int
+		n, moveErr = b.moveMessages(ctx, ch, msgs)
+		if moveErr != nil {
+			// Delete only what made it across
+			b.reaper.log.Error("could not move messages, not deleting the rest", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "moved", n, "count", len(msgs), "error", moveErr)
+			msgs, unmoved = msgs[:n], msgs[n:]
 		}
+	}
+	res := ch.Reap(ctx, msgs)
+	cancel()
+	ch.forgetArchived(msgs)
+	return b.finishReap(ch, res, start, moveErr, unmoved)
+}
 
-		b.reaper.curMu.Lock()
-		delete(b.reaper.curWork, ch)
-		b.reaper.curMu.Unlock()
-		b.QueueReap(ch)
+// finishReap records a reap that started at start, then releases the channel
+// and schedules its next reap. moveErr and unmoved are what was left behind
+// by a failed move.
+func (b *Bot) finishReap(ch *ManagedChannel, res ReapResult, start time.Time, moveErr error, unmoved []string) ReapResult {
+	atomic.AddUint64(&b.reaper.reaps, 1)
+	b.reaper.recent.add(b.now(), res.Deleted())
+	ch.recordReap(res)
+	b.audit(ch, res)
+	b.checkBacklog(ch)
+	took := time.Since(start)
+	count, err := res.Deleted(), res.Err
+	metrics.ReapDuration.Observe(took.Seconds())
+	metrics.MessagesDeleted.Add(uint64(count))
+	metrics.MessagesSkipped.Add(uint64(res.Skipped))
+	if err != nil {
+		metrics.ReapErrors.Inc()
+	}
+	b.publishReap(ch, count, took, err)
+	b.reaper.reaped(ch)
+	if b.handleCriticalPermissionsErrors(ch.Channel.ID, err) {
+		b.reaper.release(ch)
+		return res
+	}
+	if res.Skipped > 0 {
+		b.reaper.log.Debug("messages already gone", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "count", res.Skipped)
+	}
+	if err != nil {
+		b.reaper.log.Error("reap failed", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "count", count, "rate_limited", res.RateLimited, "error", err)
+		if st := ch.Stats(); !st.BackoffUntil.IsZero() {
+			b.reaper.log.Warn("backing off failing channel", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "failures", st.ConsecutiveFailures, "until", st.BackoffUntil)
+		}
+		if b.OnReapError != nil {
+			go b.OnReapError(ch, err)
+		}
+		ch.retrack(res.Failed)
+		if delay, err := b.reloadBacklog(ch, false); err != nil {
+			// Requeueing now would just fail again in a tight loop
+			b.reaper.release(ch)
+			b.reaper.Defer(ch, laterOf(b.now().Add(delay), ch.backoffUntil()))
+			return res
+		}
+	}
+	if moveErr != nil {
+		// Track the messages that weren't moved again, and try them
+		// later. A failed reap has reloaded already.
+		b.reaper.release(ch)
+		ch.retrack(unmoved)
+		retry := archiveRetryDelay
+		if err == nil {
+			if delay, err := b.reloadBacklog(ch, false); err != nil && delay > retry {
+				retry = delay
+			}
+		}
+		b.reaper.Defer(ch, laterOf(b.now().Add(retry), ch.backoffUntil()))
+		return res
+	}
+
+	if err == nil && count > 0 && ch.takeBacklogTruncated() {
+		// Now that room has been made, look for the older messages
+		// the last load didn't reach.
+		if delay, err := b.reloadBacklog(ch, true); err != nil {
+			b.reaper.release(ch)
+			b.reaper.Defer(ch, b.now().Add(delay))
+			return res
+		}
+	}
+
+	b.reaper.release(ch)
+	b.QueueReap(ch)
+	return res
+}
+
+// After a failed backlog reload, a channel's next reap waits
+// backlogRetryBase, doubling with each further failure in a row up to
+// backlogRetryMax.
+const (
+	backlogRetryBase = 30 * time.Second
+	backlogRetryMax  = 30 * time.Minute
+)
+
+// reloadBacklog reloads a channel's messages after a failed reap, just the
+// new ones unless full is set. If that fails too, it logs and returns how long
+// to hold the channel off for.
+func (b *Bot) reloadBacklog(ch *ManagedChannel, full bool) (time.Duration, error) {
+	var err error
+	if full {
+		err = ch.loadFullBacklog()
+	} else {
+		err = ch.LoadBacklog()
+	}
+	ch.mu.Lock()
+	if err == nil {
+		ch.backlogFailures = 0
+		ch.mu.Unlock()
+		return 0, nil
+	}
+	n := ch.backlogFailures
+	ch.backlogFailures++
+	ch.mu.Unlock()
+	delay := backlogRetryMax
+	if n < 16 && backlogRetryBase<<uint(n) < backlogRetryMax {
+		delay = backlogRetryBase << uint(n)
+	}
+	b.reaper.log.Warn("could not reload backlog, backing off", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "failures", n+1, "retry_in", delay, "error", err)
+	return delay, err
+}
+
+var (
+	// ErrReapInProgress is returned by ReapNow if a worker is busy with the
+	// channel.
+	ErrReapInProgress = errors.New("messages are already being deleted from this channel")
+	// ErrNotManaged is returned by ReapNow for a channel without AutoDelete
+	// settings, or one that has been disabled.
+	ErrNotManaged = errors.New("channel is not managed by AutoDelete")
+	// ErrShuttingDown is returned by ReapNow once Shutdown or Drain has
+	// been called.
+	ErrShuttingDown = errors.New("AutoDelete is shutting down")
+	// ErrBudgetExhausted is returned by ReapNow when the bot-wide deletion
+	// budget has nothing left in the current window.
+	ErrBudgetExhausted = errors.New("the deletion budget is used up for now")
+)
+
+// ReapNow deletes whatever is due in the channel right away, instead of
+// waiting for its turn in the queue, and returns how many messages were
+// deleted. It is safe to call at any time once the bot is connected.
+//
+// Only messages the next scheduled reap would take are deleted: the
+// channel's limits, exemptions, pins, KeepMessages and MinAge all apply as
+// usual. The channel is requeued afterwards as if the scheduler had run it.
+func (b *Bot) ReapNow(channelID string) (int, error) {
+	b.mu.RLock()
+	ch := b.channels[channelID]
+	b.mu.RUnlock()
+	if ch == nil {
+		return 0, ErrNotManaged
+	}
+	return b.reapNow(ch)
+}
+
+// reapNow immediately deletes whatever is due in the channel, instead of
+// waiting for its turn in the queue. It takes from the deletion budget like a
+// scheduled reap; what doesn't fit is left for the scheduler.
+func (b *Bot) reapNow(ch *ManagedChannel) (int, error) {
+	if b.reaper.stopped() {
+		return 0, ErrShuttingDown
+	}
+	if !b.reaper.claim(ch, 0) {
+		return 0, ErrReapInProgress
+	}
+	msgs := ch.collectMessagesToDelete()
+	now := b.now()
+	granted, _ := b.budget.take(now, len(msgs))
+	if granted < len(msgs) {
+		ch.retrack(msgs[granted:])
+		msgs = msgs[:granted]
+		if granted == 0 {
+			b.reaper.release(ch)
+			b.QueueReap(ch)
+			return 0, ErrBudgetExhausted
+		}
+	}
+	res := b.doReap(ch, msgs)
+	b.budget.refund(now, len(msgs)-res.Deleted()-res.Cleared-res.Archived)
+	return res.Deleted(), res.Err
+}
+
+// reapMessages deletes specific messages outside the normal schedule,
+// waiting for any reap already in progress on the channel to finish first.
+// They take from the deletion budget too; any that don't fit wait for the
+// next window.
+func (b *Bot) reapMessages(ch *ManagedChannel, msgs []string) {
+	ch.mu.Lock()
+	for _, msgID := range msgs {
+		ch.dropLiveMessage(msgID)
+	}
+	ch.mu.Unlock()
+	for len(msgs) > 0 {
+		for !b.reaper.claim(ch, 0) {
+			select {
+			case <-time.After(busyRetryDelay):
+			case <-b.reaper.done:
+				return
+			}
+		}
+		now := b.now()
+		granted, reset := b.budget.take(now, len(msgs))
+		if granted == 0 {
+			b.reaper.release(ch)
+			b.reaper.log.Info("deletion budget used up, waiting for the next window", "channel_id", ch.Channel.ID, "channel", ch.Channel.Name, "count", len(msgs), "until", reset)
+			if !b.sleepUntil(reset) {
+				return
+			}
+			continue
+		}
+		batch := msgs[:granted]
+		msgs = msgs[granted:]
+		res := b.doReap(ch, batch)
+		b.budget.refund(now, len(batch)-res.Deleted()-res.Cleared-res.Archived)
+	}
+}
+
+// sleepUntil waits until t on the bot's clock. It returns false if the reaper
+// stops first.
+func (b *Bot) sleepUntil(t time.Time) bool {
+	wake := make(chan struct{})
+	timer := b.reaper.clock.AfterFunc(t.Sub(b.now()), func() { close(wake) })
+	select {
+	case <-wake:
+		return true
+	case <-b.reaper.done:
+		timer.Stop()
+		return false
 	}
 }
@@ -0,0 +1,380 @@
+package autodelete
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func testChannel(id string) *ManagedChannel {
+	return &ManagedChannel{Channel: &discordgo.Channel{ID: id, GuildID: "1"}}
+}
+
+// newTestBot returns a Bot on a fake clock, with no scheduler or workers
+// running, for driving the queue by hand.
+func newTestBot() (*Bot, *fakeClock) {
+	q, clock := newTestQueue()
+	b := &Bot{
+		Config:   Config{ReapJitter: -1},
+		log:      discardLog,
+		channels: make(map[string]*ManagedChannel),
+		guilds:   make(map[string]guildConfigMarshal),
+		reaper:   q,
+		events:   newEventHub(),
+	}
+	return b, clock
+}
+
+// queuedAt returns a channel's deadline in the queue.
+func queuedAt(q *reapQueue, ch *ManagedChannel) (time.Time, bool) {
+	for _, e := range q.Snapshot() {
+		if e.ChannelID == ch.Channel.ID {
+			return e.NextReap, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// waitBatch runs WaitForNextBatch in the background.
+func waitBatch(q *reapQueue, max int) <-chan []*ManagedChannel {
+	got := make(chan []*ManagedChannel, 1)
+	go func() { got <- q.WaitForNextBatch(max) }()
+	return got
+}
+
+// expectBatch waits, in real time, for a batch of exactly want.
+func expectBatch(t *testing.T, got <-chan []*ManagedChannel, want ...*ManagedChannel) {
+	t.Helper()
+	select {
+	case batch := <-got:
+		if len(batch) != len(want) {
+			t.Fatalf("got %d channels, want %d", len(batch), len(want))
+		}
+		for i := range want {
+			if batch[i] != want[i] {
+				t.Fatalf("got channel %s at %d, want %s", batch[i].Channel.ID, i, want[i].Channel.ID)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing came due")
+	}
+}
+
+// expectNothing checks that nothing comes out for a short while.
+func expectNothing(t *testing.T, got <-chan []*ManagedChannel) {
+	t.Helper()
+	select {
+	case batch := <-got:
+		t.Fatalf("channel %s came out early", batch[0].Channel.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// A channel queued with a sooner deadline while the scheduler sleeps on a far
+// one comes out at its own time, not the far one.
+func TestSoonerDeadlineWakesScheduler(t *testing.T) {
+	q, clock := newTestQueue()
+	defer q.stop()
+	far, near := testChannel("10"), testChannel("11")
+	q.Update(far, clock.Now().Add(30*time.Minute))
+	got := waitBatch(q, 1)
+	clock.waitTimer(t, maxSchedulerSleep)
+
+	q.Update(near, clock.Now().Add(10*time.Second))
+	clock.waitTimer(t, 10*time.Second)
+	clock.Advance(9 * time.Second)
+	expectNothing(t, got)
+	clock.Advance(1 * time.Second)
+	expectBatch(t, got, near)
+}
+
+// Two close deadlines each come out at their own time. The timer from the
+// sleep that was cut short can't wake the scheduler early.
+func TestCloseDeadlinesDontFireEarly(t *testing.T) {
+	q, clock := newTestQueue()
+	defer q.stop()
+	later, sooner := testChannel("10"), testChannel("11")
+	q.Update(later, clock.Now().Add(10*time.Second))
+	got := waitBatch(q, 1)
+	clock.waitTimer(t, 10*time.Second)
+	q.Update(sooner, clock.Now().Add(5*time.Second))
+	clock.waitTimer(t, 5*time.Second)
+
+	clock.Advance(4 * time.Second)
+	expectNothing(t, got)
+	clock.Advance(1 * time.Second)
+	expectBatch(t, got, sooner)
+
+	got = waitBatch(q, 1)
+	clock.waitTimer(t, 5*time.Second)
+	clock.Advance(4 * time.Second)
+	expectNothing(t, got)
+	clock.Advance(1 * time.Second)
+	expectBatch(t, got, later)
+}
+
+// Channels with the same deadline come out in channel ID order, however they
+// were queued and however often they were updated.
+func TestSameDeadlinePopOrder(t *testing.T) {
+	q, clock := newTestQueue()
+	defer q.stop()
+	ids := []string{"1003", "999", "1001", "1000", "1002"}
+	chans := make(map[string]*ManagedChannel)
+	at := clock.Now().Add(time.Minute)
+	for _, id := range ids {
+		chans[id] = testChannel(id)
+		q.Update(chans[id], at.Add(time.Second))
+	}
+	// Move them all to the same deadline, which fixes each in place
+	for i := len(ids) - 1; i >= 0; i-- {
+		q.Update(chans[ids[i]], at)
+	}
+	want := []*ManagedChannel{chans["999"], chans["1000"], chans["1001"], chans["1002"], chans["1003"]}
+	snap := q.Snapshot()
+	for i, e := range snap {
+		if e.ChannelID != want[i].Channel.ID {
+			t.Errorf("Snapshot()[%d] = %s, want %s", i, e.ChannelID, want[i].Channel.ID)
+		}
+	}
+	clock.Advance(time.Minute)
+	expectBatch(t, waitBatch(q, len(ids)), want...)
+}
+
+// Update looks channels up in the index, so moving one costs about the same
+// with 10,000 queued as with 100.
+func BenchmarkQueueUpdate(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("channels=%d", n), func(b *testing.B) {
+			q, clock := newTestQueue()
+			defer q.stop()
+			now := clock.Now()
+			chans := make([]*ManagedChannel, n)
+			for i := range chans {
+				chans[i] = testChannel(strconv.Itoa(1000 + i))
+				q.Update(chans[i], now.Add(time.Duration(i)*time.Second))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q.Update(chans[i%n], now.Add(time.Duration(i%(2*n))*time.Second))
+			}
+		})
+	}
+}
+
+// Handing out a pile of channels that came due together, a batch at a time
+// against one at a time.
+func BenchmarkWaitForNextBatch(b *testing.B) {
+	const due = 1000
+	for _, max := range []int{1, 16, 100} {
+		b.Run(fmt.Sprintf("max=%d", max), func(b *testing.B) {
+			q, clock := newTestQueue()
+			defer q.stop()
+			chans := make([]*ManagedChannel, due)
+			for i := range chans {
+				chans[i] = testChannel(strconv.Itoa(1000 + i))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				now := clock.Now()
+				for j, ch := range chans {
+					q.Update(ch, now.Add(-time.Duration(j)*time.Millisecond))
+				}
+				b.StartTimer()
+				for n := 0; n < due; {
+					n += len(q.WaitForNextBatch(max))
+				}
+			}
+		})
+	}
+}
+
+// A channel that comes due while a worker still has it goes back in the queue
+// for a little later, rather than being dropped.
+func TestDispatchBusyChannelRequeues(t *testing.T) {
+	b, clock := newTestBot()
+	defer b.reaper.stop()
+	ch := testChannel("10")
+	if !b.reaper.claim(ch, 0) {
+		t.Fatal("could not claim")
+	}
+	b.reaper.Update(ch, clock.Now())
+	expectBatch(t, waitBatch(b.reaper, 1), ch)
+	if b.reaper.has(ch) {
+		t.Fatal("still queued after the pop")
+	}
+
+	b.dispatch(ch)
+	at, ok := queuedAt(b.reaper, ch)
+	if !ok {
+		t.Fatal("busy channel was dropped from the queue")
+	}
+	if want := clock.Now().Add(busyRetryDelay); !at.Equal(want) {
+		t.Errorf("requeued for %s, want %s", at, want)
+	}
+}
+
+// With every worker busy and the hand-off buffer full, dispatch puts due
+// channels back instead of blocking, and the scheduler keeps popping.
+func TestDispatchSaturatedWorkers(t *testing.T) {
+	b, clock := newTestBot()
+	defer b.reaper.stop()
+	b.reaper.workCh = make(chan reapWorkItem, 1)
+	b.reaper.workCh <- reapWorkItem{ch: testChannel("9")}
+	a, c := testChannel("10"), testChannel("11")
+	b.reaper.Update(a, clock.Now())
+	b.reaper.Update(c, clock.Now())
+	expectBatch(t, waitBatch(b.reaper, 2), a, c)
+
+	done := make(chan struct{})
+	go func() {
+		b.dispatch(a)
+		b.dispatch(c)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch blocked on busy workers")
+	}
+	for _, ch := range []*ManagedChannel{a, c} {
+		if b.reaper.isReaping(ch) {
+			t.Errorf("channel %s left claimed", ch.Channel.ID)
+		}
+	}
+
+	got := waitBatch(b.reaper, 2)
+	clock.waitTimer(t, busyRetryDelay)
+	clock.Advance(busyRetryDelay)
+	expectBatch(t, got, a, c)
+}
+
+// After an outage, overdue channels are handed out oldest deadline first,
+// even when they have to be put off and newly due channels keep arriving, so
+// the worst staleness stays bounded.
+func TestOverdueBurstStaysFIFO(t *testing.T) {
+	q, clock := newTestQueue()
+	defer q.stop()
+	start := clock.Now()
+	var old []*ManagedChannel
+	for i := 0; i < 8; i++ {
+		ch := testChannel(strconv.Itoa(100 + i))
+		q.Update(ch, start.Add(-time.Hour+time.Duration(i)*time.Second))
+		old = append(old, ch)
+	}
+	isOld := make(map[*ManagedChannel]bool)
+	for _, ch := range old {
+		isOld[ch] = true
+	}
+
+	const round = 5 * time.Second
+	var reaped []*ManagedChannel
+	var worst time.Duration
+	fresh := 0
+	for r := 0; len(reaped) < len(old); r++ {
+		if r > 2*len(old) {
+			t.Fatalf("only %d of %d overdue channels reaped after %d rounds", len(reaped), len(old), r)
+		}
+		// New channels coming due all the time
+		for i := 0; i < 3; i++ {
+			q.Update(testChannel(strconv.Itoa(1000+fresh)), clock.Now())
+			fresh++
+		}
+		batch := q.WaitForNextBatch(2)
+		ahead := len(old) - len(reaped)
+		for _, ch := range batch {
+			if !isOld[ch] && ahead > 0 {
+				t.Fatalf("newly due channel %s went ahead of the overdue ones", ch.Channel.ID)
+			}
+			ahead--
+		}
+		// The first gets reaped and the other is put off, as if its
+		// guild had no slot free.
+		if s := clock.Now().Sub(q.overdue[batch[0]]); s > worst {
+			worst = s
+		}
+		q.reaped(batch[0])
+		q.Update(batch[0], clock.Now().Add(time.Hour))
+		reaped = append(reaped, batch[0])
+		if len(batch) > 1 {
+			q.Defer(batch[1], clock.Now().Add(round/2))
+		}
+		clock.Advance(round)
+	}
+	for i, ch := range reaped {
+		if ch != old[i] {
+			t.Errorf("reaped %s at %d, want %s", ch.Channel.ID, i, old[i].Channel.ID)
+		}
+	}
+	if max := time.Hour + time.Duration(len(old))*round; worst > max {
+		t.Errorf("worst staleness %s, want at most %s", worst, max)
+	}
+}
+
+// Many QueueReaps racing on one channel leave it queued once, for the
+// deadline its messages call for.
+func TestConcurrentQueueReap(t *testing.T) {
+	b, clock := newTestBot()
+	defer b.reaper.stop()
+	ch := testChannel("10")
+	ch.bot = b
+	ch.MessageLiveTime = time.Hour
+	posted := clock.Now().Add(-10 * time.Minute)
+	ch.liveMessages = []smallMessage{{MessageID: "20", PostedAt: posted}}
+	b.channels[ch.Channel.ID] = ch
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.QueueReap(ch)
+		}()
+	}
+	wg.Wait()
+	if n := b.reaper.Len(); n != 1 {
+		t.Fatalf("%d queue entries, want 1", n)
+	}
+	if at, _ := queuedAt(b.reaper, ch); !at.Equal(posted.Add(time.Hour)) {
+		t.Errorf("queued for %s, want %s", at, posted.Add(time.Hour))
+	}
+}
+
+// A channel disabled while a worker is reaping it isn't put back in the queue
+// when the reap finishes.
+func TestDisabledMidReapStaysOut(t *testing.T) {
+	b, clock := newTestBot()
+	defer b.reaper.stop()
+	b.store = fileStore{dir: t.TempDir()}
+	ch := testChannel("10")
+	ch.bot = b
+	ch.MessageLiveTime = time.Hour
+	ch.liveMessages = []smallMessage{{MessageID: "20", PostedAt: clock.Now()}}
+	b.channels[ch.Channel.ID] = ch
+	b.QueueReap(ch)
+	clock.Advance(time.Hour)
+	expectBatch(t, waitBatch(b.reaper, 1), ch)
+	if !b.reaper.claim(ch, 0) {
+		t.Fatal("could not claim")
+	}
+
+	if err := b.disableChannel(ch.Channel.ID, "test", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// What finishReap does once the deletes are done
+	b.reaper.release(ch)
+	b.QueueReap(ch)
+	if b.reaper.has(ch) {
+		t.Error("disabled channel is back in the queue")
+	}
+	if n := b.reconcileQueue(); n != 0 {
+		t.Errorf("reconcile found %d missing channels, want none", n)
+	}
+	if b.reaper.has(ch) {
+		t.Error("reconcile put the disabled channel back")
+	}
+}
@@ -0,0 +1,173 @@
+package autodelete_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+// reapnow can't get around the deletion budget.
+func TestReapNowTakesFromBudget(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{DeleteBudget: 2, DeleteBudgetWindow: time.Hour})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h")
+	for i := 0; i < 3; i++ {
+		h.Post(ch, "hello")
+	}
+	h.Advance(61 * time.Minute)
+	h.WaitDeleted(2)
+
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err = h.Bot.ReapNow(ch); err != autodelete.ErrReapInProgress {
+			break
+		}
+	}
+	if err != autodelete.ErrBudgetExhausted {
+		t.Fatalf("ReapNow: got %v, want ErrBudgetExhausted", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := h.Deleted(); len(got) != 2 {
+		t.Fatalf("deleted %d messages over budget, want 2", len(got))
+	}
+
+	h.Advance(time.Hour)
+	h.WaitDeleted(3)
+}
+
+// outageClient is a DiscordClient for empty channels whose loads and
+// deletes can be made to fail, as if the network were down.
+type outageClient struct {
+	mu                     sync.Mutex
+	failLoads, failDeletes bool
+}
+
+var errOutage = errors.New("network down")
+
+func (c *outageClient) set(failLoads, failDeletes bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLoads, c.failDeletes = failLoads, failDeletes
+}
+
+func (c *outageClient) fail(deletes bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if (deletes && c.failDeletes) || (!deletes && c.failLoads) {
+		return errOutage
+	}
+	return nil
+}
+
+func (c *outageClient) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error) {
+	return nil, c.fail(false)
+}
+
+func (c *outageClient) ChannelMessage(channelID, messageID string) (*discordgo.Message, error) {
+	return nil, errOutage
+}
+
+func (c *outageClient) ChannelMessagesPinned(channelID string) ([]*discordgo.Message, error) {
+	return nil, c.fail(false)
+}
+
+func (c *outageClient) ChannelMessageDelete(channelID, messageID string) error {
+	return c.fail(true)
+}
+
+func (c *outageClient) ChannelMessagesBulkDelete(channelID string, messages []string) error {
+	return c.fail(true)
+}
+
+func (c *outageClient) MessageReactionsRemoveAll(channelID, messageID string) error {
+	return c.fail(true)
+}
+
+func (c *outageClient) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	return nil, errors.New("no members")
+}
+
+func (c *outageClient) ActiveThreads(guildID string) ([]autodelete.Thread, error) {
+	return nil, c.fail(false)
+}
+
+func (c *outageClient) ChannelDelete(channelID string) (*discordgo.Channel, error) {
+	return nil, c.fail(true)
+}
+
+func (c *outageClient) ThreadArchive(threadID string) error {
+	return c.fail(true)
+}
+
+// waitNextReap waits for the channel's deadline to move off prev, and
+// returns how far past the current time it went.
+func waitNextReap(t *testing.T, h *autodeletetest.Harness, channelID string, prev time.Time) time.Duration {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, v := range h.Bot.QueueSnapshot() {
+			if v.ChannelID == channelID && !v.NextReap.Equal(prev) {
+				return v.NextReap.Sub(h.Clock.Now())
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("deadline of %s stayed at %s", channelID, prev)
+	return 0
+}
+
+// When a reap fails and reloading the backlog fails too, the next try waits
+// longer each time, up to 30 minutes, and the wait starts over once a load
+// works.
+func TestBacklogReloadBacksOff(t *testing.T) {
+	client := &outageClient{}
+	h := autodeletetest.New(t, autodelete.Config{Client: client})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h")
+	h.Post(ch, "hello")
+
+	client.set(true, true)
+	h.Advance(61 * time.Minute)
+	prev := h.Clock.Now().Add(-time.Minute)
+	// The circuit breaker's own backoff stays shorter than this until the
+	// cap
+	wants := []time.Duration{
+		30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute,
+		8 * time.Minute, 16 * time.Minute, 30 * time.Minute,
+	}
+	for i, want := range wants {
+		got := waitNextReap(t, h, ch, prev)
+		if got != want {
+			t.Fatalf("try %d: next in %s, want %s", i+1, got, want)
+		}
+		prev = h.Clock.Now().Add(got)
+		if i == len(wants)-1 {
+			// The load works this time
+			client.set(false, true)
+		}
+		// and the scheduler's timer slack
+		h.Advance(got + time.Second)
+	}
+
+	// Only the circuit breaker holds it back now, until a reap works
+	got := waitNextReap(t, h, ch, prev)
+	prev = h.Clock.Now().Add(got)
+	client.set(false, false)
+	h.Advance(got + time.Second)
+	if got := waitNextReap(t, h, ch, prev); got < 24*time.Hour {
+		t.Fatalf("emptied channel due again in %s", got)
+	}
+
+	h.Post(ch, "again")
+	prev = h.Clock.Now().Add(waitNextReap(t, h, ch, time.Time{}))
+	client.set(true, true)
+	h.Advance(61 * time.Minute)
+	if got := waitNextReap(t, h, ch, prev); got != 30*time.Second {
+		t.Errorf("next try in %s after a good load, want 30s", got)
+	}
+}
@@ -0,0 +1,101 @@
+package autodelete
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quietHours is a daily window, in wall-clock time in loc, during which
+// nothing is deleted from a channel. A window whose end is before its start
+// runs over midnight.
+type quietHours struct {
+	// minutes after midnight
+	start, end int
+	loc        *time.Location
+}
+
+// parseQuietHours parses a window like "22:00-06:00". A nil loc means UTC.
+func parseQuietHours(s string, loc *time.Location) (*quietHours, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("quiet hours %q: want a range like 22:00-06:00", s)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("quiet hours %q: start and end are the same", s)
+	}
+	return &quietHours{start: start, end: end, loc: loc}, nil
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	hm := strings.SplitN(s, ":", 2)
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("bad hour in %q", s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("bad minute in %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func (q *quietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.start/60, q.start%60, q.end/60, q.end%60)
+}
+
+// contains reports whether t falls inside the window.
+func (q *quietHours) contains(t time.Time) bool {
+	local := t.In(q.loc)
+	m := local.Hour()*60 + local.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// endAfter returns when the window containing t closes. The window is
+// matched against the wall clock, so across a DST change it is an hour
+// longer or shorter in real time rather than moving. A closing time skipped
+// by the change moves to the matching instant after the jump, as in cron.
+func (q *quietHours) endAfter(t time.Time) time.Time {
+	local := t.In(q.loc)
+	y, m, d := local.Date()
+	for i := 0; i < 3; i++ {
+		c := time.Date(y, m, d+i, q.end/60, q.end%60, 0, 0, q.loc)
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, time.UTC).Day()
+		if got := c.Hour()*60 + c.Minute(); c.Day() == day && got < q.end {
+			// In a DST gap, time.Date may pick the instant before the
+			// jump. Move it to the one after.
+			c = c.Add(time.Duration(q.end-got) * time.Minute)
+		}
+		if c.After(t) && !q.contains(c) {
+			return c
+		}
+	}
+	// Can't happen for a valid window
+	return t
+}
+
+func quietHoursString(q *quietHours) string {
+	if q == nil {
+		return ""
+	}
+	return q.String()
+}
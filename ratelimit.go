@@ -0,0 +1,157 @@
+package autodelete
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/riking/AutoDelete/metrics"
+)
+
+// A RateLimiter is consulted before every delete call the reaper makes.
+type RateLimiter interface {
+	// Wait blocks until a call may be made, or the context is done.
+	Wait(ctx context.Context) error
+}
+
+const defaultDeleteRate = 2
+const defaultDeleteBurst = 5
+
+// tokenBucket is a RateLimiter allowing rate calls per second on average,
+// with bursts of up to burst calls.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		rate = defaultDeleteRate
+	}
+	if burst <= 0 {
+		burst = defaultDeleteBurst
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) Wait(ctx context.Context) error {
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	// Take the token now, even if it puts us in debt, so waiters queue up
+	// in order instead of racing for the next one.
+	tb.tokens--
+	var wait time.Duration
+	if tb.tokens < 0 {
+		wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	metrics.LimiterWaits.Inc()
+	metrics.LimiterWaitSeconds.Observe(wait.Seconds())
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		// Give the token back
+		tb.mu.Lock()
+		tb.tokens++
+		tb.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+const defaultDeleteBudgetWindow = 1 * time.Minute
+
+// A deleteBudget caps the messages deleted across the whole bot in each
+// fixed window. Unlike the RateLimiter it doesn't slow calls down: a reap
+// that finds the budget used up is put off until the next window. A nil
+// deleteBudget has no limit.
+type deleteBudget struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	used   int
+}
+
+func newDeleteBudget(limit int, window time.Duration) *deleteBudget {
+	if limit <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = defaultDeleteBudgetWindow
+	}
+	return &deleteBudget{limit: limit, window: window}
+}
+
+// roll starts a new window if the current one is over.
+// Must be called with the mutex held.
+func (d *deleteBudget) roll(now time.Time) {
+	if now.Sub(d.start) >= d.window {
+		d.start = now.Truncate(d.window)
+		d.used = 0
+	}
+}
+
+// take reserves up to n deletions from the budget and returns how many it
+// got. If that is none, reset is when the next window starts.
+func (d *deleteBudget) take(now time.Time, n int) (granted int, reset time.Time) {
+	if d == nil {
+		return n, time.Time{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(now)
+	granted = d.limit - d.used
+	if granted > n {
+		granted = n
+	}
+	if granted < 0 {
+		granted = 0
+	}
+	d.used += granted
+	metrics.DeleteBudgetUsed.Set(float64(d.used))
+	return granted, d.start.Add(d.window)
+}
+
+// refund gives back deletions that were taken but not used. Ones taken in a
+// window that has since ended are dropped.
+func (d *deleteBudget) refund(now time.Time, n int) {
+	if d == nil || n <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.start) >= d.window {
+		return
+	}
+	d.used -= n
+	if d.used < 0 {
+		d.used = 0
+	}
+	metrics.DeleteBudgetUsed.Set(float64(d.used))
+}
+
+// usage reports the deletions so far in the current window.
+func (d *deleteBudget) usage(now time.Time) (used, limit int, reset time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(now)
+	return d.used, d.limit, d.start.Add(d.window)
+}
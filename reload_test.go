@@ -0,0 +1,102 @@
+package autodelete_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+func TestReloadCounts(t *testing.T) {
+	dir := t.TempDir()
+	h := autodeletetest.New(t, autodelete.Config{DataDir: dir, GuildWorkers: -1})
+	changed := h.AddChannel("changed")
+	removed := h.AddChannel("removed")
+	same := h.AddChannel("same")
+	added := h.AddChannel("added")
+	for _, ch := range []string{changed, removed, same} {
+		h.Set(ch, "1h")
+	}
+
+	orig, err := ioutil.ReadFile(filepath.Join(dir, changed+".yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := bytes.Replace(orig, []byte("live_time: 1h0m0s"), []byte("live_time: 2h0m0s"), 1)
+	if bytes.Equal(orig, edited) {
+		t.Fatalf("no live_time in\n%s", orig)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, changed+".yml"), edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, added+".yml"), orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, removed+".yml")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := h.Bot.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (autodelete.ReloadResult{Added: 1, Removed: 1, Changed: 1}); res != want {
+		t.Errorf("Reload() = %+v, want %+v", res, want)
+	}
+	waitQueued(t, h, added, true)
+	waitQueued(t, h, removed, false)
+	for _, ch := range []string{changed, same} {
+		if _, err := h.Bot.ReapNow(ch); err == autodelete.ErrNotManaged {
+			t.Errorf("channel %s not managed after reload", ch)
+		}
+	}
+}
+
+// A changed channel is swapped for its new settings at once, never missing
+// from the bot while the new one is being set up.
+func TestReloadNeverDropsChannel(t *testing.T) {
+	dir := t.TempDir()
+	h := autodeletetest.New(t, autodelete.Config{DataDir: dir})
+	ch := h.AddChannel("general")
+	h.Set(ch, "1h")
+	path := filepath.Join(dir, ch+".yml")
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := bytes.Replace(orig, []byte("live_time: 1h0m0s"), []byte("live_time: 2h0m0s"), 1)
+	if err := ioutil.WriteFile(path, edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload looks the channel up while setting up the new one
+	var armed int32 = 1
+	var lookups, missing int32
+	h.OnRequest(func(method, path string) {
+		if method != "GET" || path != "channels/"+ch || !atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			return
+		}
+		atomic.AddInt32(&lookups, 1)
+		if _, err := h.Bot.ReapNow(ch); err == autodelete.ErrNotManaged {
+			atomic.AddInt32(&missing, 1)
+		}
+	})
+	res, err := h.Bot.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed != 1 {
+		t.Fatalf("reload changed %d channels, want 1", res.Changed)
+	}
+	if atomic.LoadInt32(&lookups) != 1 {
+		t.Fatal("reload didn't look up the channel")
+	}
+	if atomic.LoadInt32(&missing) != 0 {
+		t.Error("channel was missing from the bot during the reload")
+	}
+}
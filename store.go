@@ -0,0 +1,375 @@
+package autodelete
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// A configStore persists channel settings and guild defaults.
+type configStore interface {
+	// LoadChannel returns an error satisfying os.IsNotExist if the channel
+	// has no saved config.
+	LoadChannel(id string) (managedChannelMarshal, error)
+	SaveChannel(conf managedChannelMarshal) error
+	DeleteChannel(id string) error
+	// EachChannel calls fn with every saved channel config in turn.
+	// Entries that can't be read are logged and skipped.
+	EachChannel(fn func(conf managedChannelMarshal)) error
+	LoadGuilds() ([]guildConfigMarshal, error)
+	SaveGuild(conf guildConfigMarshal) error
+}
+
+// fileStore keeps one YAML file per channel in dir, and one per guild in
+// dir/guilds.
+type fileStore struct {
+	dir string
+}
+
+func (s fileStore) channelPath(id string) string {
+	return filepath.Join(s.dir, id+".yml")
+}
+
+func (s fileStore) guildDir() string {
+	return filepath.Join(s.dir, "guilds")
+}
+
+func (s fileStore) LoadChannel(id string) (managedChannelMarshal, error) {
+	var conf managedChannelMarshal
+	by, err := ioutil.ReadFile(s.channelPath(id))
+	if err != nil {
+		return conf, err
+	}
+	err = yaml.Unmarshal(by, &conf)
+	conf.ID = id
+	return conf, err
+}
+
+func (s fileStore) SaveChannel(conf managedChannelMarshal) error {
+	by, err := yaml.Marshal(conf)
+	if err != nil {
+		panic(err)
+	}
+	return ioutil.WriteFile(s.channelPath(conf.ID), by, 0644)
+}
+
+func (s fileStore) DeleteChannel(id string) error {
+	return os.Remove(s.channelPath(id))
+}
+
+func (s fileStore) EachChannel(fn func(conf managedChannelMarshal)) error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range files {
+		n := v.Name()
+		if !strings.HasSuffix(n, ".yml") {
+			continue
+		}
+		conf, err := s.LoadChannel(strings.TrimSuffix(n, ".yml"))
+		if err != nil {
+			fmt.Println("Error loading configuration", n, err)
+			continue
+		}
+		fn(conf)
+	}
+	return nil
+}
+
+func (s fileStore) LoadGuilds() ([]guildConfigMarshal, error) {
+	files, err := ioutil.ReadDir(s.guildDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var guilds []guildConfigMarshal
+	for _, v := range files {
+		n := v.Name()
+		if !strings.HasSuffix(n, ".yml") {
+			continue
+		}
+		by, err := ioutil.ReadFile(filepath.Join(s.guildDir(), n))
+		if err != nil {
+			fmt.Println("Error loading guild configuration", n, err)
+			continue
+		}
+		var conf guildConfigMarshal
+		err = yaml.Unmarshal(by, &conf)
+		if err != nil {
+			fmt.Println("Error loading guild configuration", n, err)
+			continue
+		}
+		conf.ID = strings.TrimSuffix(n, ".yml")
+		guilds = append(guilds, conf)
+	}
+	return guilds, nil
+}
+
+func (s fileStore) SaveGuild(conf guildConfigMarshal) error {
+	by, err := yaml.Marshal(conf)
+	if err != nil {
+		panic(err)
+	}
+	err = os.MkdirAll(s.guildDir(), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.guildDir(), conf.ID+".yml"), by, 0644)
+}
+
+// sqlStore keeps configs in a database, one row per channel or guild. Each
+// row holds the same YAML the file store writes, so new settings don't need
+// a schema change.
+//
+// It is written for SQLite. The driver has to be linked into the binary;
+// see cmd/autodelete/sqlite.go.
+type sqlStore struct {
+	db *sql.DB
+}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS channels (id TEXT PRIMARY KEY, config TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS guilds (id TEXT PRIMARY KEY, config TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+`
+
+// The meta row set once the config files have been imported.
+const metaFilesImported = "files_imported"
+
+func openSQLStore(driver, url string) (*sqlStore, error) {
+	db, err := sql.Open(driver, url)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range strings.Split(sqlSchema, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "create tables")
+		}
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) LoadChannel(id string) (managedChannelMarshal, error) {
+	var conf managedChannelMarshal
+	var text string
+	err := s.db.QueryRow(`SELECT config FROM channels WHERE id = ?`, id).Scan(&text)
+	if err == sql.ErrNoRows {
+		return conf, os.ErrNotExist
+	} else if err != nil {
+		return conf, err
+	}
+	err = yaml.Unmarshal([]byte(text), &conf)
+	conf.ID = id
+	return conf, err
+}
+
+// execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func saveChannelRow(e execer, conf managedChannelMarshal) error {
+	by, err := yaml.Marshal(conf)
+	if err != nil {
+		panic(err)
+	}
+	_, err = e.Exec(`INSERT INTO channels (id, config) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET config = excluded.config`, conf.ID, string(by))
+	return err
+}
+
+func saveGuildRow(e execer, conf guildConfigMarshal) error {
+	by, err := yaml.Marshal(conf)
+	if err != nil {
+		panic(err)
+	}
+	_, err = e.Exec(`INSERT INTO guilds (id, config) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET config = excluded.config`, conf.ID, string(by))
+	return err
+}
+
+func (s *sqlStore) SaveChannel(conf managedChannelMarshal) error {
+	return saveChannelRow(s.db, conf)
+}
+
+func (s *sqlStore) DeleteChannel(id string) error {
+	_, err := s.db.Exec(`DELETE FROM channels WHERE id = ?`, id)
+	return err
+}
+
+// How many channel rows EachChannel reads at a time.
+const sqlPageSize = 100
+
+// EachChannel streams rows from the database a page at a time instead of
+// reading them all in first. No query is left open while fn runs, so fn can
+// write to the store.
+func (s *sqlStore) EachChannel(fn func(conf managedChannelMarshal)) error {
+	last := ""
+	for {
+		var page []managedChannelMarshal
+		scanned := 0
+		rows, err := s.db.Query(`SELECT id, config FROM channels WHERE id > ? ORDER BY id LIMIT ?`, last, sqlPageSize)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id, text string
+			err = rows.Scan(&id, &text)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			last = id
+			scanned++
+			var conf managedChannelMarshal
+			err = yaml.Unmarshal([]byte(text), &conf)
+			if err != nil {
+				fmt.Println("Error loading configuration", id, err)
+				continue
+			}
+			conf.ID = id
+			page = append(page, conf)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if scanned == 0 {
+			return nil
+		}
+		for _, conf := range page {
+			fn(conf)
+		}
+	}
+}
+
+func (s *sqlStore) LoadGuilds() ([]guildConfigMarshal, error) {
+	rows, err := s.db.Query(`SELECT id, config FROM guilds`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var guilds []guildConfigMarshal
+	for rows.Next() {
+		var id, text string
+		err = rows.Scan(&id, &text)
+		if err != nil {
+			return nil, err
+		}
+		var conf guildConfigMarshal
+		err = yaml.Unmarshal([]byte(text), &conf)
+		if err != nil {
+			fmt.Println("Error loading guild configuration", id, err)
+			continue
+		}
+		conf.ID = id
+		guilds = append(guilds, conf)
+	}
+	return guilds, rows.Err()
+}
+
+func (s *sqlStore) SaveGuild(conf guildConfigMarshal) error {
+	return saveGuildRow(s.db, conf)
+}
+
+// importFiles copies every config from the file store into a new database,
+// in one transaction, and records that it did. It only runs on the first
+// start after switching: once the import is recorded, the files are never
+// read again, even if every channel is later removed from the database.
+func (s *sqlStore) importFiles(src fileStore) (int, error) {
+	var done int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM meta WHERE key = ?`, metaFilesImported).Scan(&done)
+	if err != nil || done > 0 {
+		return 0, err
+	}
+	// A database from before the import was recorded has already had it if
+	// there is anything in it
+	var existing int
+	err = s.db.QueryRow(`SELECT (SELECT COUNT(*) FROM channels) + (SELECT COUNT(*) FROM guilds)`).Scan(&existing)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if existing == 0 {
+		n, err = importFilesTx(tx, src)
+	}
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)`, metaFilesImported, time.Now().UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// importFilesTx copies the file store's configs into the database.
+func importFilesTx(tx *sql.Tx, src fileStore) (int, error) {
+	var n int
+	var saveErr error
+	err := src.EachChannel(func(conf managedChannelMarshal) {
+		if saveErr == nil {
+			saveErr = saveChannelRow(tx, conf)
+			n++
+		}
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		err = saveErr
+	}
+	if err == nil {
+		var guilds []guildConfigMarshal
+		guilds, err = src.LoadGuilds()
+		for _, g := range guilds {
+			if err != nil {
+				break
+			}
+			err = saveGuildRow(tx, g)
+		}
+	}
+	return n, err
+}
+
+// openStore switches to the database named in the config, if any, importing
+// the existing config files the first time.
+func (b *Bot) openStore() error {
+	if b.Config.Database.Driver == "" {
+		return nil
+	}
+	st, err := openSQLStore(b.Config.Database.Driver, b.Config.Database.URL)
+	if err != nil {
+		return err
+	}
+	n, err := st.importFiles(fileStore{dir: b.dataDir()})
+	if err != nil {
+		st.db.Close()
+		return errors.Wrap(err, "import config files")
+	}
+	if n > 0 {
+		fmt.Println("[load] imported", n, "channel configs into the database")
+	}
+	b.store = st
+	return nil
+}
@@ -0,0 +1,194 @@
+package autodelete
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Threads are channels of their own under a text channel. A channel set up
+// with Threads gives each of its active threads that has no settings of its
+// own a copy of its settings, marked with InheritedFrom, the way a category
+// does for its channels. Turning Threads off or removing the channel's
+// settings removes the copies. Messages in a thread are read and deleted
+// through the same endpoints as any other channel's.
+//
+// The vendored discordgo speaks API v6, which predates threads: thread
+// messages don't come over its gateway, and it has no thread calls. So active
+// threads are listed with a raw v9 request (see sessionClient), and
+// syncThreads loads each managed thread's new messages every
+// threadSyncInterval. Messages in an archived thread can't be deleted, so
+// archived threads are skipped: a copy is removed when its thread is
+// archived, and made again if it comes back, and a thread with its own
+// settings waits until it comes back.
+
+// Thread channel types, which the vendored discordgo doesn't know.
+const (
+	channelTypeAnnouncementThread discordgo.ChannelType = 10
+	channelTypePublicThread       discordgo.ChannelType = 11
+	channelTypePrivateThread      discordgo.ChannelType = 12
+)
+
+func isThread(t discordgo.ChannelType) bool {
+	return t == channelTypeAnnouncementThread || t == channelTypePublicThread || t == channelTypePrivateThread
+}
+
+// errCodeThreadArchived is returned for changes to an archived thread.
+const errCodeThreadArchived = 50083
+
+// endpointActiveThreads lists a guild's threads that aren't archived. It is
+// not in API v6.
+func endpointActiveThreads(guildID string) string {
+	return discordgo.EndpointDiscord + "api/v9/guilds/" + guildID + "/threads/active"
+}
+
+// How often the bot runs SyncThreads on its own.
+const threadSyncInterval = 5 * time.Minute
+
+// threadTemplate is channelTemplate for copying a channel's settings to its
+// threads, which have no threads of their own.
+func threadTemplate(conf managedChannelMarshal) managedChannelMarshal {
+	conf = channelTemplate(conf)
+	conf.Threads = false
+	return conf
+}
+
+func (c *ManagedChannel) inheritedFrom() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.InheritedFrom
+}
+
+func (c *ManagedChannel) threadsEnabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Threads
+}
+
+// threadArchived handles a delete refused because the thread was archived
+// since the last sync. A copy of the parent's settings is removed. A thread
+// with its own settings keeps them, but is swapped for a fresh unloaded
+// channel, out of the queue, until syncThreads sees it active again and
+// loads it.
+func (b *Bot) threadArchived(channelID string) {
+	conf, err := b.readChannelConfig(channelID)
+	if err != nil || conf.InheritedFrom != "" {
+		b.deleteChannelConfig(channelID)
+		return
+	}
+	conf.ID = channelID
+	mCh, err := InitChannel(b, conf)
+	if err != nil {
+		fmt.Println("[thrd] could not reset archived thread", channelID, err)
+		return
+	}
+	b.mu.Lock()
+	oldCh := b.channels[channelID]
+	b.channels[channelID] = mCh
+	b.mu.Unlock()
+	if oldCh != nil {
+		b.reaper.Remove(oldCh)
+	}
+}
+
+// SyncThreads brings managed threads up to date: active threads in channels
+// set up with Threads get the channel's settings, managed threads get their
+// new messages loaded, and copies are removed from threads that were
+// archived or whose channel stopped sharing its settings. Managed forums get
+// their posts reloaded. The bot runs it every threadSyncInterval.
+func (b *Bot) SyncThreads() {
+	b.syncThreads("")
+}
+
+// syncThreads is SyncThreads for the threads of one channel, or of every
+// channel if parentID is empty.
+func (b *Bot) syncThreads(parentID string) {
+	b.threadMu.Lock()
+	defer b.threadMu.Unlock()
+
+	// Channels sharing their settings, by guild, the managed threads, and
+	// the managed forums
+	parents := make(map[string]map[string]managedChannelMarshal)
+	var threads, forums []*ManagedChannel
+	b.mu.RLock()
+	for id, ch := range b.channels {
+		if ch != nil && ch.isForum() && parentID == "" {
+			forums = append(forums, ch)
+		}
+		switch {
+		case ch == nil:
+		case isThread(ch.Channel.Type):
+			if parentID == "" || ch.inheritedFrom() == parentID {
+				threads = append(threads, ch)
+			}
+		case parentID == "" || id == parentID:
+			if conf := ch.Export(); conf.Threads {
+				guildID := ch.Channel.GuildID
+				if parents[guildID] == nil {
+					parents[guildID] = make(map[string]managedChannelMarshal)
+				}
+				parents[guildID][id] = threadTemplate(conf)
+			}
+		}
+	}
+	b.mu.RUnlock()
+
+	guilds := make(map[string]bool)
+	for guildID := range parents {
+		guilds[guildID] = true
+	}
+	for _, ch := range threads {
+		guilds[ch.Channel.GuildID] = true
+	}
+	active := make(map[string]bool)
+	failed := make(map[string]bool)
+	for guildID := range guilds {
+		list, err := b.client.ActiveThreads(guildID)
+		if err != nil {
+			fmt.Println("[thrd] could not list the threads in", guildID, err)
+			failed[guildID] = true
+			continue
+		}
+		for _, th := range list {
+			if th.Metadata.Archived {
+				continue
+			}
+			active[th.ID] = true
+			conf, ok := parents[guildID][th.ParentID]
+			if !ok {
+				continue
+			}
+			if _, err := b.inheritSettings(th.ID, th.ParentID, conf); err != nil {
+				fmt.Println("[thrd] could not apply settings to thread", th.ID, err)
+			}
+		}
+	}
+
+	for _, ch := range threads {
+		id, guildID := ch.Channel.ID, ch.Channel.GuildID
+		if failed[guildID] || !b.managing(ch) {
+			// Unknown, or just replaced with new settings
+			continue
+		}
+		if from := ch.inheritedFrom(); from != "" {
+			if _, ok := parents[guildID][from]; !ok || !active[id] {
+				fmt.Println("[thrd] thread", id, "was archived or", from, "stopped sharing its settings - removing them")
+				b.deleteChannelConfig(id)
+				continue
+			}
+		}
+		if !active[id] {
+			// Has its own settings; skipped while it is archived
+			continue
+		}
+		if err := ch.LoadBacklog(); err != nil {
+			fmt.Println("[thrd] could not load new messages in thread", id, err)
+		}
+	}
+	for _, ch := range forums {
+		if !failed[ch.Channel.GuildID] && b.managing(ch) {
+			ch.LoadBacklog()
+		}
+	}
+}
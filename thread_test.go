@@ -0,0 +1,97 @@
+package autodelete_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/riking/AutoDelete"
+	"github.com/riking/AutoDelete/autodeletetest"
+)
+
+func TestThreadsGetParentSettings(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{GuildWorkers: -1})
+	parent := h.AddChannel("parent")
+	thread := h.AddThread(parent, "thread")
+	old := h.Post(thread, "old")
+
+	h.Set(parent, "1h", "threads")
+	waitQueued(t, h, thread, true)
+
+	// Thread messages don't come over the gateway, so they are found by
+	// syncing
+	fresh := h.Post(thread, "fresh")
+	h.Bot.SyncThreads()
+	h.Advance(61 * time.Minute)
+	got := h.WaitDeleted(2)
+	want := map[string]bool{old: true, fresh: true}
+	for _, id := range got {
+		delete(want, id)
+	}
+	if len(want) != 0 {
+		t.Errorf("deleted %v, missing %v", got, want)
+	}
+}
+
+func TestArchivedThreadSkipped(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{GuildWorkers: -1})
+	parent := h.AddChannel("parent")
+	thread := h.AddThread(parent, "thread")
+	h.Set(parent, "1h", "threads")
+	waitQueued(t, h, thread, true)
+
+	h.ArchiveThread(thread, true)
+	h.Bot.SyncThreads()
+	waitQueued(t, h, thread, false)
+
+	h.ArchiveThread(thread, false)
+	h.Bot.SyncThreads()
+	waitQueued(t, h, thread, true)
+
+	// Archived between syncs: the failed delete drops the copy
+	msg := h.Post(thread, "hello")
+	h.Bot.SyncThreads()
+	h.ArchiveThread(thread, true)
+	h.Advance(61 * time.Minute)
+	h.WaitRequest("DELETE", "/messages/"+msg, 1)
+	waitQueued(t, h, thread, false)
+	if n := len(h.Messages(thread)); n != 1 {
+		t.Errorf("archived thread has %d messages, want 1", n)
+	}
+}
+
+func TestArchivedThreadKeepsOwnSettings(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{GuildWorkers: -1})
+	parent := h.AddChannel("parent")
+	thread := h.AddThread(parent, "thread")
+	h.Set(thread, "1h")
+
+	msg := h.Post(thread, "hello")
+	h.Bot.SyncThreads()
+	h.ArchiveThread(thread, true)
+	h.Advance(61 * time.Minute)
+	h.WaitRequest("DELETE", "/messages/"+msg, 1)
+	waitQueued(t, h, thread, false)
+
+	h.ArchiveThread(thread, false)
+	h.Bot.SyncThreads()
+	if got := h.WaitDeleted(1); got[0] != msg {
+		t.Errorf("deleted %v, want %s", got, msg)
+	}
+}
+
+func TestThreadsTurnedOff(t *testing.T) {
+	h := autodeletetest.New(t, autodelete.Config{GuildWorkers: -1})
+	parent := h.AddChannel("parent")
+	copied := h.AddThread(parent, "copied")
+	own := h.AddThread(parent, "own")
+	h.Set(own, "2h")
+	h.Set(parent, "1h", "threads")
+	waitQueued(t, h, copied, true)
+
+	h.Set(parent, "1h")
+	waitQueued(t, h, copied, false)
+	time.Sleep(50 * time.Millisecond)
+	if !queued(h, own) {
+		t.Error("thread with its own settings lost them")
+	}
+}